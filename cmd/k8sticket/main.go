@@ -1,29 +1,97 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/ipb-halle/k8sTicket/pkg/k8sfunctions"
+	"github.com/ipb-halle/k8sTicket/pkg/proxyfunctions"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
 )
 
 //main This is the k8sTicket application.
+// "k8sticket simulate" runs the offline scaling simulator instead, see simulate.
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "simulate" {
+		os.Exit(simulate(os.Args[2:]))
+	}
+	storeType := flag.String("ticket-store", k8sfunctions.StoreMemory,
+		"where active tickets are kept: \""+k8sfunctions.StoreMemory+"\" or \""+k8sfunctions.StoreSecret+
+			"\" (survives restarts of k8sTicket)")
+	ha := flag.Bool("ha", false,
+		"high-availability mode: run several replicas that share their tickets, only the elected leader scales Pods (requires -ticket-store=secret)")
+	leaseName := flag.String("lease-name", "k8sticket", "name of the coordination Lease used for the leader election in high-availability mode")
+	signingSecret := flag.String("signing-secret", "k8sticket-signing-keys", "name of the Secret with the keys for signing tickets")
+	ticketMaxAge := flag.Duration("ticket-max-age", 24*time.Hour, "maximal lifetime of a signed ticket")
+	legacyTokens := flag.Bool("legacy-tokens", false,
+		"hand out the tokens to home pages without the JSON protocol, which set the session cookie in JavaScript (not HttpOnly)")
+	listen := flag.String("listen", "",
+		"serve all applications on this address (e.g. \":9001\") instead of the port annotation of each Deployment")
+	drainTimeout := flag.Duration("drain-timeout", k8sfunctions.DefaultDrainTimeout,
+		"how long the existing tickets of a disabled application are served before its proxy is stopped")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 25*time.Second,
+		"how long the existing tickets are served after SIGTERM before k8sTicket exits (keep it below terminationGracePeriodSeconds)")
+	kubeconfig := flag.String("kubeconfig", "",
+		"path to a kubeconfig file for running outside of the cluster (default: in-cluster configuration, or $KUBECONFIG or ~/.kube/config outside of a cluster)")
+	kubeContext := flag.String("context", "", "the context of the kubeconfig to use (default: the current context)")
+	namespaceFlag := flag.String("namespace", "",
+		"comma separated list of the namespaces to watch (default: the namespace of k8sTicket, or of the context of the kubeconfig)")
+	namespaceSelector := flag.String("namespace-selector", "",
+		"watch the namespaces matching this label selector (e.g. \"k8sticket=enabled\") instead of -namespace")
+	allNamespaces := flag.Bool("all-namespaces", false, "watch all namespaces instead of -namespace")
+	flag.Parse()
 	log.Println("main: Starting!")
+	if *storeType != k8sfunctions.StoreMemory && *storeType != k8sfunctions.StoreSecret {
+		log.Println("main: unknown ticket store", *storeType)
+		os.Exit(1)
+	}
+	if *ha && *storeType != k8sfunctions.StoreSecret {
+		log.Println("main: high-availability mode requires -ticket-store=" + k8sfunctions.StoreSecret)
+		os.Exit(1)
+	}
 
-	namespace := k8sfunctions.Namespace()
+	config, contextNamespace, err := k8sfunctions.RestConfig(*kubeconfig, *kubeContext)
+	if err != nil {
+		log.Println("main: Error", err)
+		os.Exit(1)
+	}
+	//the signing keys and the Lease are kept in the namespace of k8sTicket
+	namespace := contextNamespace
+	if namespace == "" {
+		namespace = k8sfunctions.Namespace()
+	}
+	watched := *namespaceFlag
+	if watched == "" && *namespaceSelector == "" && !*allNamespaces {
+		watched = namespace
+	}
 
-	proxymap := k8sfunctions.NewProxyMap()
+	proxymap := k8sfunctions.NewProxyMap(*storeType)
+	proxymap.Signer = proxyfunctions.NewSigner(*ticketMaxAge)
+	proxymap.DrainTimeout = *drainTimeout
+	proxymap.LegacyTokens = *legacyTokens
+	if *listen != "" {
+		proxymap.SharedRouter = k8sfunctions.NewSharedRouter(*listen)
+		proxymap.SharedRouter.Start()
+	}
 	metric := k8sfunctions.NewPMetric()
 	prometheus.MustRegister(metric.CurrentFreeTickets)
 	prometheus.MustRegister(metric.CurrentScaledPods)
 	prometheus.MustRegister(metric.CurrentUsers)
 	prometheus.MustRegister(metric.TotalUsers)
+	prometheus.MustRegister(metric.Degraded)
+	prometheus.MustRegister(metric.PrewarmActive)
+	prometheus.MustRegister(metric.ExpectedArrivals)
+	prometheus.MustRegister(metric.PredictedSpare)
 	http.Handle("/metrics", promhttp.Handler())
 
 	// Start prometheus metric
@@ -35,30 +103,115 @@ func main() {
 		}
 	}()
 
-	deploymentController := k8sfunctions.NewDeploymentController(namespace)
-	deploymentMetaController := k8sfunctions.NewDeploymentMetaController(namespace)
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		log.Println("main: Error", err)
+		os.Exit(1)
+	}
+	proxymap.Namespaces, err = k8sfunctions.NewNamespaceScope(clientset, watched, *namespaceSelector, *allNamespaces)
+	if err != nil {
+		log.Println("main: Error", err)
+		os.Exit(1)
+	}
+	if proxymap.Namespaces.Single() {
+		//a single namespace to watch also holds the signing keys and the Lease
+		namespace = proxymap.Namespaces.InformerNamespaces()[0]
+	}
+	log.Println("main: watching", proxymap.Namespaces.String())
+	proxymap.Namespaces.Run()
 
-	deploymentController.Informer.AddEventHandler(
-		k8sfunctions.NewDeploymentHandlerForK8sconfig(deploymentController.Clientset, namespace, proxymap, &metric))
-	go deploymentController.Informer.Run(deploymentController.Stopper)
+	proxymap.Reporter = k8sfunctions.NewConfigReporter(clientset)
+	if err := k8sfunctions.EnsureSigningKeys(clientset, namespace, *signingSecret); err != nil {
+		log.Println("main: signing keys: ", err)
+		os.Exit(1)
+	}
+	signingKeysController := k8sfunctions.NewSigningKeysController(clientset, namespace, *signingSecret, proxymap.Signer)
+	go signingKeysController.Informer.Run(signingKeysController.Stopper)
+	if !cache.WaitForCacheSync(signingKeysController.Stopper, signingKeysController.Informer.HasSynced) ||
+		!proxymap.Signer.HasKeys() {
+		log.Println("main: signing keys: no valid keys in the Secret " + *signingSecret)
+		os.Exit(1)
+	}
 
-	//Using the clientset of deploymentController is not a mistake,
-	//it's done on purpose because it will be used by the PodController!
-	deploymentMetaController.Informer.AddEventHandler(
-		k8sfunctions.NewMetaDeploymentHandlerForK8sconfig(deploymentController.Clientset, namespace, proxymap, &metric))
-	go deploymentMetaController.Informer.Run(deploymentMetaController.Stopper)
+	leaderCtx, stopLeading := context.WithCancel(context.Background())
+	if *ha {
+		identity, ok := os.LookupEnv("POD_NAME")
+		if !ok {
+			identity, err = os.Hostname()
+			if err != nil {
+				log.Println("main: Error", err)
+				os.Exit(1)
+			}
+		}
+		proxymap.Leadership = k8sfunctions.NewLeadership(identity)
+		proxymap.Leadership.OnStartedLeading = func() {
+			proxymap.Mux.Lock()
+			for _, proxy := range proxymap.All() {
+				proxy.TriggerScaler()
+			}
+			proxymap.Mux.Unlock()
+		}
+		go proxymap.Leadership.Run(leaderCtx, clientset, namespace, *leaseName)
+	}
+
+	proxymap.Pods = k8sfunctions.NewPodCache(clientset, proxymap.Namespaces.InformerNamespaces())
+	proxymap.Pods.Run()
+
+	//one controller per namespace of an explicit list, or one for all namespaces
+	deploymentControllers := make(map[string]k8sfunctions.Controller)
+	for _, ns := range proxymap.Namespaces.InformerNamespaces() {
+		deploymentControllers[ns] = k8sfunctions.NewDeploymentController(clientset, ns)
+	}
+	deploymentReconciler := k8sfunctions.NewDeploymentReconciler(clientset, deploymentControllers, proxymap, &metric)
+	for _, controller := range deploymentControllers {
+		go controller.Informer.Run(controller.Stopper)
+	}
+
+	//the TicketApps are reconciled by the DeploymentReconciler as well
+	ticketAppControllers := make(map[string]k8sfunctions.Controller)
+	if k8sfunctions.TicketAppsServed(clientset.Discovery()) {
+		client, err := dynamic.NewForConfig(config)
+		if err != nil {
+			log.Println("main: Error", err)
+			os.Exit(1)
+		}
+		for _, ns := range proxymap.Namespaces.InformerNamespaces() {
+			ticketAppControllers[ns] = k8sfunctions.NewTicketAppController(client, ns)
+		}
+		deploymentReconciler.AddTicketAppControllers(client, ticketAppControllers)
+		for _, controller := range ticketAppControllers {
+			go controller.Informer.Run(controller.Stopper)
+		}
+	} else {
+		log.Println("main: the TicketApp CustomResourceDefinition is not installed, only Deployments are watched")
+	}
+	reconcilerStopper := make(chan struct{})
+	go deploymentReconciler.Run(reconcilerStopper)
 	//Let the subroutines do their job until we receive a exit message from the OS
 
 	exitSignal := make(chan os.Signal, 1)
 	signal.Notify(exitSignal, syscall.SIGINT, syscall.SIGTERM)
 	<-exitSignal
 	log.Println("main: Exiting!")
-	close(deploymentController.Stopper)
+	stopLeading()
+	close(reconcilerStopper)
+	for _, controller := range deploymentControllers {
+		close(controller.Stopper)
+	}
 	log.Println("main: DeploymentController stopped!")
-	close(deploymentMetaController.Stopper)
-	log.Println("main: DeploymentMetaController stopped!")
-	for _, proxy := range proxymap.Deployments {
-		proxy.Stop()
+	for _, controller := range ticketAppControllers {
+		close(controller.Stopper)
+	}
+	if len(ticketAppControllers) > 0 {
+		log.Println("main: TicketAppController stopped!")
+	}
+	close(signingKeysController.Stopper)
+	log.Println("main: draining all applications for at most", shutdownTimeout.String())
+	proxymap.Shutdown("k8sTicket is restarting. Please try again in a moment.", *shutdownTimeout)
+	proxymap.Pods.Stop()
+	proxymap.Namespaces.Stop()
+	if proxymap.SharedRouter != nil {
+		proxymap.SharedRouter.Stop()
 	}
 	log.Println("Bye!")
 }
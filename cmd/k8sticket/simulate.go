@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ipb-halle/k8sTicket/pkg/k8sfunctions"
+)
+
+//the prefix of the annotations that can be given as suffix to -set
+const annotationPrefix = "ipb-halle.de/k8sticket."
+
+//annotationFlags This is the list of annotations given by -set.
+type annotationFlags map[string]string
+
+//String Returns the annotations for the help of the flag.
+func (annotations annotationFlags) String() string {
+	pairs := make([]string, 0, len(annotations))
+	for key, value := range annotations {
+		pairs = append(pairs, key+"="+value)
+	}
+	return strings.Join(pairs, ",")
+}
+
+//Set Adds an annotation key=value. A key without the prefix ipb-halle.de/k8sticket.
+// is an annotation of the Deployment, e.g. "deployment.tickets.spare".
+func (annotations annotationFlags) Set(value string) error {
+	kv := strings.SplitN(value, "=", 2)
+	if len(kv) != 2 || kv[0] == "" {
+		return errors.New("expected key=value")
+	}
+	key := kv[0]
+	if !strings.HasPrefix(key, annotationPrefix) {
+		key = annotationPrefix + "deployment." + key
+	}
+	annotations[key] = kv[1]
+	return nil
+}
+
+//parseSeconds Parses a duration, either a number of seconds or a Go duration like "90s" or "5m".
+func parseSeconds(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+	return time.ParseDuration(value)
+}
+
+//readTrace Reads the arrivals of a trace file. A CSV file has the columns arrival, duration and
+// optionally patience, a header line is skipped. A JSON file is a list of objects with these keys.
+// The values are seconds or Go durations, the arrivals are relative to the beginning of the trace.
+// Users without patience get the patience given by the flag.
+func readTrace(path string, patience time.Duration) ([]k8sfunctions.Arrival, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var rows [][]string
+	if strings.ToLower(filepath.Ext(path)) == ".json" {
+		var entries []map[string]interface{}
+		if err := json.NewDecoder(file).Decode(&entries); err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			row := make([]string, 3)
+			for i, key := range []string{"arrival", "duration", "patience"} {
+				if value, ok := entry[key]; ok {
+					row[i] = fmt.Sprint(value)
+				}
+			}
+			rows = append(rows, row)
+		}
+	} else {
+		reader := csv.NewReader(file)
+		reader.FieldsPerRecord = -1
+		reader.TrimLeadingSpace = true
+		reader.Comment = '#'
+		for {
+			row, err := reader.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if len(rows) == 0 && len(row) > 0 {
+				if _, err := parseSeconds(row[0]); err != nil {
+					//the header
+					continue
+				}
+			}
+			rows = append(rows, row)
+		}
+	}
+	arrivals := make([]k8sfunctions.Arrival, 0, len(rows))
+	for i, row := range rows {
+		if len(row) < 2 {
+			return nil, fmt.Errorf("%s: entry %d: expected arrival and duration", path, i+1)
+		}
+		arrival := k8sfunctions.Arrival{Patience: patience}
+		if arrival.At, err = parseSeconds(row[0]); err != nil {
+			return nil, fmt.Errorf("%s: entry %d: arrival: %v", path, i+1, err)
+		}
+		if arrival.Duration, err = parseSeconds(row[1]); err != nil {
+			return nil, fmt.Errorf("%s: entry %d: duration: %v", path, i+1, err)
+		}
+		if len(row) > 2 && strings.TrimSpace(row[2]) != "" {
+			if arrival.Patience, err = parseSeconds(row[2]); err != nil {
+				return nil, fmt.Errorf("%s: entry %d: patience: %v", path, i+1, err)
+			}
+		}
+		arrivals = append(arrivals, arrival)
+	}
+	return arrivals, nil
+}
+
+//startupDelay Returns the distribution of the startup delays of the Pods: a fixed delay like "30s",
+// a uniform distribution like "20s-60s", an exponential distribution like "exp:40s" with the mean
+// 40s or a normal distribution like "normal:40s,10s" with the mean 40s and the deviation 10s.
+func startupDelay(spec string, random *rand.Rand) (func() time.Duration, error) {
+	switch {
+	case strings.HasPrefix(spec, "exp:"):
+		mean, err := parseSeconds(strings.TrimPrefix(spec, "exp:"))
+		if err != nil {
+			return nil, err
+		}
+		return func() time.Duration { return time.Duration(random.ExpFloat64() * float64(mean)) }, nil
+	case strings.HasPrefix(spec, "normal:"):
+		params := strings.SplitN(strings.TrimPrefix(spec, "normal:"), ",", 2)
+		if len(params) != 2 {
+			return nil, errors.New("expected normal:<mean>,<deviation>")
+		}
+		mean, err := parseSeconds(params[0])
+		if err != nil {
+			return nil, err
+		}
+		deviation, err := parseSeconds(params[1])
+		if err != nil {
+			return nil, err
+		}
+		return func() time.Duration {
+			if delay := time.Duration(random.NormFloat64()*float64(deviation)) + mean; delay > 0 {
+				return delay
+			}
+			return 0
+		}, nil
+	case strings.Contains(spec, "-"):
+		bounds := strings.SplitN(spec, "-", 2)
+		min, err := parseSeconds(bounds[0])
+		if err != nil {
+			return nil, err
+		}
+		max, err := parseSeconds(bounds[1])
+		if err != nil {
+			return nil, err
+		}
+		if max < min {
+			return nil, errors.New("the maximum is less than the minimum")
+		}
+		return func() time.Duration { return min + time.Duration(random.Int63n(int64(max-min)+1)) }, nil
+	default:
+		delay, err := parseSeconds(spec)
+		if err != nil {
+			return nil, err
+		}
+		return func() time.Duration { return delay }, nil
+	}
+}
+
+//simulate This is the simulate command of k8sTicket. It replays a trace of user arrivals against
+// the scaling of an application in virtual time and prints the waiting times, the rejected users
+// and the pod-hours, see k8sfunctions.Simulate. It returns the exit code.
+func simulate(args []string) int {
+	flags := flag.NewFlagSet("simulate", flag.ExitOnError)
+	trace := flags.String("trace", "", "CSV or JSON file with the arrival, the session duration and optionally the patience of each user")
+	annotations := annotationFlags{}
+	flags.Var(annotations, "set",
+		"annotation of the Deployment as key=value, e.g. tickets.spare=4 for ipb-halle.de/k8sticket.deployment.tickets.spare (repeatable)")
+	startup := flags.String("startup", "30s",
+		"startup delay of the Pods: a fixed delay (\"30s\"), uniform (\"20s-60s\"), exponential (\"exp:40s\") or normal (\"normal:40s,10s\")")
+	patience := flags.Duration("patience", 10*time.Minute, "how long a user waits for a ticket before giving up, 0 means forever")
+	start := flags.String("start", "", "the time of the beginning of the trace in RFC 3339 for the pre-warming schedules (default: now)")
+	seed := flags.Int64("seed", 1, "seed of the random startup delays")
+	verbose := flags.Bool("v", false, "print the log of the Serverlist and the scaler")
+	//nolint:errcheck
+	flags.Parse(args)
+	if *trace == "" {
+		fmt.Fprintln(os.Stderr, "simulate: -trace is required")
+		flags.Usage()
+		return 2
+	}
+	arrivals, err := readTrace(*trace, *patience)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "simulate:", err)
+		return 1
+	}
+	delay, err := startupDelay(*startup, rand.New(rand.NewSource(*seed)))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "simulate: -startup:", err)
+		return 2
+	}
+	begin := time.Now()
+	if *start != "" {
+		if begin, err = time.Parse(time.RFC3339, *start); err != nil {
+			fmt.Fprintln(os.Stderr, "simulate: -start:", err)
+			return 2
+		}
+		begin = begin.Local()
+	}
+	if !*verbose {
+		log.SetOutput(ioutil.Discard)
+	}
+	report, errs := k8sfunctions.Simulate(k8sfunctions.SimulationConfig{
+		Annotations: annotations,
+		Arrivals:    arrivals,
+		Startup:     delay,
+		Start:       begin,
+	})
+	for _, err := range errs {
+		fmt.Fprintln(os.Stderr, "simulate:", err)
+	}
+	fmt.Printf("users:       %d\n", report.Users)
+	fmt.Printf("served:      %d\n", report.Served)
+	fmt.Printf("rejected:    %d\n", report.Rejected)
+	if report.Unfinished > 0 {
+		fmt.Printf("unfinished:  %d\n", report.Unfinished)
+	}
+	fmt.Printf("wait:        mean %v, median %v, p95 %v, max %v\n",
+		report.MeanWait, report.MedianWait, report.P95Wait, report.MaxWait)
+	fmt.Printf("pods:        %d created, at most %d at once\n", report.PodsCreated, report.MaxPods)
+	fmt.Printf("pod-hours:   %.2f\n", report.PodHours)
+	fmt.Printf("simulated:   %v\n", report.Duration)
+	return 0
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ipb-halle/k8sTicket/pkg/k8sfunctions"
+)
+
+func TestParseSeconds(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+		err   bool
+	}{
+		{"30", 30 * time.Second, false},
+		{" 1.5 ", 1500 * time.Millisecond, false},
+		{"90s", 90 * time.Second, false},
+		{"5m", 5 * time.Minute, false},
+		{"1h30m", 90 * time.Minute, false},
+		{"", 0, true},
+		{"soon", 0, true},
+	}
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			got, err := parseSeconds(test.value)
+			if (err != nil) != test.err || got != test.want {
+				t.Errorf("parseSeconds(%q) = %v, %v, expected %v, error %v", test.value, got, err, test.want, test.err)
+			}
+		})
+	}
+}
+
+func TestReadTrace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	const patience = 10 * time.Minute
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		want    []k8sfunctions.Arrival
+		err     bool
+	}{
+		{"csv with header", "trace.csv", "arrival,duration,patience\n0,600\n30, 5m, 1m\n",
+			[]k8sfunctions.Arrival{{At: 0, Duration: 10 * time.Minute, Patience: patience},
+				{At: 30 * time.Second, Duration: 5 * time.Minute, Patience: time.Minute}}, false},
+		{"csv with comments and empty patience", "trace.csv", "# users of monday\n60,120,\n",
+			[]k8sfunctions.Arrival{{At: time.Minute, Duration: 2 * time.Minute, Patience: patience}}, false},
+		{"json", "trace.json", `[{"arrival": 0, "duration": "10m"}, {"arrival": "1m", "duration": 60, "patience": 0}]`,
+			[]k8sfunctions.Arrival{{At: 0, Duration: 10 * time.Minute, Patience: patience},
+				{At: time.Minute, Duration: time.Minute, Patience: 0}}, false},
+		{"empty csv", "trace.csv", "", []k8sfunctions.Arrival{}, false},
+		{"missing duration", "trace.csv", "0\n", nil, true},
+		{"invalid duration", "trace.csv", "0,long\n", nil, true},
+		{"invalid arrival after the first line", "trace.csv", "0,60\nlater,60\n", nil, true},
+		{"invalid json", "trace.json", `{"arrival": 0}`, nil, true},
+	}
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(dir, string(rune('a'+i))+test.file)
+			if err := ioutil.WriteFile(path, []byte(test.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			got, err := readTrace(path, patience)
+			if test.err {
+				if err == nil {
+					t.Fatalf("no error, arrivals %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("arrivals %v, expected %v", got, test.want)
+			}
+		})
+	}
+	if _, err := readTrace(filepath.Join(dir, "missing.csv"), patience); err == nil {
+		t.Error("a missing trace was read")
+	}
+}
+
+func TestStartupDelay(t *testing.T) {
+	tests := []struct {
+		spec     string
+		min, max time.Duration
+		err      bool
+	}{
+		{spec: "30s", min: 30 * time.Second, max: 30 * time.Second},
+		{spec: "45", min: 45 * time.Second, max: 45 * time.Second},
+		{spec: "20s-60s", min: 20 * time.Second, max: 60 * time.Second},
+		{spec: "exp:40s", min: 0, max: time.Duration(1<<63 - 1)},
+		{spec: "normal:40s,10s", min: 0, max: time.Duration(1<<63 - 1)},
+		{spec: "60s-20s", err: true},
+		{spec: "exp:soon", err: true},
+		{spec: "normal:40s", err: true},
+		{spec: "normal:40s,wide", err: true},
+		{spec: "fast", err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.spec, func(t *testing.T) {
+			delay, err := startupDelay(test.spec, rand.New(rand.NewSource(1)))
+			if test.err {
+				if err == nil {
+					t.Fatal("no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var sum time.Duration
+			const samples = 1000
+			for i := 0; i < samples; i++ {
+				d := delay()
+				if d < test.min || d > test.max {
+					t.Fatalf("delay %v is not between %v and %v", d, test.min, test.max)
+				}
+				sum += d
+			}
+			if mean := sum / samples; mean < 30*time.Second || mean > 50*time.Second {
+				t.Errorf("mean delay %v", mean)
+			}
+		})
+	}
+}
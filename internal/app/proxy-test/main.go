@@ -30,9 +30,10 @@ func main() {
 	//nolint:errcheck
 	go time.AfterFunc(60*time.Second, func() { list.AddServer("four", 1, proxyfunctions.Config{Path: "/", Host: "127.0.0.1:3838"}) })
 	// go time.AfterFunc(90*time.Second, func() { list.AddServer(1, proxyfunctions.Config{Path: "/", Host: "127.0.0.1:3838"}) })
-	r.HandleFunc("/"+list.Prefix+"/{s}/{serverpath:.*}", list.MainHandler)
-	r.HandleFunc("/"+list.Prefix, list.ServeHome)
-	r.HandleFunc("/"+list.Prefix+"/", list.ServeHome)
-	r.HandleFunc("/"+list.Prefix+"/ws", list.ServeWs)
+	r.HandleFunc("/"+list.Prefix()+"/claim/{c}", list.ServeClaim)
+	r.HandleFunc("/"+list.Prefix()+"/{s}/{serverpath:.*}", list.MainHandler)
+	r.HandleFunc("/"+list.Prefix(), list.ServeHome)
+	r.HandleFunc("/"+list.Prefix()+"/", list.ServeHome)
+	r.HandleFunc("/"+list.Prefix()+"/ws", list.ServeWs)
 	log.Fatal(http.ListenAndServe(":9001", r))
 }
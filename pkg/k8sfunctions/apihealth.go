@@ -0,0 +1,120 @@
+package k8sfunctions
+
+import (
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	//the delay before the first retry of a failed Kubernetes API call
+	apiRetryInitial = time.Second
+	//the maximal delay between two retries
+	apiRetryMax = 2 * time.Minute
+
+	//the message for the waiting clients of a degraded proxy
+	degradedMessage = "The cluster is not reachable at the moment, so waiting for a free application slot may take longer than usual. Please be patient."
+)
+
+//apiHealth This struct tracks the failing Kubernetes API calls of a proxy.
+// The proxy is degraded from the first failure until the next successful call.
+// In the meantime, the calls are retried with exponential backoff and jitter,
+// while the existing sessions are proxied as usual.
+// Developers: Lock the mux before you modify an object of this struct.
+type apiHealth struct {
+	mux       sync.Mutex
+	backoff   wait.Backoff
+	failures  int
+	lastError error
+	retryAt   time.Time
+	retrying  map[string]bool
+}
+
+//newAPIBackoff Returns the backoff for the retries of the Kubernetes API calls.
+func newAPIBackoff() wait.Backoff {
+	return wait.Backoff{
+		Duration: apiRetryInitial,
+		Factor:   2,
+		Jitter:   0.5,
+		Steps:    math.MaxInt32,
+		Cap:      apiRetryMax,
+	}
+}
+
+//newAPIHealth Creates the apiHealth of a proxy that is not degraded.
+func newAPIHealth() *apiHealth {
+	return &apiHealth{backoff: newAPIBackoff(), retrying: make(map[string]bool)}
+}
+
+//apiFailed This method records a failed Kubernetes API call of the operation op.
+// The first failure marks the proxy as degraded in the metrics and in the messages
+// for the waiting clients. It returns the delay until the next try.
+func (proxy *ProxyForDeployment) apiFailed(op string, err error) time.Duration {
+	proxy.health.mux.Lock()
+	defer proxy.health.mux.Unlock()
+	if proxy.health.failures == 0 {
+		log.Println("k8s: ProxyForDeployment: ", proxy.Serverlist.Prefix(), " degraded, the Kubernetes API is failing")
+		proxy.metric.Degraded.WithLabelValues(proxy.namespace, proxy.Serverlist.Prefix()).Set(1)
+		proxy.Serverlist.SetDegraded(degradedMessage)
+	}
+	proxy.health.failures++
+	proxy.health.lastError = err
+	delay := proxy.health.backoff.Step()
+	proxy.health.retryAt = time.Now().Add(delay)
+	log.Println("k8s: "+op+": ", err, " (failure ", proxy.health.failures, ", retrying in ", delay.Round(time.Millisecond), ")")
+	return delay
+}
+
+//apiSucceeded This method records a successful Kubernetes API call.
+// A degraded proxy is healthy again and the backoff starts from the beginning.
+func (proxy *ProxyForDeployment) apiSucceeded() {
+	proxy.health.mux.Lock()
+	defer proxy.health.mux.Unlock()
+	if proxy.health.failures == 0 {
+		return
+	}
+	log.Println("k8s: ProxyForDeployment: ", proxy.Serverlist.Prefix(), " recovered after ", proxy.health.failures, " failed Kubernetes API calls")
+	proxy.metric.Degraded.WithLabelValues(proxy.namespace, proxy.Serverlist.Prefix()).Set(0)
+	proxy.Serverlist.SetDegraded("")
+	proxy.health.failures = 0
+	proxy.health.lastError = nil
+	proxy.health.retryAt = time.Time{}
+	proxy.health.backoff = newAPIBackoff()
+}
+
+//apiRetryIn Returns the time until the Kubernetes API may be called again,
+// or 0 if the proxy is not degraded or the backoff has passed.
+func (proxy *ProxyForDeployment) apiRetryIn() time.Duration {
+	proxy.health.mux.Lock()
+	defer proxy.health.mux.Unlock()
+	if remaining := time.Until(proxy.health.retryAt); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+//Degraded Returns the last error of the Kubernetes API if the proxy is degraded, otherwise nil.
+func (proxy *ProxyForDeployment) Degraded() error {
+	proxy.health.mux.Lock()
+	defer proxy.health.mux.Unlock()
+	return proxy.health.lastError
+}
+
+//retryLater Calls retry after delay, unless a retry of the operation op is already pending.
+func (proxy *ProxyForDeployment) retryLater(op string, delay time.Duration, retry func()) {
+	proxy.health.mux.Lock()
+	defer proxy.health.mux.Unlock()
+	if proxy.health.retrying[op] {
+		return
+	}
+	proxy.health.retrying[op] = true
+	time.AfterFunc(delay, func() {
+		proxy.health.mux.Lock()
+		delete(proxy.health.retrying, op)
+		proxy.health.mux.Unlock()
+		retry()
+	})
+}
@@ -0,0 +1,343 @@
+package k8sfunctions
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/ipb-halle/k8sTicket/pkg/proxyfunctions"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+//The annotations of a Deployment that configure an application
+const (
+	annotationPort              = "ipb-halle.de/k8sticket.deployment.port"
+	annotationAppName           = "ipb-halle.de/k8sticket.deployment.app.name"
+	annotationMaxTickets        = "ipb-halle.de/k8sticket.deployment.tickets.max"
+	annotationSpareTickets      = "ipb-halle.de/k8sticket.deployment.tickets.spare"
+	annotationPredictive        = "ipb-halle.de/k8sticket.deployment.tickets.spare.predictive"
+	annotationPredictiveLead    = "ipb-halle.de/k8sticket.deployment.tickets.spare.lead"
+	annotationMaxPods           = "ipb-halle.de/k8sticket.deployment.pods.max"
+	annotationCooldown          = "ipb-halle.de/k8sticket.deployment.pods.cooldown"
+	annotationMinLifetime       = "ipb-halle.de/k8sticket.deployment.pods.lifetime.min"
+	annotationScaleDownMax      = "ipb-halle.de/k8sticket.deployment.pods.scaledown.max"
+	annotationScaleDownOrder    = "ipb-halle.de/k8sticket.deployment.pods.scaledown.order"
+	annotationScaleDownInterval = "ipb-halle.de/k8sticket.deployment.pods.scaledown.interval"
+	annotationDNS               = "ipb-halle.de/k8sticket.ingress.dns"
+	annotationRewrite           = "ipb-halle.de/k8sticket.ingress.rewrite"
+	annotationCookies           = "ipb-halle.de/k8sticket.ingress.cookies"
+
+	//the label of the Pods of an application
+	labelAppName = "ipb-halle.de/k8sticket.deployment.app.name"
+
+	//the annotation k8sTicket writes the result of the configuration check to
+	annotationStatus = "ipb-halle.de/k8sticket.status"
+	statusOK         = "ok"
+)
+
+//AppConfig This is the configuration of an application served by k8sTicket.
+// It is parsed from the annotations of a Deployment or taken from the spec of a TicketApp.
+// Schedules holds the pre-warming schedules in the canonical form of parseSchedules,
+// so that the configurations can be compared.
+type AppConfig struct {
+	Port              string
+	AppName           string
+	MaxTickets        int
+	SpareTickets      int
+	MaxPods           int
+	Cooldown          int
+	MinLifetime       int
+	ScaleDownMax      int
+	ScaleDownOrder    string
+	ScaleDownInterval int
+	DNS               bool
+	Rewrite           bool
+	Cookies           string
+	Schedules         string
+	Predictive        bool
+	PredictiveLead    int
+}
+
+//DefaultAppConfig Returns the configuration of an application without annotations.
+// The app name is the name of the Deployment.
+func DefaultAppConfig(name string) AppConfig {
+	return AppConfig{
+		Port:              "9001",
+		AppName:           name,
+		MaxTickets:        1,
+		SpareTickets:      2,
+		MaxPods:           1,
+		Cooldown:          10,
+		ScaleDownOrder:    ScaleDownLRU,
+		ScaleDownInterval: 10,
+		Cookies:           proxyfunctions.CookiesBrowser,
+		PredictiveLead:    900,
+	}
+}
+
+//checkRange Returns an error if value is not between min and max. A max of 0 means no upper bound.
+func checkRange(field string, value int, min int, max int) error {
+	if value < min {
+		return fmt.Errorf("%s: %d is less than %d", field, value, min)
+	}
+	if max > 0 && value > max {
+		return fmt.Errorf("%s: %d is greater than %d", field, value, max)
+	}
+	return nil
+}
+
+//checkCookies Returns an error if mode is not a known cookie mode.
+func checkCookies(field string, mode string) error {
+	if mode != proxyfunctions.CookiesBrowser && mode != proxyfunctions.CookiesJar {
+		return fmt.Errorf("%s: %q is neither %q nor %q", field, mode, proxyfunctions.CookiesBrowser, proxyfunctions.CookiesJar)
+	}
+	return nil
+}
+
+//Validate Checks the ranges of all values of the configuration.
+// The errors name the fields of the spec of a TicketApp.
+func (conf AppConfig) Validate() []error {
+	var errs []error
+	port, err := strconv.Atoi(conf.Port)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("port: %q is not a number", conf.Port))
+	} else if err := checkRange("port", port, 1, 65535); err != nil {
+		errs = append(errs, err)
+	}
+	if conf.AppName == "" || strings.Contains(conf.AppName, "/") {
+		errs = append(errs, fmt.Errorf("app name: %q is empty or contains a slash", conf.AppName))
+	}
+	for _, err := range []error{
+		checkRange("maxTickets", conf.MaxTickets, 1, 0),
+		checkRange("spareTickets", conf.SpareTickets, 0, 0),
+		checkRange("maxPods", conf.MaxPods, 0, 0),
+		checkRange("cooldown", conf.Cooldown, 1, 0),
+		checkRange("minLifetime", conf.MinLifetime, 0, 0),
+		checkRange("scaleDownMax", conf.ScaleDownMax, 0, 0),
+		checkScaleDownOrder("scaleDownOrder", conf.ScaleDownOrder),
+		checkRange("scaleDownInterval", conf.ScaleDownInterval, 1, 0),
+		checkCookies("cookies", conf.Cookies),
+		checkRange("predictiveLead", conf.PredictiveLead, 0, 0),
+	} {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+//ParseAppConfig This function reads the configuration of an application from the
+// annotations of the Deployment name. Missing annotations get their defaults.
+// Malformed or out of range values are replaced by their defaults as well and
+// returned as errors, so that they can be reported to the user.
+func ParseAppConfig(name string, annotations map[string]string) (AppConfig, []error) {
+	conf := DefaultAppConfig(name)
+	var errs []error
+	parseInt := func(key string, min int, max int, value *int) {
+		raw, ok := annotations[key]
+		if !ok {
+			return
+		}
+		parsed, err := strconv.Atoi(strings.TrimSpace(raw))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %q is not a number, using %d", key, raw, *value))
+			return
+		}
+		if err := checkRange(key, parsed, min, max); err != nil {
+			errs = append(errs, fmt.Errorf("%v, using %d", err, *value))
+			return
+		}
+		*value = parsed
+	}
+	parseBool := func(key string, value *bool) {
+		raw, ok := annotations[key]
+		if !ok {
+			return
+		}
+		parsed, err := strconv.ParseBool(strings.TrimSpace(raw))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %q is not a boolean, using %t", key, raw, *value))
+			return
+		}
+		*value = parsed
+	}
+	port, _ := strconv.Atoi(conf.Port)
+	parseInt(annotationPort, 1, 65535, &port)
+	conf.Port = strconv.Itoa(port)
+	if appName, ok := annotations[annotationAppName]; ok {
+		if appName == "" || strings.Contains(appName, "/") {
+			errs = append(errs, fmt.Errorf("%s: %q is empty or contains a slash, using %q", annotationAppName, appName, name))
+		} else {
+			conf.AppName = appName
+		}
+	}
+	parseInt(annotationMaxTickets, 1, 0, &conf.MaxTickets)
+	parseInt(annotationSpareTickets, 0, 0, &conf.SpareTickets)
+	parseInt(annotationMaxPods, 0, 0, &conf.MaxPods)
+	parseInt(annotationCooldown, 1, 0, &conf.Cooldown)
+	parseInt(annotationMinLifetime, 0, 0, &conf.MinLifetime)
+	parseInt(annotationScaleDownMax, 0, 0, &conf.ScaleDownMax)
+	parseInt(annotationScaleDownInterval, 1, 0, &conf.ScaleDownInterval)
+	if order, ok := annotations[annotationScaleDownOrder]; ok {
+		if err := checkScaleDownOrder(annotationScaleDownOrder, order); err != nil {
+			errs = append(errs, fmt.Errorf("%v, using %q", err, conf.ScaleDownOrder))
+		} else {
+			conf.ScaleDownOrder = order
+		}
+	}
+	parseBool(annotationPredictive, &conf.Predictive)
+	parseInt(annotationPredictiveLead, 0, 0, &conf.PredictiveLead)
+	parseBool(annotationDNS, &conf.DNS)
+	parseBool(annotationRewrite, &conf.Rewrite)
+	if cookies, ok := annotations[annotationCookies]; ok {
+		if err := checkCookies(annotationCookies, cookies); err != nil {
+			errs = append(errs, fmt.Errorf("%v, using %q", err, conf.Cookies))
+		} else {
+			conf.Cookies = cookies
+		}
+	}
+	schedules := make(map[string]string)
+	for key, value := range annotations {
+		if strings.HasPrefix(key, annotationSchedulePrefix) {
+			schedules[strings.TrimPrefix(key, annotationSchedulePrefix)] = value
+		}
+	}
+	var scheduleErrs []error
+	conf.Schedules, scheduleErrs = parseSchedules(schedules, func(name string) string {
+		return annotationSchedulePrefix + name
+	})
+	errs = append(errs, scheduleErrs...)
+	return conf, errs
+}
+
+//logParameters Writes the configuration of an application to the log.
+func (conf AppConfig) logParameters(name string) {
+	log.Println("k8s: ", name, " port: "+conf.Port)
+	log.Println("k8s: ", name, " app: "+conf.AppName)
+	log.Println("k8s: ", name, " tickets.max: ", conf.MaxTickets)
+	log.Println("k8s: ", name, " tickets.spare: ", conf.SpareTickets)
+	log.Println("k8s: ", name, " tickets.spare.predictive: ", conf.Predictive)
+	log.Println("k8s: ", name, " tickets.spare.lead: ", conf.PredictiveLead)
+	log.Println("k8s: ", name, " pod.max: ", conf.MaxPods)
+	log.Println("k8s: ", name, " pod.cooldown: ", conf.Cooldown)
+	log.Println("k8s: ", name, " pods.lifetime.min: ", conf.MinLifetime)
+	log.Println("k8s: ", name, " pods.scaledown.max: ", conf.ScaleDownMax)
+	log.Println("k8s: ", name, " pods.scaledown.order: "+conf.ScaleDownOrder)
+	log.Println("k8s: ", name, " pods.scaledown.interval: ", conf.ScaleDownInterval)
+	log.Println("k8s: ", name, " ingress.dns: ", conf.DNS)
+	log.Println("k8s: ", name, " ingress.rewrite: ", conf.Rewrite)
+	log.Println("k8s: ", name, " ingress.cookies: "+conf.Cookies)
+	for _, schedule := range strings.Split(conf.Schedules, "\n") {
+		if schedule != "" {
+			log.Println("k8s: ", name, " schedule "+schedule)
+		}
+	}
+}
+
+//ConfigReporter This struct reports the errors in the configuration of the applications
+// as Kubernetes Events and in the annotation ipb-halle.de/k8sticket.status of the Deployments.
+// A nil ConfigReporter only logs the errors.
+type ConfigReporter struct {
+	clientset kubernetes.Interface
+	recorder  record.EventRecorder
+}
+
+//NewConfigReporter Creates a new ConfigReporter for the Deployments in all namespaces.
+// The Events are recorded in the namespace of their Deployment or TicketApp.
+func NewConfigReporter(clientset kubernetes.Interface) *ConfigReporter {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events(metav1.NamespaceAll)})
+	return &ConfigReporter{
+		clientset: clientset,
+		recorder:  broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: "k8sticket"}),
+	}
+}
+
+//statusMessage Returns the value of the status annotation for the errors.
+func statusMessage(errs []error) string {
+	if len(errs) == 0 {
+		return statusOK
+	}
+	messages := make([]string, 0, len(errs))
+	for _, err := range errs {
+		messages = append(messages, err.Error())
+	}
+	return strings.Join(messages, "; ")
+}
+
+//ReportDeployment This method reports the result of the configuration check of a Deployment.
+// Nothing is reported if the status annotation of the Deployment already shows this result,
+// so that the same errors do not lead to new Events or log messages on every reconciliation of the Deployment.
+func (reporter *ConfigReporter) ReportDeployment(meta metav1.ObjectMeta, errs []error) {
+	message := statusMessage(errs)
+	if reporter != nil && meta.GetAnnotations()[annotationStatus] == message {
+		return
+	}
+	for _, err := range errs {
+		log.Println("k8s: Deployment: " + meta.Name + ": " + err.Error())
+	}
+	if reporter == nil {
+		return
+	}
+	ref := deploymentRef(meta)
+	for _, err := range errs {
+		reporter.recorder.Event(ref, v1.EventTypeWarning, "InvalidConfiguration", err.Error())
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{annotationStatus: message},
+		},
+	})
+	if err != nil {
+		log.Println("k8s: Deployment: "+meta.Name+": status: ", err)
+		return
+	}
+	_, err = reporter.clientset.AppsV1().Deployments(meta.Namespace).Patch(meta.Name, types.MergePatchType, patch)
+	if err != nil {
+		log.Println("k8s: Deployment: "+meta.Name+": status: ", err)
+	}
+}
+
+//ReportTicketApp This method reports the errors in the configuration of a TicketApp as Events.
+func (reporter *ConfigReporter) ReportTicketApp(app *TicketApp, errs []error) {
+	for _, err := range errs {
+		log.Println("k8s: TicketApp: " + app.Name + ": " + err.Error())
+	}
+	if reporter == nil {
+		return
+	}
+	ref := ticketAppRef(app)
+	for _, err := range errs {
+		reporter.recorder.Event(ref, v1.EventTypeWarning, "InvalidConfiguration", err.Error())
+	}
+}
+
+//Warn This method reports a problem of a running application as a Warning Event of its
+// Deployment or TicketApp ref. A nil ConfigReporter only logs the problem.
+func (reporter *ConfigReporter) Warn(ref *v1.ObjectReference, reason string, message string) {
+	log.Println("k8s: " + ref.Kind + ": " + ref.Namespace + "/" + ref.Name + ": " + message)
+	if reporter == nil {
+		return
+	}
+	reporter.recorder.Event(ref, v1.EventTypeWarning, reason, message)
+}
+
+//deploymentRef Returns the reference of a Deployment for its Events.
+func deploymentRef(meta metav1.ObjectMeta) *v1.ObjectReference {
+	return &v1.ObjectReference{Kind: "Deployment", APIVersion: "apps/v1",
+		Namespace: meta.Namespace, Name: meta.Name, UID: meta.UID}
+}
+
+//ticketAppRef Returns the reference of a TicketApp for its Events.
+func ticketAppRef(app *TicketApp) *v1.ObjectReference {
+	return &v1.ObjectReference{Kind: "TicketApp", APIVersion: TicketAppResource.GroupVersion().String(),
+		Namespace: app.Namespace, Name: app.Name, UID: app.UID}
+}
@@ -0,0 +1,102 @@
+package k8sfunctions
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ipb-halle/k8sTicket/pkg/proxyfunctions"
+)
+
+func TestParseAppConfig(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		change      func(conf *AppConfig)
+		errs        []string
+	}{
+		{"no annotations give the defaults", nil, func(conf *AppConfig) {}, nil},
+		{"missing annotations keep their defaults", map[string]string{annotationSpareTickets: "0"},
+			func(conf *AppConfig) { conf.SpareTickets = 0 }, nil},
+		{"all values are read", map[string]string{
+			annotationPort:              "9100",
+			annotationAppName:           "shop",
+			annotationMaxTickets:        " 4 ",
+			annotationSpareTickets:      "3",
+			annotationMaxPods:           "10",
+			annotationCooldown:          "30",
+			annotationMinLifetime:       "600",
+			annotationScaleDownMax:      "2",
+			annotationScaleDownOrder:    ScaleDownNode,
+			annotationScaleDownInterval: "60",
+			annotationPredictive:        "true",
+			annotationPredictiveLead:    "0",
+			annotationDNS:               "True",
+			annotationRewrite:           "1",
+			annotationCookies:           proxyfunctions.CookiesJar,
+		}, func(conf *AppConfig) {
+			*conf = AppConfig{Port: "9100", AppName: "shop", MaxTickets: 4, SpareTickets: 3, MaxPods: 10, Cooldown: 30,
+				MinLifetime: 600, ScaleDownMax: 2, ScaleDownOrder: ScaleDownNode, ScaleDownInterval: 60, DNS: true,
+				Rewrite: true, Cookies: proxyfunctions.CookiesJar, Predictive: true, PredictiveLead: 0}
+		}, nil},
+		{"lower bounds are accepted", map[string]string{annotationPort: "1", annotationMaxTickets: "1", annotationMaxPods: "0", annotationCooldown: "1"},
+			func(conf *AppConfig) { conf.Port, conf.MaxPods, conf.Cooldown = "1", 0, 1 }, nil},
+		{"out of range values keep their defaults", map[string]string{
+			annotationPort:              "70000",
+			annotationMaxTickets:        "0",
+			annotationSpareTickets:      "-1",
+			annotationCooldown:          "0",
+			annotationScaleDownInterval: "0",
+		}, func(conf *AppConfig) {}, []string{
+			annotationPort + ": 70000 is greater than 65535, using 9001",
+			annotationMaxTickets + ": 0 is less than 1, using 1",
+			annotationSpareTickets + ": -1 is less than 0, using 2",
+			annotationCooldown + ": 0 is less than 1, using 10",
+			annotationScaleDownInterval + ": 0 is less than 1, using 10",
+		}},
+		{"malformed values keep their defaults", map[string]string{
+			annotationAppName:        "a/b",
+			annotationMaxTickets:     "many",
+			annotationMaxPods:        "",
+			annotationScaleDownOrder: "random",
+			annotationDNS:            "maybe",
+			annotationCookies:        "none",
+			annotationMinLifetime:    "1.5",
+		}, func(conf *AppConfig) {}, []string{
+			annotationAppName + `: "a/b" is empty or contains a slash, using "app"`,
+			annotationMaxTickets + `: "many" is not a number, using 1`,
+			annotationMaxPods + `: "" is not a number, using 1`,
+			annotationMinLifetime + `: "1.5" is not a number, using 0`,
+			annotationScaleDownOrder + `: "random" is neither "lru", "newest" nor "node", using "lru"`,
+			annotationDNS + `: "maybe" is not a boolean, using false`,
+			annotationCookies + `: "none" is neither "browser" nor "jar", using "browser"`,
+		}},
+		{"valid values are kept next to invalid ones", map[string]string{annotationMaxTickets: "3", annotationSpareTickets: "some"},
+			func(conf *AppConfig) { conf.MaxTickets = 3 }, []string{annotationSpareTickets + `: "some" is not a number, using 2`}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			want := DefaultAppConfig("app")
+			test.change(&want)
+			conf, errs := ParseAppConfig("app", test.annotations)
+			if !reflect.DeepEqual(conf, want) {
+				t.Errorf("config %+v, expected %+v", conf, want)
+			}
+			messages := make([]string, 0, len(errs))
+			for _, err := range errs {
+				messages = append(messages, err.Error())
+			}
+			if len(messages) != len(test.errs) {
+				t.Fatalf("errors %q, expected %q", messages, test.errs)
+			}
+			for i := range messages {
+				if messages[i] != test.errs[i] {
+					t.Errorf("error %q, expected %q", messages[i], test.errs[i])
+				}
+			}
+			//the parsed configuration is always valid
+			if errs := conf.Validate(); len(errs) > 0 {
+				t.Errorf("the parsed configuration is invalid: %v", errs)
+			}
+		})
+	}
+}
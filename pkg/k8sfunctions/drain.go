@@ -0,0 +1,130 @@
+package k8sfunctions
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	//the interval for checking if the tickets of a draining proxy have ended
+	drainPeriod = 5 * time.Second
+
+	//DefaultDrainTimeout This is the deadline for draining a disabled application if the ProxyMap has none.
+	DefaultDrainTimeout = time.Hour
+)
+
+//drainer This struct lets a draining proxy be stopped before its deadline.
+type drainer struct {
+	now     chan struct{}
+	nowOnce sync.Once
+	done    chan struct{}
+}
+
+//newDrainer Creates a new drainer.
+func newDrainer() *drainer {
+	return &drainer{now: make(chan struct{}), done: make(chan struct{})}
+}
+
+//Drain This method drains the proxy and stops it afterwards. No new tickets are made out,
+// the waiting clients get a maintenance message with the given text and the existing
+// tickets are served until they expire. The proxy is stopped as soon as no ticket is left,
+// at the latest after timeout or when EndDrain is called. Drain blocks until the proxy is stopped.
+func (proxy *ProxyForDeployment) Drain(message string, timeout time.Duration) {
+	defer close(proxy.drainer.done)
+	proxy.Serverlist.Drain(message)
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(drainPeriod)
+	defer ticker.Stop()
+wait:
+	for {
+		tickets := proxy.Serverlist.GetTickets()
+		if tickets == 0 {
+			break
+		}
+		log.Println("k8s: ProxyForDeployment: ", proxy.Serverlist.Prefix(), " draining, ", tickets, " tickets left")
+		select {
+		case <-ticker.C:
+		case <-deadline.C:
+			log.Println("k8s: ProxyForDeployment: ", proxy.Serverlist.Prefix(), " drain deadline reached, ", tickets, " tickets are dropped")
+			break wait
+		case <-proxy.drainer.now:
+			log.Println("k8s: ProxyForDeployment: ", proxy.Serverlist.Prefix(), " drain ended early, ", tickets, " tickets are dropped")
+			break wait
+		}
+	}
+	proxy.Stop()
+}
+
+//EndDrain This method stops a draining proxy at once and waits until it is stopped.
+func (proxy *ProxyForDeployment) EndDrain() {
+	proxy.drainer.nowOnce.Do(func() { close(proxy.drainer.now) })
+	<-proxy.drainer.done
+}
+
+//drain Drains the proxy of the Deployment or TicketApp key (e.g. "Deployment name") in the background.
+// The proxy is kept in the ProxyMap until it is stopped, so that its port stays reserved.
+// It has to be called with the locked mux of the ProxyMap.
+func (proxies *ProxyMap) drain(key string, proxy *ProxyForDeployment, message string, timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = DefaultDrainTimeout
+	}
+	log.Println("k8s: " + key + ": draining for at most " + timeout.String())
+	proxies.draining[key] = proxy
+	go func() {
+		proxy.Drain(message, timeout)
+		proxies.Mux.Lock()
+		if proxies.draining[key] == proxy {
+			delete(proxies.draining, key)
+		}
+		proxies.Mux.Unlock()
+	}()
+}
+
+//stopDraining Stops the draining proxy of key at once, e.g. because the application was enabled again.
+// It has to be called with the locked mux of the ProxyMap.
+func (proxies *ProxyMap) stopDraining(key string) {
+	proxy, ok := proxies.draining[key]
+	if !ok {
+		return
+	}
+	log.Println("k8s: " + key + ": stopping the draining proxy before a new one is started")
+	delete(proxies.draining, key)
+	proxy.EndDrain()
+}
+
+//Shutdown This method drains all proxies, e.g. when k8sTicket is terminated.
+// It returns when all proxies are stopped, at the latest after timeout.
+// Proxies that were already draining are stopped at the same deadline.
+func (proxies *ProxyMap) Shutdown(message string, timeout time.Duration) {
+	proxies.Mux.Lock()
+	for name, proxy := range proxies.Deployments {
+		proxies.drain("Deployment "+name, proxy, message, timeout)
+	}
+	for name, proxy := range proxies.TicketApps {
+		proxies.drain("TicketApp "+name, proxy, message, timeout)
+	}
+	proxies.Deployments = make(map[string]*ProxyForDeployment)
+	proxies.TicketApps = make(map[string]*ProxyForDeployment)
+	draining := make([]*ProxyForDeployment, 0, len(proxies.draining))
+	for _, proxy := range proxies.draining {
+		draining = append(draining, proxy)
+	}
+	proxies.Mux.Unlock()
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	expired := false
+	for _, proxy := range draining {
+		if !expired {
+			select {
+			case <-proxy.drainer.done:
+				continue
+			case <-deadline.C:
+				//the remaining proxies are stopped at once
+				expired = true
+			}
+		}
+		proxy.EndDrain()
+	}
+}
@@ -1,60 +1,106 @@
 package k8sfunctions
 
 import (
-	"context"
 	"log"
 	"net/http"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	gorilla "github.com/gorilla/mux"
 	"github.com/ipb-halle/k8sTicket/pkg/proxyfunctions"
-	appsv1 "k8s.io/api/apps/v1"
 	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/informers/internalinterfaces"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/metadata"
-	"k8s.io/client-go/metadata/metadatainformer"
-	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
 )
 
 //ProxyMap This is a map with a mux that stores the ProxyForDeployments.
 // The mux is used by the Informers when adding or deleting (updating)
 // a ProxyForDeployment instance.
+// The ticket stores of the Deployments are kept here as well, so that
+// a rebuilt ProxyForDeployment can restore the tickets of its predecessor.
+// The Leadership is only set in high-availability mode.
+// If the SharedRouter is set, all ProxyForDeployments are served by its listener
+// instead of their own port. The Reporter is optional, see ConfigReporter.
+// The Pods of all applications are read from the shared PodCache.
+// The proxies of the TicketApp custom resources are kept apart from the Deployments,
+// so that a TicketApp may have the same name as a Deployment. Both are keyed by namespace/name.
+// Only the applications in the namespaces of the NamespaceScope are served, a nil
+// NamespaceScope serves all namespaces.
+// The proxies of disabled applications are kept in draining until they are stopped,
+// they are drained for at most DrainTimeout (see Drain).
 type ProxyMap struct {
-	Deployments map[string]*ProxyForDeployment
-	Mux         sync.Mutex
+	Deployments  map[string]*ProxyForDeployment
+	TicketApps   map[string]*ProxyForDeployment
+	Mux          sync.Mutex
+	StoreType    string
+	Leadership   *Leadership
+	Signer       *proxyfunctions.Signer
+	SharedRouter *SharedRouter
+	Reporter     *ConfigReporter
+	Pods         *PodCache
+	Namespaces   *NamespaceScope
+	DrainTimeout time.Duration
+	LegacyTokens bool
+	stores       map[string]proxyfunctions.TicketStore
+	draining     map[string]*ProxyForDeployment
 }
 
 //ProxyForDeployment This struct includes everything needed for running
 // the ticket proxy for one deployment. It is the essiential structure of k8sTicket.
+// The previous routes and listeners are kept after a reconfiguration until their sessions have ended.
+// The problems of a running proxy are reported as Events of its Deployment or TicketApp ref.
 type ProxyForDeployment struct {
-	podController      *Controller
-	Clientset          *kubernetes.Clientset
+	pods               *PodCache
+	subscribed         map[string]bool
+	createdPods        map[string]time.Time
+	Clientset          kubernetes.Interface
 	Serverlist         *proxyfunctions.Serverlist
 	server             *http.Server
-	router             *gorilla.Router
+	handler            *proxyHandler
+	retiredRoutes      []retiredRoute
+	retiredServers     []retiredServer
+	retiring           bool
+	prefixes           map[string]bool
+	conflicts          map[string]bool
+	reporter           *ConfigReporter
+	ref                *v1.ObjectReference
 	namespace          string
 	port               string
 	podSpec            v1.PodTemplateSpec
 	Stopper            chan struct{}
 	podWatchdogStopper chan struct{}
+	podWatchdogPeriod  chan time.Duration
 	podScalerStopper   chan struct{}
 	podScalerInformer  chan string
 	metricStopper      chan struct{}
 	spareTickets       int
 	maxPods            int
 	cooldown           int
+	scaleDown          scaleDownPolicy
+	schedules          []prewarmSchedule
+	activeSchedules    map[string]bool
+	prewarmSpare       int
+	prewarmPods        int
+	arrivals           *arrivalModel
+	arrivalsLoaded     bool
+	predictive         bool
+	predictiveLead     time.Duration
+	predictedSpare     int
 	mux                sync.Mutex
 	metric             *PMetric
-	dns                bool
+	leadership         *Leadership
+	sharedRouter       *SharedRouter
+	drainer            *drainer
+	health             *apiHealth
+	podQueue           workqueue.RateLimitingInterface
+	maxTickets         int
+	config             AppConfig
 }
 
 //Controller This struct includes all components of the Controller
@@ -71,139 +117,257 @@ type Controller struct {
 }
 
 //NewProxyMap Creates a new ProxyMap with initialized ProxyForDeployment map.
-func NewProxyMap() *ProxyMap {
+// The ticket stores are of the type storeType (StoreMemory or StoreSecret).
+func NewProxyMap(storeType string) *ProxyMap {
 	p := ProxyMap{
 		Deployments: make(map[string]*ProxyForDeployment),
+		TicketApps:  make(map[string]*ProxyForDeployment),
+		StoreType:   storeType,
+		stores:      make(map[string]proxyfunctions.TicketStore),
+		draining:    make(map[string]*ProxyForDeployment),
 	}
 	return &p
 }
 
+//watches Returns true if the applications in the namespace ns are served.
+func (proxies *ProxyMap) watches(ns string) bool {
+	return proxies.Namespaces == nil || proxies.Namespaces.Watches(ns)
+}
+
+//portUser Returns the Deployment or TicketApp whose proxy listens on port, or an empty string.
+// It has to be called with the locked mux of the ProxyMap.
+func (proxies *ProxyMap) portUser(port string) string {
+	for name, proxy := range proxies.Deployments {
+		if proxy.sharedRouter == nil && proxy.port == port {
+			return "Deployment " + name
+		}
+	}
+	for name, proxy := range proxies.TicketApps {
+		if proxy.sharedRouter == nil && proxy.port == port {
+			return "TicketApp " + name
+		}
+	}
+	for key, proxy := range proxies.draining {
+		if proxy.sharedRouter == nil && proxy.port == port {
+			return "draining " + key
+		}
+	}
+	return ""
+}
+
+//All Returns the proxies of all Deployments and TicketApps, including the draining ones.
+// It has to be called with the locked mux of the ProxyMap.
+func (proxies *ProxyMap) All() []*ProxyForDeployment {
+	all := make([]*ProxyForDeployment, 0, len(proxies.Deployments)+len(proxies.TicketApps)+len(proxies.draining))
+	for _, proxy := range proxies.Deployments {
+		all = append(all, proxy)
+	}
+	for _, proxy := range proxies.TicketApps {
+		all = append(all, proxy)
+	}
+	for _, proxy := range proxies.draining {
+		all = append(all, proxy)
+	}
+	return all
+}
+
+//ticketStore This method returns the ticket store of a Deployment in the namespace ns. The store
+// is created when it is requested for the first time.
+// It has to be called with the locked mux of the ProxyMap.
+func (proxies *ProxyMap) ticketStore(clientset kubernetes.Interface, ns string, deployment string) proxyfunctions.TicketStore {
+	key := ns + "/" + deployment
+	if store, ok := proxies.stores[key]; ok {
+		return store
+	}
+	var store proxyfunctions.TicketStore
+	if proxies.StoreType == StoreSecret {
+		store = NewSecretTicketStore(clientset, ns, deployment)
+	} else {
+		store = proxyfunctions.NewMemoryTicketStore()
+	}
+	proxies.stores[key] = store
+	return store
+}
+
 //NewProxyForDeployment The main idea of the k8sTicket structure is that every
 // Deployment is one application that should be delivered with the proxy.
 // For this reason all components are tied together in this structure.
-func NewProxyForDeployment(clienset *kubernetes.Clientset, prefix string, ns string,
+// In high-availability mode (leadership is not nil), the tickets are shared with
+// the other replicas by the store and Pods are only scaled by the leader.
+// If shared is not nil, the proxy is served by the SharedRouter and port is ignored.
+// The Pods of the application are read from the shared PodCache pods.
+func NewProxyForDeployment(clienset kubernetes.Interface, prefix string, ns string,
 	port string, maxTickets int, spareTickets int, maxPods int, cooldown int,
-	podspec v1.PodTemplateSpec, metric *PMetric, dns bool) *ProxyForDeployment {
+	podspec v1.PodTemplateSpec, metric *PMetric, dns bool, rewrite bool, cookies string, store proxyfunctions.TicketStore,
+	leadership *Leadership, signer *proxyfunctions.Signer, shared *SharedRouter, pods *PodCache) *ProxyForDeployment {
 
 	proxy := ProxyForDeployment{}
-	router := gorilla.NewRouter()
 	proxy.Serverlist = proxyfunctions.NewServerlist(prefix, dns)
+	proxy.Serverlist.SetSigner(signer)
+	proxy.Serverlist.SetRewrite(rewrite)
+	proxy.Serverlist.SetCookieMode(cookies)
 	proxy.namespace = ns
 	proxy.port = port
-	proxy.podController = NewPodController(clienset, ns, prefix)
-	proxy.podController.Informer.AddEventHandler(NewPodHandlerForServerlist(&proxy, maxTickets))
+	proxy.pods = pods
+	proxy.subscribed = make(map[string]bool)
+	proxy.createdPods = make(map[string]time.Time)
+	proxy.podQueue = workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "pods-"+prefix)
+	proxy.maxTickets = maxTickets
 	proxy.Clientset = clienset
 	proxy.podSpec = podspec
 	proxy.Stopper = make(chan struct{})
 	proxy.podWatchdogStopper = make(chan struct{})
+	proxy.podWatchdogPeriod = make(chan time.Duration, 1)
 	proxy.podScalerInformer = proxy.Serverlist.AddInformerChannel()
 	proxy.podScalerStopper = make(chan struct{})
 	proxy.metricStopper = make(chan struct{})
-	proxy.router = router
-	proxy.server = &http.Server{Addr: ":" + port, Handler: router}
+	proxy.handler = &proxyHandler{}
+	proxy.prefixes = make(map[string]bool)
+	proxy.conflicts = make(map[string]bool)
+	proxy.ref = &v1.ObjectReference{Kind: "Deployment", APIVersion: "apps/v1", Namespace: ns, Name: prefix}
+	proxy.server = &http.Server{Addr: ":" + port, Handler: proxy.handler}
 	proxy.spareTickets = spareTickets
 	proxy.maxPods = maxPods
 	proxy.cooldown = cooldown
+	proxy.scaleDown = newScaleDownPolicy(DefaultAppConfig(prefix))
+	proxy.activeSchedules = make(map[string]bool)
+	proxy.arrivals = &arrivalModel{}
 	proxy.metric = metric
-	proxy.dns = dns
+	proxy.leadership = leadership
+	proxy.sharedRouter = shared
+	proxy.drainer = newDrainer()
+	proxy.health = newAPIHealth()
+	if err := proxy.Serverlist.SetTicketStore(store, leadership != nil); err != nil {
+		proxy.retryRestore(err)
+	}
 	return &proxy
 }
 
+//retryRestore This method loads the stored tickets again after the store failed with err.
+// The proxy is degraded and the load is retried with backoff, see apiFailed.
+func (proxy *ProxyForDeployment) retryRestore(err error) {
+	proxy.retryLater("restoreTickets", proxy.apiFailed("restoreTickets", err), func() {
+		select {
+		case <-proxy.Stopper:
+			//the proxy was stopped in the meantime
+			return
+		default:
+		}
+		if err := proxy.Serverlist.RestoreTickets(); err != nil {
+			proxy.retryRestore(err)
+			return
+		}
+		proxy.apiSucceeded()
+	})
+}
+
+//TriggerScaler This method asks the podScaler to check the resources of the proxy,
+// e.g. after this replica became the leader.
+func (proxy *ProxyForDeployment) TriggerScaler() {
+	go func() {
+		//the channel of a stopped proxy is closed, e.g. when a retry of the scaler is due after Stop
+		select {
+		case <-proxy.podScalerStopper:
+			return
+		default:
+		}
+		select {
+		case proxy.podScalerInformer <- "update":
+		case <-proxy.podScalerStopper:
+		}
+	}()
+}
+
 //Start This method starts a proxy. That includes the http handler as well as
 // the necessary methods and functions to manage tickets. Furthermore,
-// k8s informers are started to watch the events in the cluster.
+// the proxy subscribes to the events of its Pods at the PodCache.
 func (proxy *ProxyForDeployment) Start() {
-	//defer close(proxy.podController.Stopper)
 	//defer runtime.HandleCrash()
-	log.Println("k8s: ProxyForDeployment: ", proxy.Serverlist.Prefix, " starting...")
-	go proxy.podController.Informer.Run(proxy.podController.Stopper)
+	log.Println("k8s: ProxyForDeployment: ", proxy.Serverlist.Prefix(), " starting...")
+	go proxy.reconcilePods()
 	go proxy.Serverlist.TicketWatchdog()
 	go proxy.podScaler()
 	go proxy.podWatchdog()
-	proxy.router.HandleFunc("/"+proxy.Serverlist.Prefix+"/ws", proxy.Serverlist.ServeWs)
-	if proxy.dns {
-		proxy.router.HandleFunc("/"+proxy.Serverlist.Prefix, proxy.Serverlist.MainHandler).Host("{s}.{u}.{domain:.*}")
-		proxy.router.HandleFunc("/"+proxy.Serverlist.Prefix+"/{serverpath:.*}", proxy.Serverlist.MainHandler).Host("{s}.{u}.{domain:.*}")
+	go proxy.scheduleWatchdog()
+	proxy.updateSchedules()
+	proxy.mux.Lock()
+	proxy.subscribePods()
+	proxy.handler.setRouter(proxy.newRouter())
+	if proxy.sharedRouter != nil {
+		proxy.servePrefixes()
 	} else {
-		proxy.router.HandleFunc("/"+proxy.Serverlist.Prefix+"/{s}/{u}/{serverpath:.*}", proxy.Serverlist.MainHandler)
+		proxy.listen(proxy.server)
 	}
-	proxy.router.HandleFunc("/"+proxy.Serverlist.Prefix, proxy.Serverlist.ServeHome)
-	proxy.router.HandleFunc("/"+proxy.Serverlist.Prefix+"/", proxy.Serverlist.ServeHome)
-
-	go func() {
-		if err := proxy.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Println("Proxy:", proxy.Serverlist.Prefix, "ListenAndServe()", err)
-		}
-	}()
+	proxy.mux.Unlock()
+	proxy.metric.Degraded.WithLabelValues(proxy.namespace, proxy.Serverlist.Prefix()).Set(0)
+	go proxy.learnArrivals(proxy.Serverlist.AddInformerChannel())
+	proxy.updatePrediction()
 	go proxy.UpdateAccessMetric(proxy.Serverlist.AddInformerChannel())
 }
 
 //Stop This method stops a proxy including the http server and all running
-// routines and infomers.
+// routines and its subscription at the PodCache.
 func (proxy *ProxyForDeployment) Stop() {
-	close(proxy.podController.Stopper)
+	proxy.mux.Lock()
+	proxy.podQueue.ShutDown()
+	for app := range proxy.subscribed {
+		proxy.pods.unsubscribe(app, proxy)
+	}
+	proxy.retiredRoutes = nil
+	servers := []*http.Server{proxy.server}
+	for _, retired := range proxy.retiredServers {
+		servers = append(servers, retired.server)
+	}
+	proxy.retiredServers = nil
+	proxy.mux.Unlock()
 	defer runtime.HandleCrash()
 	go func() {
-		if err := proxy.server.Shutdown(context.Background()); err != nil {
-			// Error from closing listeners, or context timeout:
-			log.Println("HTTP:", proxy.Serverlist.Prefix, "server Shutdown: ", err)
+		if proxy.sharedRouter != nil {
+			for prefix := range proxy.prefixes {
+				proxy.sharedRouter.Remove(prefix, proxy.handler)
+			}
 		} else {
-			log.Println("HTTP:", proxy.Serverlist.Prefix, "server closed ")
+			for _, server := range servers {
+				shutdown(proxy.Serverlist.Prefix(), server)
+			}
 		}
 		close(proxy.Stopper)
 	}()
 	<-proxy.Stopper
 	close(proxy.Serverlist.Stop)
+	proxy.Serverlist.FlushTicketStore()
+	proxy.mux.Lock()
+	predictive := proxy.predictive
+	proxy.mux.Unlock()
+	if predictive {
+		proxy.saveArrivals()
+	}
 	close(proxy.podScalerStopper)
 	close(proxy.metricStopper)
-	log.Println("Proxy Serverlist:", proxy.Serverlist.Prefix, "closing channles for external functions ")
+	proxy.mux.Lock()
+	for name := range proxy.activeSchedules {
+		proxy.metric.PrewarmActive.DeleteLabelValues(proxy.namespace, proxy.Serverlist.Prefix(), name)
+	}
+	proxy.metric.ExpectedArrivals.DeleteLabelValues(proxy.namespace, proxy.Serverlist.Prefix())
+	proxy.metric.PredictedSpare.DeleteLabelValues(proxy.namespace, proxy.Serverlist.Prefix())
+	proxy.mux.Unlock()
+	log.Println("Proxy Serverlist:", proxy.Serverlist.Prefix(), "closing channles for external functions ")
 	proxy.Serverlist.Mux.Lock()
 	for _, channel := range proxy.Serverlist.Informers {
 		close(channel)
 	}
 	proxy.Serverlist.Mux.Unlock()
-	log.Println("k8s podWatchdog:", proxy.Serverlist.Prefix, "stopping watchdog ")
+	log.Println("k8s podWatchdog:", proxy.Serverlist.Prefix(), "stopping watchdog ")
 	close(proxy.podWatchdogStopper)
 }
 
-//NewPodController This function creates a new Pod controller for a proxy
-// with a kubernetes.Clientset and a given namespace to watch.
-// It will inform k8sTicket about creation, deletion or updates of running Pods for the parameter app.
-func NewPodController(clientset kubernetes.Interface, ns string, app string) *Controller {
-	factory := informers.NewSharedInformerFactoryWithOptions(clientset,
-		1000000000,
-		informers.WithNamespace(ns),
-		informers.WithTweakListOptions(internalinterfaces.TweakListOptionsFunc(func(options *metav1.ListOptions) {
-			options.LabelSelector = "ipb-halle.de/k8sticket.deployment.app.name=" + app
-		})))
-	informer := factory.Core().V1().Pods().Informer()
-	stopper := make(chan struct{})
-	return (&Controller{
-		Clientset: clientset,
-		Factory:   factory,
-		Informer:  informer,
-		Stopper:   stopper,
-	})
-}
-
 // NewDeploymentController This function creates a new Deployment controller for a proxy
-// with a hardcoded InClusterConfig and a given namespace to watch.
+// with a kubernetes.Clientset and a given namespace to watch.
 // It will inform k8sTicket about creation, deletion or updates of running Deployments.
 // This controller is a major component because k8sTicket will retrieve its configuration
 // from the Deployments.
-func NewDeploymentController(ns string) Controller {
-	// creates the in-cluster config
+func NewDeploymentController(clientset kubernetes.Interface, ns string) Controller {
 	log.Println("New deployment controller started")
-	config, err := rest.InClusterConfig() //I guess it is maybe smarter to give a
-	//reference to an exisiting config here instead of generating a new one all the time
-	if err != nil {
-		panic(err.Error())
-	}
-	// creates the clientset
-	clientset, err := kubernetes.NewForConfig(config)
-	if err != nil {
-		panic(err.Error())
-	}
 	factory := informers.NewSharedInformerFactoryWithOptions(clientset, //I am not
 		//sure if the same factory should be used for all controllers
 		1000000000,
@@ -221,492 +385,286 @@ func NewDeploymentController(ns string) Controller {
 	})
 }
 
-// NewDeploymentMetaController This function creates a new controller for
-// the meta data of Deployments. In that way it is a kind of extension of the
-// DeploymentController which only listens for Deployments themselves.
-// This controlller handels the updates of Annotations and Labels.
-func NewDeploymentMetaController(ns string) Controller {
-	// creates the in-cluster config
-	log.Println("New deployment meta information controller started")
-	config, err := rest.InClusterConfig() //I guess it is maybe smarter to give a
-	//reference to an exisiting config here instead of generating a new one all the time
-	if err != nil {
-		panic(err.Error())
-	}
-	// creates the clientset
-	clientset, err := metadata.NewForConfig(metadata.ConfigFor(config))
-	if err != nil {
-		panic(err.Error())
+//startProxy Creates and starts the proxy of the Deployment meta with the configuration conf.
+// The proxy is kept under the key namespace/name.
+// It has to be called with the locked mux of the ProxyMap.
+func (proxies *ProxyMap) startProxy(clientset kubernetes.Interface, meta metav1.ObjectMeta, conf AppConfig,
+	podSpec v1.PodTemplateSpec, metric *PMetric) {
+	ns, name := meta.Namespace, meta.Name
+	key := ns + "/" + name
+	log.Println("k8s: Starting deployment " + key + " parameters: ")
+	conf.logParameters(key)
+	if user := proxies.portUser(conf.Port); proxies.SharedRouter == nil && user != "" {
+		log.Println("k8s: Deployment: " + key + ": port " + conf.Port + " is already used by " + user)
 	}
-	factory := metadatainformer.NewFilteredSharedInformerFactory(clientset, //I am not
-		// sure if the same factory should be used for all controllers
-		1000000000,
-		ns,
-		metadatainformer.TweakListOptionsFunc(func(options *metav1.ListOptions) {
-			options.LabelSelector = "ipb-halle.de/k8sticket=true"
-		}))
-	gvr, _ := schema.ParseResourceArg("deployments.v1.apps")
-	i := factory.ForResource(*gvr)
+	proxy := NewProxyForDeployment(clientset, conf.AppName,
+		ns, conf.Port, conf.MaxTickets, conf.SpareTickets, conf.MaxPods, conf.Cooldown, podSpec, metric,
+		conf.DNS, conf.Rewrite, conf.Cookies,
+		proxies.ticketStore(clientset, ns, name), proxies.Leadership, proxies.Signer, proxies.SharedRouter, proxies.Pods)
+	proxy.config = conf
+	proxy.reporter = proxies.Reporter
+	proxy.ref = deploymentRef(meta)
+	proxy.scaleDown = newScaleDownPolicy(conf)
+	proxy.schedules = schedulesOf(conf.Schedules)
+	proxy.setPrediction(conf.Predictive, time.Duration(conf.PredictiveLead)*time.Second)
+	proxy.Serverlist.SetLegacyTokens(proxies.LegacyTokens)
+	proxies.Deployments[key] = proxy
+	proxy.Start()
+}
 
-	return (Controller{
-		Clientset: clientset,
-		Factory:   factory,
-		Informer:  i.Informer(),
-		Stopper:   make(chan struct{}),
-	})
+//applyConfig This method applies the parameters that can be changed while the proxy is running:
+// the tickets per Pod, the spare tickets, the maximal number of Pods, the cooldown, the scale-down policy,
+// the pre-warming schedules and the predictive spare tickets.
+// The parameters are only changed if they differ between old and conf.
+func (proxy *ProxyForDeployment) applyConfig(name string, old AppConfig, conf AppConfig) {
+	proxy.mux.Lock()
+	if conf.MaxTickets != old.MaxTickets {
+		log.Println("k8s: ", name, " tickets.max: ", conf.MaxTickets)
+		proxy.Serverlist.ChangeAllMaxTickets(conf.MaxTickets)
+		proxy.maxTickets = conf.MaxTickets
+	}
+	if conf.SpareTickets != old.SpareTickets {
+		log.Println("k8s: ", name, " spareTickets: ", conf.SpareTickets)
+		proxy.spareTickets = conf.SpareTickets
+	}
+	if conf.MaxPods != old.MaxPods {
+		log.Println("k8s: ", name, " maxPods: ", conf.MaxPods)
+		proxy.maxPods = conf.MaxPods
+	}
+	proxy.mux.Unlock()
+	if conf.SpareTickets != old.SpareTickets || conf.MaxPods != old.MaxPods {
+		proxy.TriggerScaler()
+	}
+	if conf.Cooldown != old.Cooldown {
+		proxy.mux.Lock()
+		proxy.cooldown = conf.Cooldown
+		log.Println("k8s: ", name, " pod.cooldown: ", proxy.cooldown)
+		proxy.mux.Unlock()
+	}
+	policy := newScaleDownPolicy(conf)
+	proxy.mux.Lock()
+	if policy.interval != proxy.scaleDown.interval {
+		//the ticker of the podWatchdog gets the new interval, an interval it has not taken yet is replaced
+		select {
+		case <-proxy.podWatchdogPeriod:
+		default:
+		}
+		proxy.podWatchdogPeriod <- policy.interval
+	}
+	if policy != proxy.scaleDown {
+		log.Println("k8s: ", name, " pods.lifetime.min: ", conf.MinLifetime, " pods.scaledown.max: ", conf.ScaleDownMax,
+			" pods.scaledown.order: "+conf.ScaleDownOrder+" pods.scaledown.interval: ", conf.ScaleDownInterval)
+		proxy.scaleDown = policy
+	}
+	proxy.mux.Unlock()
+	if conf.Schedules != old.Schedules {
+		log.Println("k8s: ", name, " schedules: ", strings.Replace(conf.Schedules, "\n", "; ", -1))
+		proxy.mux.Lock()
+		proxy.schedules = schedulesOf(conf.Schedules)
+		proxy.mux.Unlock()
+		proxy.updateSchedules()
+	}
+	if conf.Predictive != old.Predictive || conf.PredictiveLead != old.PredictiveLead {
+		log.Println("k8s: ", name, " tickets.spare.predictive: ", conf.Predictive, " tickets.spare.lead: ", conf.PredictiveLead)
+		proxy.setPrediction(conf.Predictive, time.Duration(conf.PredictiveLead)*time.Second)
+		proxy.updatePrediction()
+	}
 }
 
-//NewPodHandlerForServerlist This function creates the PodHandler
-// for a given Proxy. The handler will only handle the specific Serverlist of this Proxy.
-// It will create the servers in the Serverlist based on the running Pods.
-// It will also modify them or delete them if the Pod was modified.
-// This handler implements the actions of the podController and triggers the UpdatePodMetric method.
-func NewPodHandlerForServerlist(proxy *ProxyForDeployment, maxtickets int) cache.ResourceEventHandlerFuncs {
-	list := proxy.Serverlist
-	addfunction := func(obj interface{}) {
-		pod := obj.(*v1.Pod)
-		if pod.Status.Phase == v1.PodRunning {
-			var rdy = true
-			for condition := range pod.Status.Conditions {
-				if pod.Status.Conditions[condition].Type == v1.PodReady {
-					if pod.Status.Conditions[condition].Status != v1.ConditionTrue {
-						rdy = false
-					}
-				}
+//podScaler This method creates new pods on-demand when a new ticket is made out, a client
+// starts waiting, a server is removed, a pre-warming schedule starts or ends or the predicted spare tickets change. While clients are waiting, the demand is checked every
+// scalerPeriod as well, so that a queue without new tickets still leads to new Pods.
+// If the Kubernetes API fails, the proxy is degraded and the scaling is retried with backoff.
+func (proxy *ProxyForDeployment) podScaler() {
+	ticker := time.NewTicker(scalerPeriod)
+	defer ticker.Stop()
+	scale := func() {
+		if !proxy.leadership.IsLeader() || proxy.Serverlist.Draining() {
+			return
+		}
+		if wait := proxy.apiRetryIn(); wait > 0 {
+			//the API is failing, the resources are checked again when the backoff has passed
+			proxy.retryLater("podScaler", wait, proxy.TriggerScaler)
+			return
+		}
+		if err := proxy.scalePods(); err != nil {
+			proxy.retryLater("podScaler", proxy.apiFailed("podScaler", err), proxy.TriggerScaler)
+		} else {
+			proxy.apiSucceeded()
+		}
+	}
+	for {
+		select {
+		case msg := <-proxy.podScalerInformer:
+			if msg == "new ticket" || msg == "new query" || msg == "deleting server" || msg == "update" {
+				scale()
 			}
-			if rdy {
-				log.Println("k8s: New Pod " + pod.Name)
-				conf, err := PodToConfig(pod)
-				if err == nil {
-					err := list.AddServer(pod.Name, maxtickets, conf)
-					if err != nil {
-						log.Println("k8s: AddServer:  ", err)
-					}
-				}
+		case <-ticker.C:
+			if proxy.Serverlist.QueueLength() > 0 {
+				scale()
 			}
+		case <-proxy.podScalerStopper:
+			return
 		}
-		proxy.UpdatePodMetric()
 	}
-	deletefunction := func(obj interface{}) {
-		pod := obj.(*v1.Pod)
-		log.Println("k8s: Delete Pod " + pod.Name)
-		err := list.SetServerDeletion(pod.Name)
-		if err != nil {
-			log.Println("k8s: SetServerDeletion:  ", err)
-		}
-		proxy.UpdatePodMetric()
-	}
-	return (cache.ResourceEventHandlerFuncs{
-		AddFunc:    addfunction,
-		DeleteFunc: deletefunction,
-		UpdateFunc: func(oldObj, newObj interface{}) {
-			podOld := oldObj.(*v1.Pod)
-			podNew := newObj.(*v1.Pod)
-			//We have to check different cases:
-			//A server was not ready and can be used now
-			//A server was ready but is not ready anymore
-			//A server was changed (e.g. IP or other changes)
-			if podOld.Status.Phase != v1.PodRunning && podNew.Status.Phase == v1.PodRunning {
-				//the pod status was changed to PodRunning
-				addfunction(podNew)
-			} else if podOld.Status.Phase == v1.PodRunning && podNew.Status.Phase != v1.PodRunning {
-				//the pod was changed from PodRunning to sth else
-				deletefunction(podNew)
-			} else if podOld.Status.PodIP != podNew.Status.PodIP { //I guess this should not happen
-				deletefunction(podOld)
-				addfunction(podNew)
-			} else {
-				for conditionOld := range podOld.Status.Conditions {
-					if podOld.Status.Conditions[conditionOld].Type == v1.PodReady {
-						for conditionNew := range podNew.Status.Conditions {
-							if podNew.Status.Conditions[conditionNew].Type == v1.PodReady {
-								if podOld.Status.Conditions[conditionOld].Status != v1.ConditionTrue &&
-									podNew.Status.Conditions[conditionNew].Status == v1.ConditionTrue {
-
-									addfunction(podNew)
-
-								} else if podOld.Status.Conditions[conditionOld].Status == v1.ConditionTrue &&
-									podNew.Status.Conditions[conditionNew].Status != v1.ConditionTrue {
+}
 
-									deletefunction(podNew)
-								}
-							}
-						}
-					}
-				}
-				//I think all other changes will not affect the proxy service
-			}
-			proxy.UpdatePodMetric()
-		},
-	})
+//podsNeeded Returns the number of Pods with maxTickets tickets each that are missing to serve
+// the waiting clients and to keep spare free tickets in addition. The free tickets and the
+// tickets of the Pods that are still starting are already available for this.
+func podsNeeded(waiting int, spare int, free int, starting int, maxTickets int) int {
+	missing := waiting + spare - free - starting*maxTickets
+	if missing <= 0 || maxTickets < 1 {
+		return 0
+	}
+	return (missing + maxTickets - 1) / maxTickets
 }
 
-//NewDeploymentHandlerForK8sconfig This function creates a new deployment handler.
-// It will watch for deployments in k8s with the desired annotations and
-// create (delete) the corresponding proxy. It is possible to have more than one
-// Deployment in a namespace, but they should have different app annotations and different ports.
-// This handler implements the actions of the DeploymentController.
-func NewDeploymentHandlerForK8sconfig(c interface{}, ns string,
-	proxies *ProxyMap, metric *PMetric) cache.ResourceEventHandlerFuncs {
-	clientset := c.(*kubernetes.Clientset)
-	addfunction := func(obj interface{}) {
-		deployment := obj.(*appsv1.Deployment)
-		proxies.Mux.Lock()
-		log.Println("k8s: Adding deployment" + deployment.Name)
-		if _, ok := proxies.Deployments[deployment.Name]; !ok {
-			var port string
-			if _, ok := deployment.GetAnnotations()["ipb-halle.de/k8sticket.deployment.port"]; !ok {
-				port = "9001"
-			} else {
-				port = deployment.GetAnnotations()["ipb-halle.de/k8sticket.deployment.port"]
-			}
-			var prefix string
-			if _, ok := deployment.GetAnnotations()["ipb-halle.de/k8sticket.deployment.app.name"]; !ok {
-				prefix = deployment.Name
-			} else {
-				prefix = deployment.GetAnnotations()["ipb-halle.de/k8sticket.deployment.app.name"]
-			}
-			var maxTickets int
-			if _, ok := deployment.GetAnnotations()["ipb-halle.de/k8sticket.deployment.tickets.max"]; !ok {
-				maxTickets = 1
-			} else {
-				_, err := strconv.Atoi(deployment.GetAnnotations()["ipb-halle.de/k8sticket.deployment.tickets.max"])
-				if err != nil {
-					log.Println("k8s: Deployment: " + deployment.Name +
-						"ipb-halle.de/k8sticket.deployment.tickets.max annotation malformed: " + err.Error())
-					maxTickets = 1
-				} else {
-					maxTickets, _ = strconv.Atoi(deployment.GetAnnotations()["ipb-halle.de/k8sticket.deployment.tickets.max"])
-				}
-			}
-			var spareTickets int
-			if _, ok := deployment.GetAnnotations()["ipb-halle.de/k8sticket.deployment.tickets.spare"]; !ok {
-				spareTickets = 2
-			} else {
-				_, err := strconv.Atoi(deployment.GetAnnotations()["ipb-halle.de/k8sticket.deployment.tickets.spare"])
-				if err != nil {
-					log.Println("k8s: Deployment: " + deployment.Name +
-						"ipb-halle.de/k8sticket.deployment.tickets.spare annotation malformed: " + err.Error())
-					spareTickets = 2
-				} else {
-					spareTickets, _ = strconv.Atoi(deployment.GetAnnotations()["ipb-halle.de/k8sticket.deployment.tickets.spare"])
-				}
-			}
-			var maxPods int
-			if _, ok := deployment.GetAnnotations()["ipb-halle.de/k8sticket.deployment.pods.max"]; !ok {
-				maxPods = 1
-			} else {
-				_, err := strconv.Atoi(deployment.GetAnnotations()["ipb-halle.de/k8sticket.deployment.pods.max"])
-				if err != nil {
-					log.Println("k8s: Deployment: " + deployment.Name +
-						"ipb-halle.de/k8sticket.deployment.pods.max annotation malformed: " + err.Error())
-					maxPods = 1
-				} else {
-					maxPods, _ = strconv.Atoi(deployment.GetAnnotations()["ipb-halle.de/k8sticket.deployment.pods.max"])
-				}
-			}
-			var cooldown int
-			if _, ok := deployment.GetAnnotations()["ipb-halle.de/k8sticket.deployment.pods.cooldown"]; !ok {
-				cooldown = 10
-			} else {
-				_, err := strconv.Atoi(deployment.GetAnnotations()["ipb-halle.de/k8sticket.deployment.pods.cooldown"])
-				if err != nil {
-					log.Println("k8s: Deployment: " + deployment.Name +
-						"ipb-halle.de/k8sticket.deployment.pods.cooldown annotation malformed: " + err.Error())
-					cooldown = 10
-				} else {
-					cooldown, _ = strconv.Atoi(deployment.GetAnnotations()["ipb-halle.de/k8sticket.deployment.pods.cooldown"])
-				}
-			}
-			var dns bool = false
-			if _, ok := deployment.GetAnnotations()["ipb-halle.de/k8sticket.ingress.dns"]; ok {
-				_, err := strconv.ParseBool(deployment.GetAnnotations()["ipb-halle.de/k8sticket.ingress.dns"])
-				if err == nil {
-					dns, _ = strconv.ParseBool(deployment.GetAnnotations()["ipb-halle.de/k8sticket.ingress.dns"])
-				} else {
-					log.Println("k8s: Deployment: " + deployment.Name + "ipb-halle.de/k8sticket.ingress.dns annotation malformed: " + err.Error())
-				}
-			}
+//ticketDemand This is the state of an application that decides how many autoscaled Pods it needs.
+// The podScaler creates Pods for it, see podsNeeded, and the podWatchdog keeps the Pods for it, see removeIdlePods.
+// The Pods that were created but are not in the PodCache yet (pending) and the Pods that are not registered
+// in the Serverlist yet are starting, running are all Pods that are not being deleted.
+type ticketDemand struct {
+	waiting  int
+	spare    int
+	free     int
+	starting int
+	running  int
+	pending  int
+}
 
-			log.Println("k8s: Adding deployment " + deployment.Name + " parameters: ")
-			log.Println("k8s: port: " + port)
-			log.Println("k8s: app: " + prefix)
-			log.Println("k8s: tickets.max: ", maxTickets)
-			log.Println("k8s: tickets.spare: ", spareTickets)
-			log.Println("k8s: pod.max: ", maxPods)
-			log.Println("k8s: pod.cooldown: ", cooldown)
-			log.Println("k8s: ingress.dns: ", dns)
-			proxies.Deployments[deployment.Name] = NewProxyForDeployment(clientset, prefix,
-				ns, port, maxTickets, spareTickets, maxPods, cooldown, deployment.Spec.Template, metric, dns)
-			proxies.Deployments[deployment.Name].Start()
-		} else {
-			log.Println("k8s: NewDeploymentHandlerForK8sconfig: Deployment " + deployment.Name + " already exists!")
+//demand Returns the demand of the proxy with the autoscaled Pods of the PodCache.
+// It has to be called with the locked mux of the proxy.
+func (proxy *ProxyForDeployment) demand(pods []*v1.Pod) ticketDemand {
+	pending := proxy.pendingPods(pods)
+	demand := ticketDemand{
+		waiting:  proxy.Serverlist.QueueLength(),
+		spare:    proxy.spareTarget(),
+		free:     proxy.Serverlist.GetAvailableTickets(),
+		starting: pending,
+		running:  pending,
+		pending:  pending,
+	}
+	for _, pod := range pods {
+		if pod.DeletionTimestamp != nil {
+			continue
 		}
-		proxies.Mux.Unlock()
+		demand.running++
+		if _, registered := proxy.Serverlist.ServerConfig(pod.Name); !registered {
+			demand.starting++
+		}
+	}
+	return demand
+}
 
+//surplus Returns the number of free and starting tickets that are needed neither for the waiting clients
+// nor for the spare tickets, if every Pod has maxTickets tickets. It is the opposite of the tickets missing in podsNeeded.
+func (demand ticketDemand) surplus(maxTickets int) int {
+	return demand.free + demand.starting*maxTickets - demand.waiting - demand.spare
+}
+
+//scalePods Creates the Pods needed for the waiting clients and the spare tickets in one batch,
+// see podsNeeded. The Pods are counted in the PodCache, the Pods that were created but are not in
+// the cache yet and the Pods that are not registered in the Serverlist yet are counted as starting, see demand.
+// While a pre-warming schedule is active, its spare tickets and its minimal number of Pods are kept,
+// see updateSchedules, and the predicted spare tickets are kept as well, see updatePrediction. No more than maxPods Pods are scaled.
+func (proxy *ProxyForDeployment) scalePods() error {
+	//check ressources
+	proxy.mux.Lock()
+	defer proxy.mux.Unlock()
+	pods, err := proxy.pods.scaledPods(proxy.namespace, proxy.Serverlist.Prefix())
+	if err != nil {
+		return err
 	}
-	deletionfunction := func(obj interface{}) {
-		proxies.Mux.Lock()
-		deployment := obj.(*appsv1.Deployment)
-		log.Println("k8s: Deleting deployment " + deployment.Name)
-		if _, ok := proxies.Deployments[deployment.Name]; !ok {
-			log.Println("k8s: NewDeploymentHandlerForK8sconfig: Deployment " + deployment.Name + " is not known!")
-		} else {
-			proxies.Deployments[deployment.Name].Stop()
-			delete(proxies.Deployments, deployment.Name)
+	demand := proxy.demand(pods)
+	needed := podsNeeded(demand.waiting, demand.spare, demand.free, demand.starting, proxy.maxTickets)
+	if missing := proxy.prewarmPods - demand.running; needed < missing {
+		needed = missing
+	}
+	if room := proxy.maxPods - len(pods) - demand.pending; needed > room {
+		needed = room
+	}
+	if needed <= 0 {
+		return nil
+	}
+	log.Println("k8s: podScaler: ", proxy.Serverlist.Prefix(), " creating ", needed, " Pods for ", demand.waiting,
+		" waiting clients, ", demand.starting, " Pods are starting")
+	for i := 0; i < needed; i++ {
+		//the pod template is copied, so that its labels stay as in the Deployment
+		template := proxy.podSpec.DeepCopy()
+		mypod := v1.Pod{
+			ObjectMeta: template.ObjectMeta,
+			Spec:       template.Spec,
 		}
-		proxies.Mux.Unlock()
-	}
-	return cache.ResourceEventHandlerFuncs{
-		AddFunc:    addfunction,
-		DeleteFunc: deletionfunction,
-		UpdateFunc: func(oldObj, newObj interface{}) {
-			proxies.Mux.Lock()
-			deploymentOld := oldObj.(*appsv1.Deployment)
-			deploymentNew := newObj.(*appsv1.Deployment)
-			if deploymentNew.Name != deploymentOld.Name {
-				log.Println("k8s: NewDeploymentHandlerForK8sconfig: Deployment " + deploymentOld.Name + " is updated!")
-				deletionfunction(deploymentOld)
-				addfunction(deploymentNew)
-			}
-			proxies.Deployments[deploymentNew.Name].mux.Lock()
-			if deploymentNew.Spec.Template.String() != deploymentOld.Spec.Template.String() {
-				log.Println("k8s: NewDeploymentHandlerForK8sconfig: Deployment " + deploymentOld.Name + " is updated!")
-				proxies.Deployments[deploymentNew.Name].podSpec = deploymentNew.Spec.Template
-			}
-			proxies.Deployments[deploymentNew.Name].mux.Unlock()
-
-			//other changes are handled by k8s itself
-			//e.g. change of pod template
-			proxies.Mux.Unlock()
-		},
+		if mypod.ObjectMeta.Labels == nil {
+			mypod.ObjectMeta.Labels = make(map[string]string)
+		}
+		mypod.ObjectMeta.Labels[labelScaled] = "true"
+		mypod.GenerateName = strings.ToLower(proxy.Serverlist.Prefix() + "-k8sticket-autoscaled-")
+		created, err := proxy.Clientset.CoreV1().Pods(proxy.namespace).Create(&mypod)
+		if err != nil {
+			return err
+		}
+		proxy.createdPods[created.Name] = proxy.Serverlist.Now()
+		log.Println("k8s: podScaler: Pod created successfully")
 	}
+	return nil
 }
 
-//NewMetaDeploymentHandlerForK8sconfig This function creates a new handler for the meta data of Deployments.
-// It will only watch for updates of the meta data.
-// It does basically the same job as the handler for the Deployment,
-// but enables the change of parameters while the application is running.
-// This handler implements the actions of the DeploymentMetaController.
-func NewMetaDeploymentHandlerForK8sconfig(c interface{}, ns string,
-	proxies *ProxyMap, metric *PMetric) cache.ResourceEventHandlerFuncs {
-	clientset := c.(*kubernetes.Clientset)
-	return cache.ResourceEventHandlerFuncs{
-		UpdateFunc: func(oldObj, newObj interface{}) {
-			proxies.Mux.Lock()
-			deploymentPMetaOld := oldObj.(*metav1.PartialObjectMetadata)
-			deploymentPMetaNew := newObj.(*metav1.PartialObjectMetadata)
-			deploymentMetaOld := deploymentPMetaOld.ObjectMeta
-			deploymentMetaNew := deploymentPMetaNew.ObjectMeta
-			ok := true
-			//log.Println("k8s: NewMetaDeploymentHandlerForK8sconfig: Deployment " + deploymentMetaOld.Name + " is updated!")
-			if deploymentMetaOld.Name != deploymentMetaNew.Name { //I think this is already processed in NewMetaDeploymentHandlerForK8sconfig
-				ok = false
-			}
-			if deploymentMetaOld.GetAnnotations()["ipb-halle.de/k8sticket.deployment.port"] != deploymentMetaNew.GetAnnotations()["ipb-halle.de/k8sticket.deployment.port"] {
-				ok = false
-			}
-			if deploymentMetaOld.GetAnnotations()["ipb-halle.de/k8sticket.deployment.app.name"] != deploymentMetaNew.GetAnnotations()["ipb-halle.de/k8sticket.deployment.app.name"] {
-				ok = false
-			}
-			if deploymentMetaOld.GetAnnotations()["ipb-halle.de/k8sticket.ingress.dns"] != deploymentMetaNew.GetAnnotations()["ipb-halle.de/k8sticket.ingress.dns"] {
-				ok = false
-			}
-			if !ok { //here we have to restart the proxy
-				log.Println("k8s: Deleting deployment " + deploymentMetaOld.Name)
-				if _, ok := proxies.Deployments[deploymentMetaOld.Name]; !ok {
-					log.Println("k8s: NewMetaDeploymentHandlerForK8sconfig: Deployment " + deploymentMetaOld.Name + " is not known!")
-				} else {
-					var port string
-					if _, ok := deploymentMetaNew.GetAnnotations()["ipb-halle.de/k8sticket.deployment.port"]; !ok {
-						port = "9001"
-					} else {
-						port = deploymentMetaNew.GetAnnotations()["ipb-halle.de/k8sticket.deployment.port"]
-					}
-					var prefix string
-					if _, ok := deploymentMetaNew.GetAnnotations()["ipb-halle.de/k8sticket.deployment.app.name"]; !ok {
-						prefix = deploymentMetaNew.Name
-					} else {
-						prefix = deploymentMetaNew.GetAnnotations()["ipb-halle.de/k8sticket.deployment.app.name"]
-					}
-					var maxTickets int
-					_, err := strconv.Atoi(deploymentMetaNew.GetAnnotations()["ipb-halle.de/k8sticket.deployment.tickets.max"])
-					if err != nil {
-						log.Println("k8s: Deployment: " + deploymentMetaNew.Name + "ipb-halle.de/k8sticket.deployment.tickets.max annotation malformed: " + err.Error())
-						maxTickets = 1
-					} else {
-						maxTickets, _ = strconv.Atoi(deploymentMetaNew.GetAnnotations()["ipb-halle.de/k8sticket.deployment.tickets.max"])
-					}
-					var dns bool = false
-					if _, ok := deploymentMetaNew.GetAnnotations()["ipb-halle.de/k8sticket.ingress.dns"]; ok {
-						_, err := strconv.ParseBool(deploymentMetaNew.GetAnnotations()["ipb-halle.de/k8sticket.ingress.dns"])
-						if err == nil {
-							dns, _ = strconv.ParseBool(deploymentMetaNew.GetAnnotations()["ipb-halle.de/k8sticket.ingress.dns"])
-						} else {
-							log.Println("k8s: Deployment: " + deploymentMetaNew.Name + "ipb-halle.de/k8sticket.ingress.dns annotation malformed: " + err.Error())
-						}
-					}
-					log.Println("k8s: Modifying deployment " + deploymentMetaOld.Name + " parameters: ")
-					log.Println("k8s: ", deploymentMetaNew.Name, " port: "+port)
-					log.Println("k8s: ", deploymentMetaNew.Name, " app: "+prefix)
-					log.Println("k8s: ", deploymentMetaNew.Name, " tickets.max: ", maxTickets)
-					log.Println("k8s: ", deploymentMetaNew.Name, " ingress.dns: ", dns)
-					proxies.Deployments[deploymentMetaOld.Name].Stop()
-					dpl := proxies.Deployments[deploymentMetaOld.Name]
-					delete(proxies.Deployments, deploymentMetaOld.Name)
-					proxies.Deployments[deploymentMetaNew.Name] = NewProxyForDeployment(clientset, prefix,
-						ns, port, maxTickets, dpl.spareTickets, dpl.maxPods, dpl.cooldown, dpl.podSpec, metric, dns)
-					proxies.Deployments[deploymentMetaNew.Name].Start()
-				}
-			} else {
-				if deploymentMetaOld.GetAnnotations()["ipb-halle.de/k8sticket.deployment.tickets.max"] != deploymentMetaNew.GetAnnotations()["ipb-halle.de/k8sticket.deployment.tickets.max"] {
-					_, err := strconv.Atoi(deploymentMetaNew.GetAnnotations()["ipb-halle.de/k8sticket.deployment.tickets.max"])
-					proxies.Deployments[deploymentMetaNew.Name].mux.Lock()
-					var maxTickets int
-					if err != nil {
-						log.Println("k8s: Deployment: " + deploymentMetaNew.Name + "ipb-halle.de/k8sticket.deployment.tickets.max annotation malformed: " + err.Error())
-						maxTickets = 1
-					} else {
-						maxTickets, _ = strconv.Atoi(deploymentMetaNew.GetAnnotations()["ipb-halle.de/k8sticket.deployment.tickets.max"])
-					}
-					log.Println("k8s: ", deploymentMetaNew.Name, " tickets.max: ", maxTickets)
-					proxies.Deployments[deploymentMetaNew.Name].Serverlist.ChangeAllMaxTickets(maxTickets)
-					proxies.Deployments[deploymentMetaNew.Name].mux.Unlock()
-				}
-			}
-			if deploymentMetaOld.GetAnnotations()["ipb-halle.de/k8sticket.deployment.tickets.spare"] != deploymentMetaNew.GetAnnotations()["ipb-halle.de/k8sticket.deployment.tickets.spare"] {
-				_, err := strconv.Atoi(deploymentMetaNew.GetAnnotations()["ipb-halle.de/k8sticket.deployment.tickets.spare"])
-				proxies.Deployments[deploymentMetaNew.Name].mux.Lock()
-				if err != nil {
-					log.Println("k8s: Deployment: " + deploymentMetaNew.Name + "ipb-halle.de/k8sticket.deployment.tickets.spare annotation malformed: " + err.Error())
-					proxies.Deployments[deploymentMetaNew.Name].spareTickets = 2
-				} else {
-					proxies.Deployments[deploymentMetaNew.Name].spareTickets, _ = strconv.Atoi(deploymentMetaNew.GetAnnotations()["ipb-halle.de/k8sticket.deployment.tickets.spare"])
-				}
-				log.Println("k8s: ", deploymentMetaNew.Name, " spareTickets: ", proxies.Deployments[deploymentMetaNew.Name].spareTickets)
-				proxies.Deployments[deploymentMetaNew.Name].mux.Unlock()
-			}
-			if deploymentMetaOld.GetAnnotations()["ipb-halle.de/k8sticket.deployment.pods.max"] != deploymentMetaNew.GetAnnotations()["ipb-halle.de/k8sticket.deployment.pods.max"] {
-				_, err := strconv.Atoi(deploymentMetaNew.GetAnnotations()["ipb-halle.de/k8sticket.deployment.pods.max"])
-				proxies.Deployments[deploymentMetaNew.Name].mux.Lock()
-				if err != nil {
-					log.Println("k8s: Deployment: " + deploymentMetaNew.Name + "ipb-halle.de/k8sticket.deployment.pods.max annotation malformed: " + err.Error())
-					proxies.Deployments[deploymentMetaNew.Name].maxPods = 1
-				} else {
-					proxies.Deployments[deploymentMetaNew.Name].maxPods, _ = strconv.Atoi(deploymentMetaNew.GetAnnotations()["ipb-halle.de/k8sticket.deployment.pods.max"])
-				}
-				proxies.Deployments[deploymentMetaNew.Name].podScalerInformer <- "update"
-				log.Println("k8s: ", deploymentMetaNew.Name, " maxPods: ", proxies.Deployments[deploymentMetaNew.Name].maxPods)
-				proxies.Deployments[deploymentMetaNew.Name].mux.Unlock()
-			}
-			if deploymentMetaOld.GetAnnotations()["ipb-halle.de/k8sticket.deployment.pods.cooldown"] != deploymentMetaNew.GetAnnotations()["ipb-halle.de/k8sticket.deployment.pods.cooldown"] {
-				_, err := strconv.Atoi(deploymentMetaNew.GetAnnotations()["ipb-halle.de/k8sticket.deployment.pods.cooldown"])
-				close(proxies.Deployments[deploymentMetaNew.Name].podWatchdogStopper)
-				proxies.Deployments[deploymentMetaNew.Name].mux.Lock()
-				proxies.Deployments[deploymentMetaNew.Name].podWatchdogStopper = make(chan struct{})
-				if err != nil {
-					log.Println("k8s: Deployment: " + deploymentMetaNew.Name + "ipb-halle.de/k8sticket.deployment.pods.cooldown annotation malformed: " + err.Error())
-					proxies.Deployments[deploymentMetaNew.Name].cooldown = 10
-				} else {
-					proxies.Deployments[deploymentMetaNew.Name].cooldown, _ = strconv.Atoi(deploymentMetaNew.GetAnnotations()["ipb-halle.de/k8sticket.deployment.pods.cooldown"])
-				}
-				log.Println("k8s: ", deploymentMetaNew.Name, " pod.cooldown: ", proxies.Deployments[deploymentMetaNew.Name].cooldown)
-				proxies.Deployments[deploymentMetaNew.Name].mux.Unlock()
-				go proxies.Deployments[deploymentMetaNew.Name].podWatchdog()
-			}
-			/*	if deploymentMetaNew.GetLabels()["k8sTicket"] != "true" {
-				proxies.Deployments[deploymentMetaOld.Name].Stop()
-				delete(proxies.Deployments, deploymentMetaOld.Name)
-			} */
-			//other changes are handled by k8s itself
-			//e.g. change of pod template
-			proxies.Mux.Unlock()
-		},
+//pendingPods Returns the number of Pods created by the podScaler that are not in the PodCache yet.
+// Pods that were not seen within podPendingTimeout are not counted anymore.
+// It has to be called with the locked mux of the proxy.
+func (proxy *ProxyForDeployment) pendingPods(cached []*v1.Pod) int {
+	for _, pod := range cached {
+		delete(proxy.createdPods, pod.Name)
+	}
+	for name, created := range proxy.createdPods {
+		if proxy.Serverlist.Now().Sub(created) > podPendingTimeout {
+			delete(proxy.createdPods, name)
+		}
 	}
+	return len(proxy.createdPods)
 }
 
-//podScaler This method creates new pods on-demand when a new ticket is created.
-func (proxy *ProxyForDeployment) podScaler() {
-	for {
-		select {
-		case msg := <-proxy.podScalerInformer:
-			if msg == "new ticket" || msg == "update" {
-				//check ressources
-				proxy.mux.Lock()
-				if proxy.Serverlist.GetAvailableTickets() < proxy.spareTickets {
-					pods, err := proxy.Clientset.CoreV1().Pods(proxy.namespace).List(
-						metav1.ListOptions{LabelSelector: "ipb-halle.de/k8sticket.deployment.app.name=" + proxy.Serverlist.Prefix + ",ipb-halle.de/k8sTicket.scaled=true"})
-					if err != nil {
-						panic(err.Error())
-					}
-					if len(pods.Items) < proxy.maxPods {
-						mypod := v1.Pod{
-							ObjectMeta: proxy.podSpec.ObjectMeta,
-							Spec:       proxy.podSpec.Spec,
-						}
-						mypod.ObjectMeta.Labels["ipb-halle.de/k8sTicket.scaled"] = "true"
-						mypod.GenerateName = strings.ToLower(proxy.Serverlist.Prefix + "-k8sticket-autoscaled-")
-						_, err := proxy.Clientset.CoreV1().Pods(proxy.namespace).Create(&mypod)
-						if err != nil {
-							panic(err)
-						}
-						log.Println("k8s: podScaler: Pod created successfully")
-					}
-				}
-				proxy.mux.Unlock()
-			}
-		case <-proxy.podScalerStopper:
-			return
-		}
+//deletePod Deletes an unused Pod created by the podScaler.
+// A failure other than a Pod that is already gone degrades the proxy, see apiFailed.
+func (proxy *ProxyForDeployment) deletePod(name string) {
+	err := proxy.Clientset.CoreV1().Pods(proxy.namespace).Delete(name, &metav1.DeleteOptions{})
+	if err == nil || apierrors.IsNotFound(err) {
+		proxy.apiSucceeded()
+		return
 	}
+	proxy.apiFailed("podWatchdog: deleting "+name, err)
 }
 
 //podWatchdog This method checks if a pod is unused and can be deleted.
-// Only pods scaled by the podScaler will be deleted.
+// Only pods scaled by the podScaler will be deleted. The Pods are checked every interval
+// of the scale-down policy, see removeIdlePods. A new interval is taken from podWatchdogPeriod.
+// While the Kubernetes API is failing, the checks are skipped until the backoff has passed.
 func (proxy *ProxyForDeployment) podWatchdog() {
-	ticker := time.NewTicker(time.Duration(proxy.cooldown) * time.Second)
-	defer ticker.Stop()
+	proxy.mux.Lock()
+	ticker := time.NewTicker(proxy.scaleDown.interval)
+	proxy.mux.Unlock()
+	defer func() {
+		ticker.Stop()
+	}()
 	//defer list.mux.Unlock()
 	for {
 		select {
+		case interval := <-proxy.podWatchdogPeriod:
+			ticker.Stop()
+			ticker = time.NewTicker(interval)
 		case <-ticker.C:
-			log.Println("k8s: podWatchdog: Start cleaning")
-			pods, err := proxy.Clientset.CoreV1().Pods(proxy.namespace).List(
-				metav1.ListOptions{LabelSelector: "ipb-halle.de/k8sticket.deployment.app.name=" + proxy.Serverlist.Prefix + ",ipb-halle.de/k8sTicket.scaled=true"})
-			if err != nil {
-				panic("k8s: podWatchdog: " + err.Error())
-			}
-			proxy.mux.Lock()
-			if proxy.Serverlist.GetAvailableTickets() > proxy.spareTickets {
-				for _, pod := range pods.Items {
-					if _, ok := proxy.Serverlist.Servers[pod.Name]; ok {
-						log.Println("k8s: podWatchdog: Checking "+pod.Name+" with ", len(proxy.Serverlist.Servers[pod.Name].Tickets), " Tickets")
-						if proxy.Serverlist.Servers[pod.Name].HasNoTickets() {
-							if time.Since(proxy.Serverlist.Servers[pod.Name].GetLastUsed()).Milliseconds() > int64(proxy.cooldown)*time.Second.Milliseconds() {
-								if (proxy.Serverlist.GetAvailableTickets() - proxy.Serverlist.Servers[pod.Name].GetMaxTickets()) >= proxy.spareTickets {
-									err := proxy.Clientset.CoreV1().Pods(proxy.namespace).Delete(pod.Name, &metav1.DeleteOptions{})
-									if err != nil {
-										log.Println("k8s: podWatchdog: Error deleting "+pod.Name+": ", err)
-									}
-								}
-							}
-						}
-					} else {
-						log.Println("k8s: podWatchdog: There is an unused pod which is not in the serverlist " + pod.Name)
-						err := proxy.Clientset.CoreV1().Pods(proxy.namespace).Delete(pod.Name, &metav1.DeleteOptions{})
-						if err != nil {
-							log.Println("k8s: podWatchdog: Error deleting "+pod.Name+": ", err)
-						}
-					}
-				}
+			if !proxy.leadership.IsLeader() || proxy.apiRetryIn() > 0 {
+				continue
 			}
-			proxy.mux.Unlock()
+			proxy.removeIdlePods()
 		case <-proxy.podWatchdogStopper:
 			log.Println("k8s: podWatchdog: Exiting")
 			//log.Println("k8s: podWatchdog: Start cleaning")
 			//The following part can remove autoscaled pods when the ProxyForDeployment is deleted.
 			//But this will kill all connections on the running pods, therefore it is disabled.
-			/*pods, err := proxy.Clientset.CoreV1().Pods(proxy.namespace).List(metav1.ListOptions{LabelSelector: "ipb-halle.de/k8sticket.deployment.app=" + proxy.Serverlist.Prefix + ",ipb-halle.de/k8sTicket.scaled=true"})
+			/*pods, err := proxy.Clientset.CoreV1().Pods(proxy.namespace).List(metav1.ListOptions{LabelSelector: "ipb-halle.de/k8sticket.deployment.app=" + proxy.Serverlist.Prefix() + ",ipb-halle.de/k8sTicket.scaled=true"})
 			if err != nil {
 				panic("k8s: podWatchdog: " + err.Error())
 			}
@@ -722,3 +680,41 @@ func (proxy *ProxyForDeployment) podWatchdog() {
 		}
 	}
 }
+
+//removeIdlePods Removes the idle autoscaled Pods in the order of the scale-down policy, see scaleDownCandidates,
+// as long as the tickets for the waiting clients and the spare tickets are kept. The demand is the same as
+// for the podScaler, so the tickets of the starting Pods count as well, see demand. While a pre-warming
+// schedule is active, its spare tickets and its minimal number of Pods are kept.
+func (proxy *ProxyForDeployment) removeIdlePods() {
+	log.Println("k8s: podWatchdog: Start cleaning")
+	pods, err := proxy.pods.scaledPods(proxy.namespace, proxy.Serverlist.Prefix())
+	if err != nil {
+		log.Println("k8s: podWatchdog: ", err)
+		return
+	}
+	proxy.mux.Lock()
+	defer proxy.mux.Unlock()
+	demand := proxy.demand(pods)
+	surplus := demand.surplus(proxy.maxTickets)
+	if surplus <= 0 {
+		return
+	}
+	removed := 0
+	for _, candidate := range proxy.scaleDownCandidates(pods) {
+		if proxy.scaleDown.maxRemovals > 0 && removed >= proxy.scaleDown.maxRemovals ||
+			demand.running-removed <= proxy.prewarmPods {
+			break
+		}
+		if surplus-candidate.maxTickets < 0 {
+			continue
+		}
+		if !candidate.registered {
+			log.Println("k8s: podWatchdog: There is an unused pod which is not in the serverlist " + candidate.name)
+		} else {
+			log.Println("k8s: podWatchdog: Removing idle pod " + candidate.name)
+		}
+		surplus -= candidate.maxTickets
+		proxy.deletePod(candidate.name)
+		removed++
+	}
+}
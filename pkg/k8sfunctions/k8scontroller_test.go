@@ -0,0 +1,41 @@
+package k8sfunctions
+
+import "testing"
+
+func TestPodsNeeded(t *testing.T) {
+	tests := []struct {
+		name       string
+		waiting    int
+		spare      int
+		free       int
+		starting   int
+		maxTickets int
+		want       int
+	}{
+		{"nothing to do", 0, 0, 0, 0, 2, 0},
+		{"example of the documentation", 5, 2, 1, 1, 2, 2},
+		{"exact fit", 4, 0, 0, 0, 2, 2},
+		{"rounded up", 3, 0, 0, 0, 2, 2},
+		{"spare tickets only", 0, 5, 0, 0, 2, 3},
+		{"covered by free tickets", 2, 1, 3, 0, 2, 0},
+		{"covered by starting Pods", 4, 0, 0, 2, 2, 0},
+		{"more free tickets than needed", 1, 0, 10, 3, 2, 0},
+		{"one ticket per Pod", 3, 1, 1, 1, 1, 2},
+		{"no tickets per Pod", 5, 0, 0, 0, 0, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := podsNeeded(test.waiting, test.spare, test.free, test.starting, test.maxTickets); got != test.want {
+				t.Errorf("podsNeeded = %d, expected %d", got, test.want)
+			}
+			if test.maxTickets < 1 {
+				return
+			}
+			//the podWatchdog removes Pods only while the podScaler would not create any
+			demand := ticketDemand{waiting: test.waiting, spare: test.spare, free: test.free, starting: test.starting}
+			if surplus := demand.surplus(test.maxTickets); (surplus < 0) != (test.want > 0) {
+				t.Errorf("surplus = %d, but podsNeeded = %d", surplus, test.want)
+			}
+		})
+	}
+}
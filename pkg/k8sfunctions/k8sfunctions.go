@@ -10,6 +10,8 @@ import (
 
 	"github.com/ipb-halle/k8sTicket/pkg/proxyfunctions"
 	"k8s.io/api/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
 )
 
 const (
@@ -35,6 +37,34 @@ func Namespace() string {
 	return "default"
 }
 
+// RestConfig This function returns the configuration for the Kubernetes API and the namespace
+// of the selected context. If neither kubeconfig nor context are given, the in-cluster
+// configuration of the ServiceAccount is used and the namespace is empty. Outside of a cluster
+// (or if kubeconfig or context are given) the kubeconfig file is read instead. Without kubeconfig,
+// the files of $KUBECONFIG or ~/.kube/config are read. Without context, the current context is used.
+func RestConfig(kubeconfig string, context string) (*rest.Config, string, error) {
+	if kubeconfig == "" && context == "" {
+		config, err := rest.InClusterConfig()
+		if err != rest.ErrNotInCluster {
+			return config, "", err
+		}
+		log.Println("k8s: not running in a cluster, reading the kubeconfig")
+	}
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = kubeconfig
+	clientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules,
+		&clientcmd.ConfigOverrides{CurrentContext: context})
+	config, err := clientConfig.ClientConfig()
+	if err != nil {
+		return nil, "", err
+	}
+	ns, _, err := clientConfig.Namespace()
+	if err != nil {
+		return nil, "", err
+	}
+	return config, ns, nil
+}
+
 // PodToConfig This function reads the k8sTicket annotations and creates
 // a config for the reverse proxy.
 func PodToConfig(pod *v1.Pod) (proxyfunctions.Config, error) {
@@ -56,5 +86,6 @@ func PodToConfig(pod *v1.Pod) (proxyfunctions.Config, error) {
 			cport, _ = strconv.Atoi(port)
 		}
 	}
-	return proxyfunctions.Config{Host: ip + ":" + strconv.Itoa(cport), Path: cpath}, nil
+	flavor := pod.GetAnnotations()["ipb-halle.de/k8sticket.pod.flavor"]
+	return proxyfunctions.Config{Host: ip + ":" + strconv.Itoa(cport), Path: cpath, Flavor: flavor}, nil
 }
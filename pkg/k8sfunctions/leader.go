@@ -0,0 +1,100 @@
+package k8sfunctions
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+const (
+	leaseDuration = 15 * time.Second
+	renewDeadline = 10 * time.Second
+	retryPeriod   = 2 * time.Second
+)
+
+//Leadership This struct tells the ProxyForDeployments of a k8sTicket replica if
+// they are allowed to scale and delete Pods. In high-availability mode, the
+// replicas elect a leader with a coordination Lease and only the leader scales.
+// A nil Leadership is used when k8sTicket runs as a single replica, it is always leading.
+type Leadership struct {
+	Identity string
+	leading  bool
+	mux      sync.Mutex
+	//OnStartedLeading is called whenever this replica becomes the leader
+	OnStartedLeading func()
+}
+
+//NewLeadership Creates a new Leadership for a replica with the given identity.
+// The replica is not leading until Run has won the election.
+func NewLeadership(identity string) *Leadership {
+	return &Leadership{Identity: identity}
+}
+
+//IsLeader Returns true if this replica is allowed to scale and delete Pods.
+func (leadership *Leadership) IsLeader() bool {
+	if leadership == nil {
+		return true
+	}
+	leadership.mux.Lock()
+	defer leadership.mux.Unlock()
+	return leadership.leading
+}
+
+//setLeading Changes the state of the Leadership taking the mux into account.
+func (leadership *Leadership) setLeading(leading bool) {
+	leadership.mux.Lock()
+	leadership.leading = leading
+	leadership.mux.Unlock()
+}
+
+//Run This method takes part in the leader election with the Lease name in the
+// namespace ns until the context is canceled. When the leadership is lost, the
+// replica stops scaling and tries to get it back.
+func (leadership *Leadership) Run(ctx context.Context, clientset kubernetes.Interface, ns string, name string) {
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: ns,
+		},
+		Client: clientset.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: leadership.Identity,
+		},
+	}
+	for {
+		leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+			Lock:            lock,
+			ReleaseOnCancel: true,
+			LeaseDuration:   leaseDuration,
+			RenewDeadline:   renewDeadline,
+			RetryPeriod:     retryPeriod,
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: func(ctx context.Context) {
+					log.Println("k8s: Leadership: ", leadership.Identity, " is leading now")
+					leadership.setLeading(true)
+					if leadership.OnStartedLeading != nil {
+						leadership.OnStartedLeading()
+					}
+				},
+				OnStoppedLeading: func() {
+					log.Println("k8s: Leadership: ", leadership.Identity, " stopped leading")
+					leadership.setLeading(false)
+				},
+				OnNewLeader: func(identity string) {
+					log.Println("k8s: Leadership: current leader is ", identity)
+				},
+			},
+		})
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+	}
+}
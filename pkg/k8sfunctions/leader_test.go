@@ -0,0 +1,161 @@
+package k8sfunctions
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ipb-halle/k8sTicket/pkg/proxyfunctions"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+//eventually Returns true as soon as condition is true, or false if it is still false after timeout.
+func eventually(timeout time.Duration, condition func() bool) bool {
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		if condition() {
+			return true
+		}
+	}
+	return condition()
+}
+
+//newTestClientset Creates a fake clientset that generates the names of the Pods, like the API server.
+func newTestClientset() *fake.Clientset {
+	clientset := fake.NewSimpleClientset()
+	var mux sync.Mutex
+	count := 0
+	clientset.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		pod := action.(k8stesting.CreateAction).GetObject().(*v1.Pod)
+		if pod.Name == "" {
+			mux.Lock()
+			count++
+			pod.Name = fmt.Sprintf("%s%05d", pod.GenerateName, count)
+			mux.Unlock()
+		}
+		return false, nil, nil
+	})
+	return clientset
+}
+
+//newTestProxy Creates a proxy of the app "app" in the namespace "ns" with one ticket per Pod
+// and the given spare tickets. The PodCache is filled by the test.
+func newTestProxy(clientset *fake.Clientset, leadership *Leadership, spare int) *ProxyForDeployment {
+	metric := NewPMetric()
+	template := v1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{labelAppName: "app"}},
+		Spec:       v1.PodSpec{Containers: []v1.Container{{Name: "app", Image: "app"}}},
+	}
+	return NewProxyForDeployment(clientset, "app", "ns", "0", 1, spare, 3, 0, template, &metric,
+		false, false, "", proxyfunctions.NewMemoryTicketStore(), leadership, nil, nil, NewPodCache(clientset, []string{"ns"}))
+}
+
+//podCount Returns the number of Pods in the fake clientset.
+func podCount(t *testing.T, clientset *fake.Clientset) int {
+	pods, err := clientset.CoreV1().Pods("ns").List(metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(pods.Items)
+}
+
+func TestLeadershipHandover(t *testing.T) {
+	if testing.Short() {
+		t.Skip("the leader election takes several seconds")
+	}
+	clientset := fake.NewSimpleClientset()
+	first, second := NewLeadership("first"), NewLeadership("second")
+	var mux sync.Mutex
+	started := 0
+	second.OnStartedLeading = func() {
+		mux.Lock()
+		started++
+		mux.Unlock()
+	}
+	ctxFirst, stopFirst := context.WithCancel(context.Background())
+	defer stopFirst()
+	ctxSecond, stopSecond := context.WithCancel(context.Background())
+	defer stopSecond()
+	firstDone := make(chan struct{})
+	go func() {
+		first.Run(ctxFirst, clientset, "ns", "lease")
+		close(firstDone)
+	}()
+	if !eventually(5*time.Second, first.IsLeader) {
+		t.Fatal("the first replica did not win the election")
+	}
+	go second.Run(ctxSecond, clientset, "ns", "lease")
+	time.Sleep(retryPeriod + retryPeriod/2)
+	if second.IsLeader() {
+		t.Fatal("the second replica leads while the first one holds the Lease")
+	}
+	//the first replica stops and releases the Lease
+	stopFirst()
+	<-firstDone
+	if first.IsLeader() {
+		t.Error("the stopped replica still leads")
+	}
+	if !eventually(3*retryPeriod, second.IsLeader) {
+		t.Fatal("the second replica did not take over the released Lease")
+	}
+	mux.Lock()
+	defer mux.Unlock()
+	if started != 1 {
+		t.Errorf("OnStartedLeading was called %d times, expected once", started)
+	}
+}
+
+func TestFollowerDoesNotScale(t *testing.T) {
+	clientset := newTestClientset()
+	leadership := NewLeadership("follower")
+	proxy := newTestProxy(clientset, leadership, 2)
+	go proxy.podScaler()
+	defer close(proxy.podScalerStopper)
+	proxy.TriggerScaler()
+	time.Sleep(200 * time.Millisecond)
+	if n := podCount(t, clientset); n != 0 {
+		t.Fatalf("the follower created %d Pods", n)
+	}
+	//the replica becomes the leader, see OnStartedLeading in main
+	leadership.setLeading(true)
+	proxy.TriggerScaler()
+	if !eventually(2*time.Second, func() bool { return podCount(t, clientset) == 2 }) {
+		t.Errorf("the leader created %d Pods for 2 spare tickets, expected 2", podCount(t, clientset))
+	}
+}
+
+func TestFollowerDoesNotRemovePods(t *testing.T) {
+	clientset := newTestClientset()
+	leadership := NewLeadership("follower")
+	proxy := newTestProxy(clientset, leadership, 0)
+	proxy.scaleDown = scaleDownPolicy{order: ScaleDownLRU, interval: 20 * time.Millisecond}
+	//an idle autoscaled Pod that is registered in the Serverlist
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "idle", Namespace: "ns",
+		Labels:            map[string]string{labelAppName: "app", labelScaled: "true"},
+		CreationTimestamp: metav1.NewTime(time.Now().Add(-time.Hour))}}
+	if _, err := clientset.CoreV1().Pods("ns").Create(pod); err != nil {
+		t.Fatal(err)
+	}
+	if err := proxy.pods.indexers["ns"].Add(pod); err != nil {
+		t.Fatal(err)
+	}
+	if err := proxy.Serverlist.AddServer("idle", 1, proxyfunctions.Config{Host: "10.0.0.1:80", Path: "/"}); err != nil {
+		t.Fatal(err)
+	}
+	proxy.Serverlist.Servers["idle"].LastUsed = time.Now().Add(-time.Hour)
+	go proxy.podWatchdog()
+	defer close(proxy.podWatchdogStopper)
+	time.Sleep(200 * time.Millisecond)
+	if n := podCount(t, clientset); n != 1 {
+		t.Fatal("the follower removed the idle Pod")
+	}
+	leadership.setLeading(true)
+	if !eventually(2*time.Second, func() bool { return podCount(t, clientset) == 0 }) {
+		t.Error("the leader did not remove the idle Pod")
+	}
+}
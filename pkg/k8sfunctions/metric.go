@@ -1,46 +1,71 @@
 package k8sfunctions
 
 import (
+	"log"
+
 	"github.com/prometheus/client_golang/prometheus"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/rest"
 )
 
 //PMetric This struct defines our exported metrics.
-// We export the current users, the available Tickets, the scaled Pods and
-// a counter for all served users.
+// We export the current users, the available Tickets, the scaled Pods,
+// a counter for all served users, if the application is degraded, which pre-warming schedules are active
+// and the learned and predicted tickets of the predictive pre-warming.
 type PMetric struct {
 	CurrentUsers       *prometheus.GaugeVec
 	CurrentFreeTickets *prometheus.GaugeVec
 	CurrentScaledPods  *prometheus.GaugeVec
 	TotalUsers         *prometheus.CounterVec
+	Degraded           *prometheus.GaugeVec
+	PrewarmActive      *prometheus.GaugeVec
+	ExpectedArrivals   *prometheus.GaugeVec
+	PredictedSpare     *prometheus.GaugeVec
 }
 
 //NewPMetric This function defines the metrics from the PMetric struct.
-// We will label each value with the Prefix (application name).
+// We will label each value with the namespace and the Prefix (application name),
+// the activity of the pre-warming schedules additionally with the name of the schedule.
 func NewPMetric() PMetric {
 	return (PMetric{
 		CurrentUsers: prometheus.NewGaugeVec(prometheus.GaugeOpts{
 			Name: "k8sticket_current_users_total",
 			Help: "The total number of current users",
 		},
-			[]string{"application"}),
+			[]string{"namespace", "application"}),
 		CurrentFreeTickets: prometheus.NewGaugeVec(prometheus.GaugeOpts{
 			Name: "k8sticket_current_free_tickets_total",
 			Help: "The number of slots than can be used for client connections",
 		},
-			[]string{"application"}),
+			[]string{"namespace", "application"}),
 		CurrentScaledPods: prometheus.NewGaugeVec(prometheus.GaugeOpts{
 			Name: "k8sticket_scaled_pods_total",
 			Help: "The number of pods autoscaled by k8sticket",
 		},
-			[]string{"application"}),
+			[]string{"namespace", "application"}),
 		TotalUsers: prometheus.NewCounterVec(prometheus.CounterOpts{
 			Name: "k8sticket_users_total",
 			Help: "The total number of users served (total number of made out tickets)",
 		},
-			[]string{"application"}),
+			[]string{"namespace", "application"}),
+		Degraded: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "k8sticket_degraded",
+			Help: "1 if the Kubernetes API calls of the application are failing and retried, 0 otherwise",
+		},
+			[]string{"namespace", "application"}),
+		PrewarmActive: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "k8sticket_prewarm_active",
+			Help: "1 while the pre-warming schedule raises the capacity of the application, 0 otherwise",
+		},
+			[]string{"namespace", "application", "schedule"}),
+		ExpectedArrivals: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "k8sticket_expected_arrivals",
+			Help: "The learned number of tickets made out in the current hour of the week",
+		},
+			[]string{"namespace", "application"}),
+		PredictedSpare: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "k8sticket_predicted_spare_tickets",
+			Help: "The spare tickets kept for the tickets expected at the lead time",
+		},
+			[]string{"namespace", "application"}),
 	})
 }
 
@@ -52,10 +77,10 @@ func (proxy *ProxyForDeployment) UpdateAccessMetric(informer chan string) {
 		select {
 		case msg := <-informer:
 			if msg == "new ticket" {
-				proxy.metric.TotalUsers.WithLabelValues(proxy.Serverlist.Prefix).Inc()
+				proxy.metric.TotalUsers.WithLabelValues(proxy.namespace, proxy.Serverlist.Prefix()).Inc()
 			}
-			proxy.metric.CurrentUsers.WithLabelValues(proxy.Serverlist.Prefix).Set(float64(proxy.Serverlist.GetTickets()))
-			proxy.metric.CurrentFreeTickets.WithLabelValues(proxy.Serverlist.Prefix).Set(float64(proxy.Serverlist.GetAvailableTickets()))
+			proxy.metric.CurrentUsers.WithLabelValues(proxy.namespace, proxy.Serverlist.Prefix()).Set(float64(proxy.Serverlist.GetTickets()))
+			proxy.metric.CurrentFreeTickets.WithLabelValues(proxy.namespace, proxy.Serverlist.Prefix()).Set(float64(proxy.Serverlist.GetAvailableTickets()))
 		case <-proxy.metricStopper:
 			return
 		}
@@ -63,22 +88,12 @@ func (proxy *ProxyForDeployment) UpdateAccessMetric(informer chan string) {
 }
 
 //UpdatePodMetric This method is called in the PodHandler to update the metric
-// about new or deleted autoscaled Pods by k8sTicket
+// about new or deleted autoscaled Pods by k8sTicket. The Pods are counted in the PodCache.
 func (proxy *ProxyForDeployment) UpdatePodMetric() {
-	config, err := rest.InClusterConfig() //I guess it is maybe smarter to give a
-	//reference to an exisiting config here instead of generating a new one all the time
-	if err != nil {
-		panic(err.Error())
-	}
-	// creates the clientset
-	clientset, err := kubernetes.NewForConfig(config)
-	if err != nil {
-		panic(err.Error())
-	}
-	pods, err := clientset.CoreV1().Pods(proxy.namespace).List(metav1.ListOptions{
-		LabelSelector: "ipb-halle.de/k8sticket.deployment.app=" + proxy.Serverlist.Prefix + ",ipb-halle.de/k8sTicket.scaled=true"})
+	pods, err := proxy.pods.scaledPods(proxy.namespace, proxy.Serverlist.Prefix())
 	if err != nil {
-		panic("Metric: UpdatePodMetric: " + err.Error())
+		log.Println("k8s: Metric: UpdatePodMetric: ", err)
+		return
 	}
-	proxy.metric.CurrentScaledPods.WithLabelValues(proxy.Serverlist.Prefix).Set(float64(len(pods.Items)))
+	proxy.metric.CurrentScaledPods.WithLabelValues(proxy.namespace, proxy.Serverlist.Prefix()).Set(float64(len(pods)))
 }
@@ -0,0 +1,132 @@
+package k8sfunctions
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+)
+
+//NamespaceScope This struct defines the namespaces watched by k8sTicket. These are either
+// an explicit list of namespaces, the namespaces matching a label selector or all namespaces.
+// The Deployments, Pods and TicketApps of an explicit list are watched by one informer per
+// namespace, so that k8sTicket only needs a RoleBinding in each of them. The other modes
+// watch all namespaces and need a ClusterRoleBinding.
+type NamespaceScope struct {
+	names      []string
+	selector   labels.Selector
+	lister     corelisters.NamespaceLister
+	controller *Controller
+}
+
+//NewNamespaceScope Creates the NamespaceScope for the comma separated list of namespaces names,
+// the label selector of the namespaces or all namespaces. Only one of them may be given.
+func NewNamespaceScope(clientset kubernetes.Interface, names string, selector string, all bool) (*NamespaceScope, error) {
+	scope := &NamespaceScope{}
+	modes := 0
+	for _, set := range []bool{names != "", selector != "", all} {
+		if set {
+			modes++
+		}
+	}
+	if modes != 1 {
+		return nil, errors.New("exactly one of a list of namespaces, a namespace selector or all namespaces has to be given")
+	}
+	if names != "" {
+		known := make(map[string]bool)
+		for _, name := range strings.Split(names, ",") {
+			name = strings.TrimSpace(name)
+			if name != "" && !known[name] {
+				known[name] = true
+				scope.names = append(scope.names, name)
+			}
+		}
+		if len(scope.names) == 0 {
+			return nil, errors.New("the list of namespaces is empty")
+		}
+		sort.Strings(scope.names)
+		return scope, nil
+	}
+	if selector != "" {
+		parsed, err := labels.Parse(selector)
+		if err != nil {
+			return nil, err
+		}
+		scope.selector = parsed
+		factory := informers.NewSharedInformerFactory(clientset, podResync)
+		namespaces := factory.Core().V1().Namespaces()
+		scope.lister = namespaces.Lister()
+		scope.controller = &Controller{
+			Clientset: clientset,
+			Factory:   factory,
+			Informer:  namespaces.Informer(),
+			Stopper:   make(chan struct{}),
+		}
+	}
+	return scope, nil
+}
+
+//InformerNamespaces Returns the namespaces the informers have to be created for.
+// An empty string stands for all namespaces.
+func (scope *NamespaceScope) InformerNamespaces() []string {
+	if len(scope.names) > 0 {
+		return scope.names
+	}
+	return []string{metav1.NamespaceAll}
+}
+
+//Single Returns true if only one namespace is watched.
+func (scope *NamespaceScope) Single() bool {
+	return len(scope.names) == 1
+}
+
+//Run Runs the informer of the namespaces of a selector. It returns when the namespaces are known.
+func (scope *NamespaceScope) Run() {
+	if scope.controller == nil {
+		return
+	}
+	scope.controller.Factory.(informers.SharedInformerFactory).Start(scope.controller.Stopper)
+	scope.controller.Factory.(informers.SharedInformerFactory).WaitForCacheSync(scope.controller.Stopper)
+}
+
+//Stop Stops the informer of the namespaces.
+func (scope *NamespaceScope) Stop() {
+	if scope.controller != nil {
+		close(scope.controller.Stopper)
+	}
+}
+
+//Watches Returns true if the namespace ns is watched. The labels of the namespaces are
+// read from the informer, so that a namespace is added or removed when its labels change.
+func (scope *NamespaceScope) Watches(ns string) bool {
+	switch {
+	case len(scope.names) > 0:
+		i := sort.SearchStrings(scope.names, ns)
+		return i < len(scope.names) && scope.names[i] == ns
+	case scope.selector != nil:
+		namespace, err := scope.lister.Get(ns)
+		if err != nil {
+			return false
+		}
+		return scope.selector.Matches(labels.Set(namespace.Labels))
+	default:
+		return true
+	}
+}
+
+//String Describes the watched namespaces for the log.
+func (scope *NamespaceScope) String() string {
+	switch {
+	case len(scope.names) > 0:
+		return strings.Join(scope.names, ", ")
+	case scope.selector != nil:
+		return "the namespaces matching " + scope.selector.String()
+	default:
+		return "all namespaces"
+	}
+}
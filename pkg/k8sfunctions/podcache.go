@@ -0,0 +1,225 @@
+package k8sfunctions
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/informers/internalinterfaces"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	//the name of the index of the PodCache by app label
+	podAppIndex = "app"
+
+	//the label of the Pods created by the podScaler
+	labelScaled = "ipb-halle.de/k8sTicket.scaled"
+
+	//the resync period of the shared informer of the Pods
+	podResync = 30 * time.Second
+
+	//the time a Pod created by the podScaler is counted before it shows up in the PodCache
+	podPendingTimeout = time.Minute
+
+	//the interval of the podScaler for checking the demand while clients are waiting
+	scalerPeriod = 10 * time.Second
+)
+
+//PodCache This struct holds the shared informers of the Pods of all applications, one for each
+// namespace of the NamespaceScope (or one for all namespaces). The proxies read the Pods from their
+// listers instead of asking the API server and subscribe to the app labels of their Pods in their
+// namespace. The events of a Pod are dispatched to the pod queues of the proxies subscribed to its
+// namespace and app label, see reconcilePod. Pods are never shared between namespaces.
+type PodCache struct {
+	controllers map[string]*Controller
+	listers     map[string]corelisters.PodLister
+	indexers    map[string]cache.Indexer
+	mux         sync.Mutex
+	subscribers map[string]map[*ProxyForDeployment]bool
+}
+
+//appKey Returns the key of the app label app in the namespace ns.
+func appKey(ns string, app string) string {
+	return ns + "/" + app
+}
+
+//NewPodCache Creates the PodCache for the Pods with an app label in the namespaces
+// (an empty string stands for all namespaces), see NamespaceScope.InformerNamespaces.
+func NewPodCache(clientset kubernetes.Interface, namespaces []string) *PodCache {
+	podCache := &PodCache{
+		controllers: make(map[string]*Controller),
+		listers:     make(map[string]corelisters.PodLister),
+		indexers:    make(map[string]cache.Indexer),
+		subscribers: make(map[string]map[*ProxyForDeployment]bool),
+	}
+	for _, ns := range namespaces {
+		factory := informers.NewSharedInformerFactoryWithOptions(clientset,
+			podResync,
+			informers.WithNamespace(ns),
+			informers.WithTweakListOptions(internalinterfaces.TweakListOptionsFunc(func(options *metav1.ListOptions) {
+				options.LabelSelector = labelAppName
+			})))
+		pods := factory.Core().V1().Pods()
+		informer := pods.Informer()
+		if err := informer.AddIndexers(cache.Indexers{podAppIndex: func(obj interface{}) ([]string, error) {
+			pod := obj.(*v1.Pod)
+			return []string{appKey(pod.Namespace, pod.Labels[labelAppName])}, nil
+		}}); err != nil {
+			log.Println("k8s: PodCache: ", err)
+		}
+		podCache.controllers[ns] = &Controller{
+			Clientset: clientset,
+			Factory:   factory,
+			Informer:  informer,
+			Stopper:   make(chan struct{}),
+		}
+		podCache.listers[ns] = pods.Lister()
+		podCache.indexers[ns] = informer.GetIndexer()
+		informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc: podCache.dispatch,
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				//a Pod whose app label was changed leaves the proxy of the previous label
+				if oldObj.(*v1.Pod).Labels[labelAppName] != newObj.(*v1.Pod).Labels[labelAppName] {
+					podCache.dispatch(oldObj)
+				}
+				podCache.dispatch(newObj)
+			},
+			DeleteFunc: podCache.dispatch,
+		})
+	}
+	return podCache
+}
+
+//Run Runs the shared informers until Stop is called.
+func (pods *PodCache) Run() {
+	for _, controller := range pods.controllers {
+		controller.Factory.(informers.SharedInformerFactory).Start(controller.Stopper)
+	}
+}
+
+//Stop Stops the shared informers.
+func (pods *PodCache) Stop() {
+	for _, controller := range pods.controllers {
+		close(controller.Stopper)
+	}
+}
+
+//HasSynced Returns true if the caches of all namespaces have been filled.
+func (pods *PodCache) HasSynced() bool {
+	for _, controller := range pods.controllers {
+		if !controller.Informer.HasSynced() {
+			return false
+		}
+	}
+	return true
+}
+
+//informerNamespace Returns the namespace of the informer watching the namespace ns.
+func (pods *PodCache) informerNamespace(ns string) string {
+	if _, ok := pods.controllers[ns]; ok {
+		return ns
+	}
+	return metav1.NamespaceAll
+}
+
+//dispatch Adds the key of a Pod to the pod queues of the proxies subscribed to its app label.
+func (pods *PodCache) dispatch(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	pod, ok := obj.(*v1.Pod)
+	if !ok {
+		log.Printf("k8s: PodCache: got data of type %T but wanted *v1.Pod!", obj)
+		return
+	}
+	key, err := cache.MetaNamespaceKeyFunc(pod)
+	if err != nil {
+		log.Println("k8s: PodCache: ", err)
+		return
+	}
+	pods.mux.Lock()
+	defer pods.mux.Unlock()
+	for proxy := range pods.subscribers[appKey(pod.Namespace, pod.Labels[labelAppName])] {
+		proxy.podQueue.Add(key)
+	}
+}
+
+//subscribe Dispatches the events of the Pods with the app label app in the namespace of the proxy to the proxy.
+// The Pods that are already known are added to the pod queue of the proxy at once.
+func (pods *PodCache) subscribe(app string, proxy *ProxyForDeployment) {
+	key := appKey(proxy.namespace, app)
+	pods.mux.Lock()
+	if pods.subscribers[key] == nil {
+		pods.subscribers[key] = make(map[*ProxyForDeployment]bool)
+	}
+	pods.subscribers[key][proxy] = true
+	pods.mux.Unlock()
+	pods.enqueue(app, proxy)
+}
+
+//unsubscribe Stops dispatching the events of the Pods with the app label app to the proxy.
+// The Pods that are already known are added to the pod queue of the proxy once more,
+// so that their servers are removed.
+func (pods *PodCache) unsubscribe(app string, proxy *ProxyForDeployment) {
+	key := appKey(proxy.namespace, app)
+	pods.mux.Lock()
+	delete(pods.subscribers[key], proxy)
+	if len(pods.subscribers[key]) == 0 {
+		delete(pods.subscribers, key)
+	}
+	pods.mux.Unlock()
+	pods.enqueue(app, proxy)
+}
+
+//enqueue Adds the keys of the known Pods with the app label app in the namespace of the proxy to its pod queue.
+func (pods *PodCache) enqueue(app string, proxy *ProxyForDeployment) {
+	indexer, ok := pods.indexers[pods.informerNamespace(proxy.namespace)]
+	if !ok {
+		log.Println("k8s: PodCache: the namespace " + proxy.namespace + " is not watched")
+		return
+	}
+	objs, err := indexer.ByIndex(podAppIndex, appKey(proxy.namespace, app))
+	if err != nil {
+		log.Println("k8s: PodCache: ", err)
+		return
+	}
+	for _, obj := range objs {
+		if key, err := cache.MetaNamespaceKeyFunc(obj); err == nil {
+			proxy.podQueue.Add(key)
+		}
+	}
+}
+
+//get Returns the Pod key or nil if it is not in the cache.
+func (pods *PodCache) get(key string) (*v1.Pod, error) {
+	ns, _, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return nil, err
+	}
+	indexer, ok := pods.indexers[pods.informerNamespace(ns)]
+	if !ok {
+		return nil, nil
+	}
+	obj, exists, err := indexer.GetByKey(key)
+	if err != nil || !exists {
+		return nil, err
+	}
+	return obj.(*v1.Pod), nil
+}
+
+//scaledPods Returns the Pods of the app in the namespace ns that were created by the podScaler.
+func (pods *PodCache) scaledPods(ns string, app string) ([]*v1.Pod, error) {
+	lister, ok := pods.listers[pods.informerNamespace(ns)]
+	if !ok {
+		return nil, errors.New("the namespace " + ns + " is not watched")
+	}
+	return lister.Pods(ns).List(labels.SelectorFromSet(labels.Set{labelAppName: app, labelScaled: "true"}))
+}
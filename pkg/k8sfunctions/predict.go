@@ -0,0 +1,253 @@
+package k8sfunctions
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	//the number of hours of a week, the arrival rates are learned for each of them
+	arrivalSlots = 7 * 24
+	//the weight of the last week in the exponentially weighted moving average of the arrivals
+	arrivalAlpha = 0.3
+	//the key of the arrival model in the data of its ConfigMap
+	arrivalKey = "model"
+)
+
+//arrivalModel This struct learns how many tickets of an application are made out in each hour of the week.
+// Rates is the exponentially weighted moving average of the tickets made out in the hour of the week
+// (Sunday 0:00 is the first one), Seen tells if the hour was observed at all. The tickets of the current
+// hour Hour are counted in Count and added to the average when the hour is over.
+type arrivalModel struct {
+	mux   sync.Mutex
+	Rates [arrivalSlots]float64 `json:"rates"`
+	Seen  [arrivalSlots]bool    `json:"seen"`
+	Hour  time.Time             `json:"hour"`
+	Count int                   `json:"count"`
+}
+
+//arrivalSlot Returns the hour of the week of t in local time.
+func arrivalSlot(t time.Time) int {
+	return int(t.Weekday())*24 + t.Hour()
+}
+
+//startOfHour Returns the beginning of the hour of t.
+func startOfHour(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
+}
+
+//observe Adds the number of tickets made out in an hour of the week to its average.
+func (model *arrivalModel) observe(slot int, count int) {
+	if !model.Seen[slot] {
+		model.Rates[slot] = float64(count)
+		model.Seen[slot] = true
+		return
+	}
+	model.Rates[slot] = arrivalAlpha*float64(count) + (1-arrivalAlpha)*model.Rates[slot]
+}
+
+//advance Adds the hours that are over at now to the averages, the hours without a check count as
+// hours without tickets. It returns true if an hour was added. It has to be called with the locked mux.
+func (model *arrivalModel) advance(now time.Time) bool {
+	hour := startOfHour(now)
+	if model.Hour.IsZero() {
+		model.Hour = hour
+	}
+	if !hour.After(model.Hour) {
+		return false
+	}
+	count := model.Count
+	for i, h := 0, model.Hour; i < arrivalSlots && h.Before(hour); i, h = i+1, startOfHour(h.Add(time.Hour)) {
+		model.observe(arrivalSlot(h), count)
+		count = 0
+	}
+	model.Hour = hour
+	model.Count = 0
+	return true
+}
+
+//record Counts a new ticket.
+func (model *arrivalModel) record(now time.Time) {
+	model.mux.Lock()
+	defer model.mux.Unlock()
+	model.advance(now)
+	model.Count++
+}
+
+//update Adds the hours that are over to the averages, see advance. It returns true if an hour was added,
+// the learned tickets of the current hour and the learned tickets of the hour at now+lead.
+func (model *arrivalModel) update(now time.Time, lead time.Duration) (bool, float64, float64) {
+	model.mux.Lock()
+	defer model.mux.Unlock()
+	closed := model.advance(now)
+	return closed, model.Rates[arrivalSlot(now)], model.Rates[arrivalSlot(now.Add(lead))]
+}
+
+//merge Adds the averages of a saved model to the model, hour by hour. The hours that were not observed
+// since the start take the saved average, the hours observed since the start are added to the saved
+// average as the latest week, so that the tickets learned while the prediction was disabled are kept.
+// The count of the saved hour is only kept if it is still the current hour, otherwise the hour is incomplete and dropped.
+func (model *arrivalModel) merge(saved *arrivalModel) {
+	model.mux.Lock()
+	defer model.mux.Unlock()
+	for slot := 0; slot < arrivalSlots; slot++ {
+		switch {
+		case !saved.Seen[slot]:
+		case !model.Seen[slot]:
+			model.Rates[slot] = saved.Rates[slot]
+			model.Seen[slot] = true
+		default:
+			model.Rates[slot] = arrivalAlpha*model.Rates[slot] + (1-arrivalAlpha)*saved.Rates[slot]
+		}
+	}
+	if !model.Hour.IsZero() && saved.Hour.Equal(model.Hour) {
+		model.Count += saved.Count
+	}
+}
+
+//arrivalConfigMap Returns the name of the ConfigMap of the arrival model of the app.
+func arrivalConfigMap(app string) string {
+	return "k8sticket-arrivals-" + strings.ToLower(app)
+}
+
+//loadArrivals Restores the arrival model of the proxy from its ConfigMap, if there is one.
+func (proxy *ProxyForDeployment) loadArrivals() error {
+	name := arrivalConfigMap(proxy.Serverlist.Prefix())
+	configMap, err := proxy.Clientset.CoreV1().ConfigMaps(proxy.namespace).Get(name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	saved := &arrivalModel{}
+	if err := json.Unmarshal([]byte(configMap.Data[arrivalKey]), saved); err != nil {
+		return err
+	}
+	saved.Hour = saved.Hour.Local()
+	proxy.arrivals.merge(saved)
+	return nil
+}
+
+//saveArrivals Writes the arrival model of the proxy to its ConfigMap, which is created if it does not exist.
+// In high-availability mode, only the leader writes the model.
+func (proxy *ProxyForDeployment) saveArrivals() {
+	if !proxy.leadership.IsLeader() {
+		return
+	}
+	proxy.arrivals.mux.Lock()
+	data, err := json.Marshal(proxy.arrivals)
+	proxy.arrivals.mux.Unlock()
+	name := arrivalConfigMap(proxy.Serverlist.Prefix())
+	if err == nil {
+		err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			configMap, err := proxy.Clientset.CoreV1().ConfigMaps(proxy.namespace).Get(name, metav1.GetOptions{})
+			if errors.IsNotFound(err) {
+				_, err = proxy.Clientset.CoreV1().ConfigMaps(proxy.namespace).Create(&v1.ConfigMap{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:   name,
+						Labels: map[string]string{"ipb-halle.de/k8sticket.arrivals": proxy.Serverlist.Prefix()},
+					},
+					Data: map[string]string{arrivalKey: string(data)},
+				})
+				if errors.IsAlreadyExists(err) {
+					//somebody else was faster, try again with an update
+					return errors.NewConflict(v1.Resource("configmaps"), name, err)
+				}
+				return err
+			}
+			if err != nil {
+				return err
+			}
+			if configMap.Data == nil {
+				configMap.Data = make(map[string]string)
+			}
+			configMap.Data[arrivalKey] = string(data)
+			_, err = proxy.Clientset.CoreV1().ConfigMaps(proxy.namespace).Update(configMap)
+			return err
+		})
+	}
+	if err != nil {
+		log.Println("k8s: ", proxy.Serverlist.Prefix(), " arrival model could not be saved: ", err)
+	}
+}
+
+//setPrediction Enables or disables the predictive spare tickets of the proxy with the lead time lead.
+// The learned arrivals are restored from the ConfigMap when the prediction is enabled for the first time.
+func (proxy *ProxyForDeployment) setPrediction(enabled bool, lead time.Duration) {
+	proxy.mux.Lock()
+	load := enabled && !proxy.arrivalsLoaded
+	if load {
+		proxy.arrivalsLoaded = true
+	}
+	if !enabled && proxy.predictive {
+		proxy.metric.ExpectedArrivals.DeleteLabelValues(proxy.namespace, proxy.Serverlist.Prefix())
+		proxy.metric.PredictedSpare.DeleteLabelValues(proxy.namespace, proxy.Serverlist.Prefix())
+	}
+	proxy.predictive = enabled
+	proxy.predictiveLead = lead
+	proxy.mux.Unlock()
+	if load {
+		if err := proxy.loadArrivals(); err != nil {
+			log.Println("k8s: ", proxy.Serverlist.Prefix(), " arrival model could not be restored: ", err)
+		}
+	}
+}
+
+//updatePrediction This method adds the hours that are over to the arrival model and saves it.
+// If the prediction is enabled, the spare tickets of the proxy are raised to the tickets that are
+// expected within the lead time: the learned tickets of the hour at the lead time from now are an hourly
+// rate, so they are scaled to the length of the lead time. The lead time is the time the Pods need to be
+// ready, the tickets made out after it are covered by the Pods the podScaler starts for them.
+// The learned and the predicted tickets are exported by the metrics k8sticket_expected_arrivals and k8sticket_predicted_spare_tickets.
+func (proxy *ProxyForDeployment) updatePrediction() {
+	proxy.mux.Lock()
+	enabled, lead := proxy.predictive, proxy.predictiveLead
+	proxy.mux.Unlock()
+	closed, expected, ahead := proxy.arrivals.update(proxy.Serverlist.Now(), lead)
+	spare := 0
+	if enabled {
+		if closed {
+			proxy.saveArrivals()
+		}
+		spare = int(math.Ceil(ahead * lead.Hours()))
+		proxy.metric.ExpectedArrivals.WithLabelValues(proxy.namespace, proxy.Serverlist.Prefix()).Set(expected)
+		proxy.metric.PredictedSpare.WithLabelValues(proxy.namespace, proxy.Serverlist.Prefix()).Set(float64(spare))
+	}
+	proxy.mux.Lock()
+	changed := spare != proxy.predictedSpare
+	proxy.predictedSpare = spare
+	proxy.mux.Unlock()
+	if changed {
+		log.Println("k8s: ", proxy.Serverlist.Prefix(), " predicted spare tickets: ", spare)
+		proxy.TriggerScaler()
+	}
+}
+
+//learnArrivals This method counts the tickets made out by the proxy and updates the prediction
+// every schedulePeriod until the proxy is stopped.
+func (proxy *ProxyForDeployment) learnArrivals(informer chan string) {
+	ticker := time.NewTicker(schedulePeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case msg := <-informer:
+			if msg == "new ticket" {
+				proxy.arrivals.record(proxy.Serverlist.Now())
+			}
+		case <-ticker.C:
+			proxy.updatePrediction()
+		case <-proxy.metricStopper:
+			return
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package k8sfunctions
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestArrivalModelAdvance(t *testing.T) {
+	//Monday 10:00, the slot 34 of the week
+	start := time.Date(2024, 1, 8, 10, 0, 0, 0, time.Local)
+	slot := arrivalSlot(start)
+	//step This is a call of advance at after start with count tickets of the current hour.
+	type step struct {
+		at     time.Duration
+		count  int
+		closed bool
+	}
+	tests := []struct {
+		name  string
+		steps []step
+		rates map[int]float64
+		seen  int
+	}{
+		{"first hour is not closed", []step{{0, 3, false}, {30 * time.Minute, 5, false}}, map[int]float64{}, 0},
+		{"closed hour is observed", []step{{0, 3, false}, {time.Hour, 0, true}}, map[int]float64{slot: 3}, 1},
+		{"skipped hours have no tickets", []step{{0, 4, false}, {3*time.Hour + time.Minute, 0, true}},
+			map[int]float64{slot: 4, slot + 1: 0, slot + 2: 0}, 3},
+		{"second week is averaged", []step{{0, 10, false}, {time.Hour, 0, true}, {7 * 24 * time.Hour, 20, true}, {7*24*time.Hour + time.Hour, 0, true}},
+			map[int]float64{slot: arrivalAlpha*20 + (1-arrivalAlpha)*10}, arrivalSlots},
+		{"long gaps observe each hour once", []step{{0, 2, false}, {30 * 24 * time.Hour, 0, true}},
+			map[int]float64{slot: 2, slot + 1: 0}, arrivalSlots},
+		{"clock going back is ignored", []step{{time.Hour, 1, false}, {0, 0, false}}, map[int]float64{}, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			model := &arrivalModel{}
+			for i, s := range test.steps {
+				if closed := model.advance(start.Add(s.at)); closed != s.closed {
+					t.Errorf("step %d: closed %v, expected %v", i, closed, s.closed)
+				}
+				model.Count += s.count
+			}
+			for slot, rate := range test.rates {
+				if math.Abs(model.Rates[slot]-rate) > 1e-9 || !model.Seen[slot] {
+					t.Errorf("slot %d: rate %v (seen %v), expected %v", slot, model.Rates[slot], model.Seen[slot], rate)
+				}
+			}
+			seen := 0
+			for _, s := range model.Seen {
+				if s {
+					seen++
+				}
+			}
+			if seen != test.seen {
+				t.Errorf("%d hours seen, expected %d", seen, test.seen)
+			}
+		})
+	}
+}
+
+func TestArrivalModelMerge(t *testing.T) {
+	hour := time.Date(2024, 1, 8, 10, 0, 0, 0, time.Local)
+	saved := &arrivalModel{Hour: hour, Count: 2}
+	saved.Rates[1], saved.Seen[1] = 10, true
+	saved.Rates[2], saved.Seen[2] = 10, true
+	model := &arrivalModel{Hour: hour, Count: 1}
+	model.Rates[2], model.Seen[2] = 20, true
+	model.Rates[3], model.Seen[3] = 5, true
+	model.merge(saved)
+	want := map[int]float64{1: 10, 2: arrivalAlpha*20 + (1-arrivalAlpha)*10, 3: 5}
+	for slot, rate := range want {
+		if math.Abs(model.Rates[slot]-rate) > 1e-9 || !model.Seen[slot] {
+			t.Errorf("slot %d: rate %v (seen %v), expected %v", slot, model.Rates[slot], model.Seen[slot], rate)
+		}
+	}
+	if model.Seen[4] {
+		t.Error("an unobserved hour is seen")
+	}
+	if model.Count != 3 {
+		t.Errorf("count %d, expected 3", model.Count)
+	}
+}
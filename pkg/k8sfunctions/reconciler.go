@@ -0,0 +1,333 @@
+package k8sfunctions
+
+import (
+	"log"
+	"reflect"
+	"strings"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+const (
+	//the number of retries of a key whose reconciliation fails, before it is left to the next event or resync
+	maxReconcileRetries = 10
+	//the prefix of the keys of the TicketApps in the queue of the DeploymentReconciler
+	ticketAppKeyPrefix = "TicketApp:"
+	//the interval for checking if the previous server of a changed Pod is free
+	occupiedRetry = 10 * time.Second
+)
+
+//requeueAfter This error of a reconciliation lets processQueue reconcile the key again after delay.
+// Unlike other errors, it is not counted as failure, so the key is never given up.
+type requeueAfter struct {
+	reason string
+	delay  time.Duration
+}
+
+//Error Returns the reason of the requeue.
+func (err requeueAfter) Error() string {
+	return err.reason
+}
+
+//newQueueHandler Creates an event handler that adds the namespace/name key of every
+// added, updated or deleted object to the queue, prefixed by prefix. The objects themselves are read from
+// the listers when the key is reconciled, so that only the latest state is handled.
+func newQueueHandler(queue workqueue.RateLimitingInterface, prefix string) cache.ResourceEventHandlerFuncs {
+	enqueue := func(obj interface{}) {
+		key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+		if err != nil {
+			log.Println("k8s: enqueue: ", err)
+			return
+		}
+		queue.Add(prefix + key)
+	}
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: enqueue,
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			enqueue(newObj)
+		},
+		DeleteFunc: enqueue,
+	}
+}
+
+//processQueue Reconciles the keys of the queue one after another until the queue is shut down.
+// A key is never reconciled by two workers at the same time and a key that is added several
+// times while it waits is reconciled once. A failed key is retried with the rate limit of the queue,
+// a key that returns requeueAfter is reconciled again after its delay.
+func processQueue(name string, queue workqueue.RateLimitingInterface, reconcile func(key string) error) {
+	for {
+		item, shutdown := queue.Get()
+		if shutdown {
+			return
+		}
+		key := item.(string)
+		err := reconcile(key)
+		requeue, wait := err.(requeueAfter)
+		switch {
+		case err == nil:
+			queue.Forget(item)
+		case wait:
+			queue.Forget(item)
+			queue.AddAfter(item, requeue.delay)
+		case queue.NumRequeues(item) < maxReconcileRetries:
+			log.Println("k8s: "+name+": "+key+": ", err, " retrying")
+			queue.AddRateLimited(item)
+		default:
+			log.Println("k8s: "+name+": "+key+": ", err, " giving up")
+			queue.Forget(item)
+		}
+		queue.Done(item)
+	}
+}
+
+//DeploymentReconciler This is the controller for the Deployments and TicketApps served by k8sTicket.
+// The events of the DeploymentController only add the key of a Deployment to a rate limited
+// workqueue. The worker reads the Deployment from the lister and brings the ProxyMap in line
+// with it: a proxy is started for a new Deployment, reconfigured when the annotations or the
+// pod template changed and drained when the Deployment was deleted or disabled.
+// The TicketApps are queued with the prefix ticketAppKeyPrefix and reconciled by the same worker,
+// so that the ProxyMap is only changed by one goroutine, see reconcileTicketApp.
+// There is one DeploymentController for each namespace of an explicit list of namespaces
+// or one for all namespaces. The proxies are keyed by namespace/name in the ProxyMap.
+type DeploymentReconciler struct {
+	clientset  kubernetes.Interface
+	proxies    *ProxyMap
+	metric     *PMetric
+	listers    map[string]appslisters.DeploymentLister
+	client     dynamic.Interface
+	ticketApps map[string]cache.GenericLister
+	templates  map[string]appslisters.DeploymentLister
+	factories  []informers.SharedInformerFactory
+	apps       map[string]ticketAppConfig
+	reported   map[string]int64
+	synced     []cache.InformerSynced
+	queue      workqueue.RateLimitingInterface
+}
+
+//NewDeploymentReconciler Creates the DeploymentReconciler for the DeploymentControllers of the
+// namespaces (an empty string stands for all namespaces), see NamespaceScope.InformerNamespaces.
+// The annotations are parsed by ParseAppConfig, errors are reported by the ConfigReporter of the ProxyMap.
+func NewDeploymentReconciler(clientset kubernetes.Interface, controllers map[string]Controller, proxies *ProxyMap, metric *PMetric) *DeploymentReconciler {
+	reconciler := &DeploymentReconciler{
+		clientset:  clientset,
+		proxies:    proxies,
+		metric:     metric,
+		listers:    make(map[string]appslisters.DeploymentLister),
+		ticketApps: make(map[string]cache.GenericLister),
+		templates:  make(map[string]appslisters.DeploymentLister),
+		apps:       make(map[string]ticketAppConfig),
+		reported:   make(map[string]int64),
+		queue:      workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "deployments"),
+	}
+	for ns, controller := range controllers {
+		deployments := controller.Factory.(informers.SharedInformerFactory).Apps().V1().Deployments()
+		reconciler.listers[ns] = deployments.Lister()
+		reconciler.synced = append(reconciler.synced, controller.Informer.HasSynced)
+		controller.Informer.AddEventHandler(newQueueHandler(reconciler.queue, ""))
+	}
+	return reconciler
+}
+
+//Run Reconciles the Deployments and TicketApps until stopper is closed.
+// The informers of the DeploymentControllers and TicketAppControllers have to be running,
+// the informers of the Deployments referenced by the TicketApps are run until stopper is closed.
+func (reconciler *DeploymentReconciler) Run(stopper <-chan struct{}) {
+	defer reconciler.queue.ShutDown()
+	for _, factory := range reconciler.factories {
+		factory.Start(stopper)
+	}
+	if !cache.WaitForCacheSync(stopper, reconciler.synced...) {
+		log.Println("k8s: DeploymentReconciler: cache could not be synchronized")
+		return
+	}
+	go processQueue("DeploymentReconciler", reconciler.queue, reconciler.reconcile)
+	<-stopper
+}
+
+//lister Returns the lister of the Deployments in the namespace ns.
+func (reconciler *DeploymentReconciler) lister(ns string) appslisters.DeploymentNamespaceLister {
+	return namespaceLister(reconciler.listers, ns)
+}
+
+//namespaceLister Returns the lister of the Deployments in the namespace ns
+// from the listers keyed by namespace, see NamespaceScope.InformerNamespaces.
+func namespaceLister(listers map[string]appslisters.DeploymentLister, ns string) appslisters.DeploymentNamespaceLister {
+	lister, ok := listers[ns]
+	if !ok {
+		lister = listers[metav1.NamespaceAll]
+	}
+	return lister.Deployments(ns)
+}
+
+//reconcile Brings the proxy of the Deployment key in line with the Deployment in the lister.
+// A Deployment in a namespace that is not watched (anymore) is handled as if it was deleted.
+// The keys of TicketApps are passed to reconcileTicketApp.
+func (reconciler *DeploymentReconciler) reconcile(key string) error {
+	if strings.HasPrefix(key, ticketAppKeyPrefix) {
+		return reconciler.reconcileTicketApp(strings.TrimPrefix(key, ticketAppKeyPrefix))
+	}
+	ns, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+	deployment, err := reconciler.lister(ns).Get(name)
+	if apierrors.IsNotFound(err) || !reconciler.proxies.watches(ns) {
+		deployment = nil
+	} else if err != nil {
+		return err
+	}
+	proxies := reconciler.proxies
+	proxies.Mux.Lock()
+	defer proxies.Mux.Unlock()
+	proxy, ok := proxies.Deployments[key]
+	if deployment == nil {
+		if ok {
+			log.Println("k8s: Deleting deployment " + key)
+			proxies.drain("Deployment "+key, proxy, "", proxies.DrainTimeout)
+			delete(proxies.Deployments, key)
+		}
+		return nil
+	}
+	conf, errs := ParseAppConfig(name, deployment.GetAnnotations())
+	proxies.Reporter.ReportDeployment(deployment.ObjectMeta, errs)
+	if !ok {
+		log.Println("k8s: Adding deployment " + key)
+		proxies.stopDraining("Deployment " + key)
+		proxies.startProxy(reconciler.clientset, deployment.ObjectMeta, conf, deployment.Spec.Template, reconciler.metric)
+		return nil
+	}
+	reconciler.update(proxy, deployment, conf)
+	return nil
+}
+
+//update Applies the changed configuration and pod template of a Deployment to its running proxy.
+// The proxy is never rebuilt, so that no ticket is lost, see Reconfigure.
+// It has to be called with the locked mux of the ProxyMap.
+func (reconciler *DeploymentReconciler) update(proxy *ProxyForDeployment, deployment *appsv1.Deployment, conf AppConfig) {
+	name := deployment.Namespace + "/" + deployment.Name
+	proxy.mux.Lock()
+	if !reflect.DeepEqual(proxy.podSpec, deployment.Spec.Template) {
+		log.Println("k8s: DeploymentReconciler: pod template of Deployment " + name + " is updated!")
+		proxy.podSpec = deployment.Spec.Template
+	}
+	old := proxy.config
+	proxy.config = conf
+	proxy.mux.Unlock()
+	if old == conf {
+		return
+	}
+	proxies := reconciler.proxies
+	if user := proxies.portUser(conf.Port); conf.Port != old.Port && proxies.SharedRouter == nil && user != "" {
+		log.Println("k8s: Deployment: " + name + ": port " + conf.Port + " is already used by " + user)
+	}
+	proxy.Reconfigure(name, old, conf)
+	proxy.applyConfig(name, old, conf)
+}
+
+//reconcilePods Reconciles the Pods of the proxy until its pod queue is shut down.
+// The keys of the Pods are added to the queue by the PodCache, see subscribePods.
+func (proxy *ProxyForDeployment) reconcilePods() {
+	if !cache.WaitForCacheSync(proxy.podScalerStopper, proxy.pods.HasSynced) {
+		log.Println("k8s: ProxyForDeployment: ", proxy.Serverlist.Prefix(), " pod cache could not be synchronized")
+	}
+	processQueue("PodReconciler "+proxy.Serverlist.Prefix(), proxy.podQueue, proxy.reconcilePod)
+}
+
+//pod Returns the Pod key from the PodCache, or nil if it does not exist (anymore),
+// is in another namespace or does not carry the current or a previous app label of the proxy.
+func (proxy *ProxyForDeployment) pod(key string) (*v1.Pod, error) {
+	pod, err := proxy.pods.get(key)
+	if pod == nil || err != nil {
+		return nil, err
+	}
+	proxy.mux.Lock()
+	defer proxy.mux.Unlock()
+	if pod.Namespace != proxy.namespace || !proxy.subscribed[pod.Labels[labelAppName]] {
+		return nil, nil
+	}
+	return pod, nil
+}
+
+//podReady Returns true if the Pod exists, is running and ready and is not being deleted.
+func podReady(pod *v1.Pod) bool {
+	if pod == nil || pod.DeletionTimestamp != nil || pod.Status.Phase != v1.PodRunning {
+		return false
+	}
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == v1.PodReady && condition.Status != v1.ConditionTrue {
+			return false
+		}
+	}
+	return true
+}
+
+//reconcilePod Brings the server of the Pod key in the Serverlist in line with the Pod in the lister.
+// A ready Pod is added as server, a server whose Pod is not ready or gone is marked for deletion.
+// The server of a Pod that is ready again with the same address is used again at once.
+// A server whose Pod changed its address is replaced as soon as its tickets have ended,
+// until then the Pod is checked every occupiedRetry.
+func (proxy *ProxyForDeployment) reconcilePod(key string) error {
+	_, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+	pod, err := proxy.pod(key)
+	if err != nil {
+		return err
+	}
+	list := proxy.Serverlist
+	current, known := list.ServerConfig(name)
+	if !podReady(pod) {
+		if known {
+			log.Println("k8s: Delete Pod " + name)
+			if err := list.SetServerDeletion(name); err != nil {
+				log.Println("k8s: SetServerDeletion:  ", err)
+			}
+		}
+		proxy.UpdatePodMetric()
+		return nil
+	}
+	conf, err := PodToConfig(pod)
+	if err != nil {
+		//the Pod is added when it has an address
+		log.Println("k8s: Pod "+name+": ", err)
+		return nil
+	}
+	if known {
+		if current == conf {
+			//the Pod may be ready again after its server was marked for deletion
+			if list.ResumeServer(name) {
+				log.Println("k8s: Pod " + name + " is ready again")
+			}
+			//the app label may have changed, see relabelPods
+			proxy.UpdatePodMetric()
+			return nil
+		}
+		log.Println("k8s: Pod " + name + " has changed, replacing its server")
+		if err := list.SetServerDeletion(name); err != nil {
+			log.Println("k8s: SetServerDeletion:  ", err)
+		}
+		if _, occupied := list.ServerConfig(name); occupied {
+			return requeueAfter{reason: "the previous server of the Pod is still occupied", delay: occupiedRetry}
+		}
+	}
+	log.Println("k8s: New Pod " + name)
+	proxy.mux.Lock()
+	maxTickets := proxy.maxTickets
+	proxy.mux.Unlock()
+	if err := list.AddServer(name, maxTickets, conf); err != nil {
+		return err
+	}
+	proxy.UpdatePodMetric()
+	return nil
+}
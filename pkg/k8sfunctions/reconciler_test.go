@@ -0,0 +1,62 @@
+package k8sfunctions
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ipb-halle/k8sTicket/pkg/proxyfunctions"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestReconcilePodReadyAgain(t *testing.T) {
+	//a session on the Pod is restored as soon as its server is added
+	store := proxyfunctions.NewMemoryTicketStore()
+	if err := store.Save(proxyfunctions.TicketRecord{Token: "t1", Server: "pod-1", Session: "s1", Created: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	clientset := newTestClientset()
+	metric := NewPMetric()
+	proxy := NewProxyForDeployment(clientset, "app", "ns", "0", 2, 0, 3, 0, v1.PodTemplateSpec{}, &metric,
+		false, false, "", store, nil, nil, nil, NewPodCache(clientset, []string{"ns"}))
+	defer close(proxy.Serverlist.Stop)
+	proxy.subscribed["app"] = true
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "pod-1", Namespace: "ns", Labels: map[string]string{labelAppName: "app"}},
+		Status: v1.PodStatus{Phase: v1.PodRunning, PodIP: "10.0.0.1",
+			Conditions: []v1.PodCondition{{Type: v1.PodReady, Status: v1.ConditionTrue}}},
+	}
+	//setReady Updates the readiness of the Pod in the cache and reconciles it.
+	setReady := func(ready v1.ConditionStatus) {
+		pod = pod.DeepCopy()
+		pod.Status.Conditions[0].Status = ready
+		if err := proxy.pods.indexers["ns"].Update(pod); err != nil {
+			t.Fatal(err)
+		}
+		if err := proxy.reconcilePod("ns/pod-1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setReady(v1.ConditionTrue)
+	if tickets := proxy.Serverlist.GetTickets(); tickets != 1 {
+		t.Fatalf("%d tickets on the Pod, expected the restored one", tickets)
+	}
+	steps := []struct {
+		ready     v1.ConditionStatus
+		available int
+	}{
+		{v1.ConditionFalse, 0},
+		{v1.ConditionTrue, 1},
+		//a repeated reconcile of the ready Pod changes nothing
+		{v1.ConditionTrue, 1},
+	}
+	for i, step := range steps {
+		setReady(step.ready)
+		if _, known := proxy.Serverlist.ServerConfig("pod-1"); !known {
+			t.Fatalf("step %d: the occupied server was removed", i)
+		}
+		if available := proxy.Serverlist.GetAvailableTickets(); available != step.available {
+			t.Errorf("step %d: ready %s, %d available tickets, expected %d", i, step.ready, available, step.available)
+		}
+	}
+}
@@ -0,0 +1,365 @@
+package k8sfunctions
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	gorilla "github.com/gorilla/mux"
+	"github.com/ipb-halle/k8sTicket/pkg/proxyfunctions"
+	"github.com/prometheus/client_golang/prometheus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+const (
+	//the interval for checking if the sessions of a previous route or port have ended
+	retirePeriod = 5 * time.Second
+	//the interval for trying again to serve an app name that is used by another application
+	conflictRetry = 30 * time.Second
+)
+
+//proxyHandler This is the http.Handler of a ProxyForDeployment that is served by its
+// listeners or the SharedRouter. The router is replaced when the routes of the proxy change.
+type proxyHandler struct {
+	router http.Handler
+	mux    sync.RWMutex
+}
+
+//ServeHTTP Passes the request to the current router.
+func (handler *proxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	handler.mux.RLock()
+	router := handler.router
+	handler.mux.RUnlock()
+	router.ServeHTTP(w, r)
+}
+
+//setRouter Replaces the router of the handler.
+func (handler *proxyHandler) setRouter(router http.Handler) {
+	handler.mux.Lock()
+	handler.router = router
+	handler.mux.Unlock()
+}
+
+//retiredRoute This is a previous route of a ProxyForDeployment. The sessions made out for
+// this route are served until they end. If the app name was changed, the Pods with the
+// previous app label are kept in the Serverlist in the meantime, see subscribePods.
+type retiredRoute struct {
+	route    proxyfunctions.Route
+	sessions map[string]bool
+}
+
+//retiredServer This is the listener of a previous port of a ProxyForDeployment.
+// It is shut down when the sessions made out before the port was changed have ended.
+type retiredServer struct {
+	server   *http.Server
+	sessions map[string]bool
+}
+
+//listen Starts a listener for the proxy in the background.
+func (proxy *ProxyForDeployment) listen(server *http.Server) {
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Println("Proxy:", proxy.Serverlist.Prefix(), "ListenAndServe()", err)
+		}
+	}()
+}
+
+//newRouter Creates the router for the current route of the proxy and the previous routes
+// that still have sessions. The previous routes only match the requests of their sessions,
+// their home pages redirect to the home page of the current route.
+// It has to be called with the locked mux of the proxy.
+func (proxy *ProxyForDeployment) newRouter() *gorilla.Router {
+	router := gorilla.NewRouter()
+	list := proxy.Serverlist
+	current := list.Route()
+	for _, retired := range proxy.retiredRoutes {
+		route := retired.route
+		sessions := retired.sessions
+		matcher := func(r *http.Request, rm *gorilla.RouteMatch) bool {
+			return sessions[route.Session(r)]
+		}
+		if route.DNS {
+			router.HandleFunc("/"+route.Prefix, list.SessionHandler(route)).Host("{s}.{u}.{domain:.*}").MatcherFunc(matcher)
+			router.HandleFunc("/"+route.Prefix+"/{serverpath:.*}", list.SessionHandler(route)).Host("{s}.{u}.{domain:.*}").MatcherFunc(matcher)
+		} else {
+			router.HandleFunc("/"+route.Prefix+"/{s}/{u}/{serverpath:.*}", list.SessionHandler(route)).MatcherFunc(matcher)
+		}
+		if route.Prefix != current.Prefix {
+			//clients that are still waiting on the previous home page get their ticket for the current route
+			router.HandleFunc("/"+route.Prefix+"/ws", list.ServeWs)
+			router.HandleFunc("/"+route.Prefix+"/claim/{c}", list.ServeClaim)
+			router.Handle("/"+route.Prefix, http.RedirectHandler("/"+current.Prefix+"/", http.StatusFound))
+			router.Handle("/"+route.Prefix+"/", http.RedirectHandler("/"+current.Prefix+"/", http.StatusFound))
+		}
+	}
+	router.HandleFunc("/"+current.Prefix+"/ws", list.ServeWs)
+	router.HandleFunc("/"+current.Prefix+"/claim/{c}", list.ServeClaim)
+	if current.DNS {
+		router.HandleFunc("/"+current.Prefix, list.MainHandler).Host("{s}.{u}.{domain:.*}")
+		router.HandleFunc("/"+current.Prefix+"/{serverpath:.*}", list.MainHandler).Host("{s}.{u}.{domain:.*}")
+	} else {
+		router.HandleFunc("/"+current.Prefix+"/{s}/{u}/{serverpath:.*}", list.MainHandler)
+	}
+	router.HandleFunc("/"+current.Prefix, list.ServeHome)
+	router.HandleFunc("/"+current.Prefix+"/", list.ServeHome)
+	return router
+}
+
+//usedPrefixes Returns the current and the previous app names of the proxy.
+// It has to be called with the locked mux of the proxy.
+func (proxy *ProxyForDeployment) usedPrefixes() map[string]bool {
+	used := map[string]bool{proxy.Serverlist.Route().Prefix: true}
+	for _, retired := range proxy.retiredRoutes {
+		used[retired.route.Prefix] = true
+	}
+	return used
+}
+
+//subscribePods Subscribes the proxy to the Pods of the current and the previous app names
+// at the PodCache and unsubscribes the app names that are not used anymore.
+// It has to be called with the locked mux of the proxy.
+func (proxy *ProxyForDeployment) subscribePods() {
+	wanted := proxy.usedPrefixes()
+	for app := range proxy.subscribed {
+		if !wanted[app] {
+			proxy.pods.unsubscribe(app, proxy)
+			delete(proxy.subscribed, app)
+		}
+	}
+	for app := range wanted {
+		if !proxy.subscribed[app] {
+			proxy.pods.subscribe(app, proxy)
+			proxy.subscribed[app] = true
+		}
+	}
+}
+
+//servePrefixes Registers the handler of the proxy at the SharedRouter for the current
+// and the previous app names and removes the app names that are not used anymore.
+// An app name that is served by another application is reported as Warning Event of the
+// Deployment or TicketApp and tried again every conflictRetry, until the other application is gone.
+// It has to be called with the locked mux of the proxy.
+func (proxy *ProxyForDeployment) servePrefixes() {
+	if proxy.sharedRouter == nil {
+		return
+	}
+	wanted := proxy.usedPrefixes()
+	for prefix := range proxy.prefixes {
+		if !wanted[prefix] {
+			proxy.sharedRouter.Remove(prefix, proxy.handler)
+			delete(proxy.prefixes, prefix)
+		}
+	}
+	for prefix := range proxy.conflicts {
+		if !wanted[prefix] {
+			delete(proxy.conflicts, prefix)
+		}
+	}
+	for prefix := range wanted {
+		if proxy.prefixes[prefix] {
+			continue
+		}
+		if err := proxy.sharedRouter.Add(prefix, proxy.handler); err != nil {
+			if !proxy.conflicts[prefix] {
+				proxy.conflicts[prefix] = true
+				proxy.reporter.Warn(proxy.ref, "AppNameConflict",
+					err.Error()+", the application is not reachable until the other application is removed")
+			}
+			continue
+		}
+		if proxy.conflicts[prefix] {
+			log.Println("Proxy:", proxy.Serverlist.Prefix(), "app "+prefix+" is served now")
+			delete(proxy.conflicts, prefix)
+		}
+		proxy.prefixes[prefix] = true
+	}
+	if len(proxy.conflicts) > 0 {
+		proxy.retryLater("servePrefixes", conflictRetry, proxy.retryPrefixes)
+	}
+}
+
+//retryPrefixes Tries again to serve the app names of the proxy that are used by other applications.
+func (proxy *ProxyForDeployment) retryPrefixes() {
+	proxy.mux.Lock()
+	defer proxy.mux.Unlock()
+	select {
+	case <-proxy.Stopper:
+		//the proxy was stopped in the meantime
+		return
+	default:
+	}
+	proxy.servePrefixes()
+}
+
+//Reconfigure This method applies a new app name, port, DNS mode, rewriting and cookie mode
+// while the proxy is running. The Serverlist with all its tickets and waiting clients is kept.
+// The new route and listener come up at once. The sessions made out before keep being
+// served on the previous route and listener until they end, new sessions get the new route.
+func (proxy *ProxyForDeployment) Reconfigure(name string, old AppConfig, conf AppConfig) {
+	proxy.mux.Lock()
+	defer proxy.mux.Unlock()
+	list := proxy.Serverlist
+	if conf.Rewrite != old.Rewrite {
+		log.Println("k8s: ", name, " ingress.rewrite: ", conf.Rewrite)
+		list.SetRewrite(conf.Rewrite)
+	}
+	if conf.Cookies != old.Cookies {
+		log.Println("k8s: ", name, " ingress.cookies: "+conf.Cookies)
+		list.SetCookieMode(conf.Cookies)
+	}
+	previous := list.Route()
+	route := proxyfunctions.Route{Prefix: conf.AppName, DNS: conf.DNS}
+	if route != previous {
+		log.Println("k8s: ", name, " app: "+conf.AppName+" ingress.dns: ", conf.DNS)
+		retired := retiredRoute{route: previous, sessions: list.SetRoute(route)}
+		//a route with the same address as the new one is replaced by it
+		routes := []retiredRoute{}
+		for _, r := range proxy.retiredRoutes {
+			if r.route != route {
+				routes = append(routes, r)
+			}
+		}
+		proxy.retiredRoutes = append(routes, retired)
+		proxy.handler.setRouter(proxy.newRouter())
+		proxy.servePrefixes()
+		proxy.subscribePods()
+		if route.Prefix != previous.Prefix {
+			proxy.moveMetrics(previous.Prefix)
+			go proxy.relabelPods(previous.Prefix)
+		}
+	}
+	if conf.Port != proxy.port && proxy.sharedRouter == nil {
+		log.Println("k8s: ", name, " port: "+conf.Port)
+		proxy.retiredServers = append(proxy.retiredServers, retiredServer{server: proxy.server, sessions: list.Sessions()})
+		proxy.server = &http.Server{Addr: ":" + conf.Port, Handler: proxy.handler}
+		proxy.listen(proxy.server)
+	}
+	proxy.port = conf.Port
+	if !proxy.retiring && (len(proxy.retiredRoutes) > 0 || len(proxy.retiredServers) > 0) {
+		proxy.retiring = true
+		go proxy.retireWatchdog()
+	}
+}
+
+//moveMetrics This method moves the metrics of the proxy from the previous app name to the current one.
+// The series of the previous app name are deleted and the gauges are set for the current one.
+// It has to be called with the locked mux of the proxy.
+func (proxy *ProxyForDeployment) moveMetrics(previous string) {
+	app := proxy.Serverlist.Prefix()
+	metric := proxy.metric
+	for _, gauge := range []*prometheus.GaugeVec{metric.CurrentUsers, metric.CurrentFreeTickets, metric.CurrentScaledPods,
+		metric.Degraded, metric.ExpectedArrivals, metric.PredictedSpare} {
+		gauge.DeleteLabelValues(proxy.namespace, previous)
+	}
+	metric.TotalUsers.DeleteLabelValues(proxy.namespace, previous)
+	for _, schedule := range proxy.schedules {
+		metric.PrewarmActive.DeleteLabelValues(proxy.namespace, previous, schedule.name)
+	}
+	for name := range proxy.activeSchedules {
+		metric.PrewarmActive.DeleteLabelValues(proxy.namespace, previous, name)
+		metric.PrewarmActive.WithLabelValues(proxy.namespace, app, name).Set(1)
+	}
+	degraded := 0.0
+	if proxy.Degraded() != nil {
+		degraded = 1
+	}
+	metric.Degraded.WithLabelValues(proxy.namespace, app).Set(degraded)
+	metric.CurrentUsers.WithLabelValues(proxy.namespace, app).Set(float64(proxy.Serverlist.GetTickets()))
+	metric.CurrentFreeTickets.WithLabelValues(proxy.namespace, app).Set(float64(proxy.Serverlist.GetAvailableTickets()))
+	if proxy.predictive {
+		metric.PredictedSpare.WithLabelValues(proxy.namespace, app).Set(float64(proxy.predictedSpare))
+	}
+	proxy.UpdatePodMetric()
+}
+
+//relabelPods This method gives the Pods created by the podScaler for the previous app name the
+// current app label, so that they are counted and scaled down like the Pods of the current app name.
+// Their servers and sessions are kept, because the proxy is subscribed to both app names until the
+// sessions of the previous route have ended. Only the leader changes the Pods, failed updates are
+// retried with backoff.
+func (proxy *ProxyForDeployment) relabelPods(previous string) {
+	select {
+	case <-proxy.podScalerStopper:
+		return
+	default:
+	}
+	if !proxy.leadership.IsLeader() {
+		return
+	}
+	pods, err := proxy.pods.scaledPods(proxy.namespace, previous)
+	if err == nil {
+		app := proxy.Serverlist.Prefix()
+		for _, cached := range pods {
+			pod := cached.DeepCopy()
+			pod.Labels[labelAppName] = app
+			_, err = proxy.Clientset.CoreV1().Pods(proxy.namespace).Update(pod)
+			if err != nil && !apierrors.IsNotFound(err) {
+				break
+			}
+			err = nil
+			log.Println("k8s: ", app, " Pod "+pod.Name+" moved from the previous app name "+previous)
+		}
+	}
+	if err != nil {
+		proxy.retryLater("relabelPods "+previous, proxy.apiFailed("relabelPods", err), func() { proxy.relabelPods(previous) })
+		return
+	}
+	proxy.apiSucceeded()
+}
+
+//retireWatchdog This method removes the previous routes and listeners of the proxy
+// as soon as their sessions have ended. It returns when nothing is left to retire.
+func (proxy *ProxyForDeployment) retireWatchdog() {
+	ticker := time.NewTicker(retirePeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			proxy.mux.Lock()
+			routes := []retiredRoute{}
+			for _, retired := range proxy.retiredRoutes {
+				if proxy.Serverlist.LiveSessions(retired.sessions) > 0 {
+					routes = append(routes, retired)
+					continue
+				}
+				log.Println("k8s: ", proxy.Serverlist.Prefix(), " previous app name "+retired.route.Prefix+" has no sessions left")
+			}
+			if len(routes) != len(proxy.retiredRoutes) {
+				proxy.retiredRoutes = routes
+				proxy.handler.setRouter(proxy.newRouter())
+				proxy.servePrefixes()
+				proxy.subscribePods()
+			}
+			servers := []retiredServer{}
+			for _, retired := range proxy.retiredServers {
+				if proxy.Serverlist.LiveSessions(retired.sessions) > 0 {
+					servers = append(servers, retired)
+					continue
+				}
+				log.Println("HTTP:", proxy.Serverlist.Prefix(), "closing previous listener", retired.server.Addr)
+				go shutdown(proxy.Serverlist.Prefix(), retired.server)
+			}
+			proxy.retiredServers = servers
+			if len(proxy.retiredRoutes) == 0 && len(proxy.retiredServers) == 0 {
+				proxy.retiring = false
+				proxy.mux.Unlock()
+				return
+			}
+			proxy.mux.Unlock()
+		case <-proxy.metricStopper:
+			return
+		}
+	}
+}
+
+//shutdown Shuts a listener of a proxy down.
+func shutdown(prefix string, server *http.Server) {
+	if err := server.Shutdown(context.Background()); err != nil {
+		// Error from closing listeners, or context timeout:
+		log.Println("HTTP:", prefix, "server Shutdown: ", err)
+	} else {
+		log.Println("HTTP:", prefix, "server closed ")
+	}
+}
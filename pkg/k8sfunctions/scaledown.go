@@ -0,0 +1,119 @@
+package k8sfunctions
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"k8s.io/api/core/v1"
+)
+
+//The orders in which the idle autoscaled Pods are removed
+const (
+	//the Pod that was used least recently first
+	ScaleDownLRU = "lru"
+	//the Pod that was created last first
+	ScaleDownNewest = "newest"
+	//the Pods on the nodes with the fewest Pods of the application first, so that nodes are emptied
+	ScaleDownNode = "node"
+)
+
+//checkScaleDownOrder Returns an error if order is not a known scale-down order.
+func checkScaleDownOrder(field string, order string) error {
+	switch order {
+	case ScaleDownLRU, ScaleDownNewest, ScaleDownNode:
+		return nil
+	}
+	return fmt.Errorf("%s: %q is neither %q, %q nor %q", field, order, ScaleDownLRU, ScaleDownNewest, ScaleDownNode)
+}
+
+//scaleDownPolicy This struct defines which idle autoscaled Pods the podWatchdog removes and when.
+// A Pod is kept for at least minLifetime after it was created. Every interval, at most maxRemovals
+// Pods (0 means no limit) are removed in the given order.
+type scaleDownPolicy struct {
+	minLifetime time.Duration
+	maxRemovals int
+	order       string
+	interval    time.Duration
+}
+
+//newScaleDownPolicy Returns the scale-down policy of the configuration of an application.
+func newScaleDownPolicy(conf AppConfig) scaleDownPolicy {
+	return scaleDownPolicy{
+		minLifetime: time.Duration(conf.MinLifetime) * time.Second,
+		maxRemovals: conf.ScaleDownMax,
+		order:       conf.ScaleDownOrder,
+		interval:    time.Duration(conf.ScaleDownInterval) * time.Second,
+	}
+}
+
+//scaleDownCandidate This is an autoscaled Pod that may be removed by the podWatchdog.
+// A Pod that is not registered in the Serverlist serves no tickets and is removed first.
+type scaleDownCandidate struct {
+	name       string
+	node       string
+	created    time.Time
+	lastUsed   time.Time
+	maxTickets int
+	registered bool
+}
+
+//sortCandidates Sorts the candidates in the order of the policy. The Pods that are not
+// registered in the Serverlist come first, ties are broken by the least recent use.
+func (policy scaleDownPolicy) sortCandidates(candidates []scaleDownCandidate) {
+	perNode := make(map[string]int)
+	for _, candidate := range candidates {
+		perNode[candidate.node]++
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.registered != b.registered {
+			return !a.registered
+		}
+		switch policy.order {
+		case ScaleDownNewest:
+			if !a.created.Equal(b.created) {
+				return a.created.After(b.created)
+			}
+		case ScaleDownNode:
+			if perNode[a.node] != perNode[b.node] {
+				return perNode[a.node] < perNode[b.node]
+			}
+			if a.node != b.node {
+				//the Pods of one node are removed together
+				return a.node < b.node
+			}
+		}
+		return a.lastUsed.Before(b.lastUsed)
+	})
+}
+
+//scaleDownCandidates Returns the autoscaled Pods that are idle for longer than the cooldown and older
+// than the minimal lifetime, in the order of the scale-down policy. A Pod that is not registered in the
+// Serverlist is only a candidate after podPendingTimeout, before it is still starting.
+// It has to be called with the locked mux of the proxy.
+func (proxy *ProxyForDeployment) scaleDownCandidates(pods []*v1.Pod) []scaleDownCandidate {
+	candidates := []scaleDownCandidate{}
+	cooldown := time.Duration(proxy.cooldown) * time.Second
+	now := proxy.Serverlist.Now()
+	for _, pod := range pods {
+		if pod.DeletionTimestamp != nil || now.Sub(pod.CreationTimestamp.Time) < proxy.scaleDown.minLifetime {
+			continue
+		}
+		candidate := scaleDownCandidate{name: pod.Name, node: pod.Spec.NodeName, created: pod.CreationTimestamp.Time,
+			maxTickets: proxy.maxTickets}
+		if server, ok := proxy.Serverlist.Servers[pod.Name]; ok {
+			if !server.HasNoTickets() || now.Sub(server.GetLastUsed()) <= cooldown {
+				continue
+			}
+			candidate.registered = true
+			candidate.lastUsed = server.GetLastUsed()
+			candidate.maxTickets = server.GetMaxTickets()
+		} else if now.Sub(pod.CreationTimestamp.Time) <= podPendingTimeout {
+			continue
+		}
+		candidates = append(candidates, candidate)
+	}
+	proxy.scaleDown.sortCandidates(candidates)
+	return candidates
+}
@@ -0,0 +1,100 @@
+package k8sfunctions
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ipb-halle/k8sTicket/pkg/proxyfunctions"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+//testPod This is an autoscaled Pod of TestScaleDownCandidates. A registered Pod has a server
+// that was last used lastUsed ago, a busy one has a ticket.
+type testPod struct {
+	name       string
+	node       string
+	age        time.Duration
+	deleted    bool
+	registered bool
+	lastUsed   time.Duration
+	busy       bool
+}
+
+func TestScaleDownCandidates(t *testing.T) {
+	now := time.Date(2024, 1, 8, 12, 0, 0, 0, time.Local)
+	lru := scaleDownPolicy{order: ScaleDownLRU}
+	tests := []struct {
+		name   string
+		policy scaleDownPolicy
+		pods   []testPod
+		want   []string
+	}{
+		{"least recently used first", lru, []testPod{
+			{name: "a", age: time.Hour, registered: true, lastUsed: 10 * time.Minute},
+			{name: "b", age: time.Hour, registered: true, lastUsed: 20 * time.Minute},
+		}, []string{"b", "a"}},
+		{"busy and recently used Pods are kept", lru, []testPod{
+			{name: "a", age: time.Hour, registered: true, lastUsed: 10 * time.Minute, busy: true},
+			{name: "b", age: time.Hour, registered: true, lastUsed: 30 * time.Second},
+		}, []string{}},
+		{"deleted Pods are skipped", lru, []testPod{
+			{name: "a", age: time.Hour, registered: true, lastUsed: 10 * time.Minute, deleted: true},
+		}, []string{}},
+		{"Pods younger than the minimal lifetime are kept", scaleDownPolicy{order: ScaleDownLRU, minLifetime: time.Hour}, []testPod{
+			{name: "a", age: 10 * time.Minute, registered: true, lastUsed: 5 * time.Minute},
+			{name: "b", age: 2 * time.Hour, registered: true, lastUsed: 5 * time.Minute},
+		}, []string{"b"}},
+		{"unregistered Pods first after the pending timeout", lru, []testPod{
+			{name: "a", age: time.Hour, registered: true, lastUsed: time.Hour},
+			{name: "starting", age: 30 * time.Second},
+			{name: "stuck", age: 5 * time.Minute},
+		}, []string{"stuck", "a"}},
+		{"newest first", scaleDownPolicy{order: ScaleDownNewest}, []testPod{
+			{name: "old", age: 2 * time.Hour, registered: true, lastUsed: 10 * time.Minute},
+			{name: "new", age: time.Hour, registered: true, lastUsed: 20 * time.Minute},
+		}, []string{"new", "old"}},
+		{"emptiest node first", scaleDownPolicy{order: ScaleDownNode}, []testPod{
+			{name: "a", node: "n1", age: time.Hour, registered: true, lastUsed: 10 * time.Minute},
+			{name: "b", node: "n1", age: time.Hour, registered: true, lastUsed: 20 * time.Minute},
+			{name: "c", node: "n2", age: time.Hour, registered: true, lastUsed: 5 * time.Minute},
+		}, []string{"c", "b", "a"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			list := proxyfunctions.NewServerlist("app", false)
+			list.SetClock(&virtualClock{now: now})
+			proxy := &ProxyForDeployment{Serverlist: list, cooldown: 60, maxTickets: 2, scaleDown: test.policy}
+			pods := make([]*v1.Pod, 0, len(test.pods))
+			for _, p := range test.pods {
+				pod := &v1.Pod{
+					ObjectMeta: metav1.ObjectMeta{Name: p.name, CreationTimestamp: metav1.NewTime(now.Add(-p.age))},
+					Spec:       v1.PodSpec{NodeName: p.node},
+				}
+				if p.deleted {
+					deleted := metav1.NewTime(now)
+					pod.DeletionTimestamp = &deleted
+				}
+				pods = append(pods, pod)
+				if !p.registered {
+					continue
+				}
+				if err := list.AddServer(p.name, 2, proxyfunctions.Config{Host: "10.0.0.1:80", Path: "/"}); err != nil {
+					t.Fatal(err)
+				}
+				list.Servers[p.name].LastUsed = now.Add(-p.lastUsed)
+				if p.busy {
+					list.Servers[p.name].Tickets["token"] = nil
+				}
+			}
+			names := []string{}
+			for _, candidate := range proxy.scaleDownCandidates(pods) {
+				names = append(names, candidate.name)
+			}
+			if !reflect.DeepEqual(names, test.want) {
+				t.Errorf("candidates %v, expected %v", names, test.want)
+			}
+		})
+	}
+}
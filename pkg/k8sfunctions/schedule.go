@@ -0,0 +1,270 @@
+package k8sfunctions
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	//the prefix of the annotations with the pre-warming schedules, the rest of the key is the name of the schedule
+	annotationSchedulePrefix = "ipb-halle.de/k8sticket.deployment.schedule."
+	//the interval for checking which schedules are active
+	schedulePeriod = 30 * time.Second
+	//the maximal duration of a time window
+	maxScheduleDuration = 7 * 24 * time.Hour
+)
+
+//cronField This is the set of the allowed values of one field of a cron expression.
+type cronField map[int]bool
+
+//parseCronField Parses one field of a cron expression with values between min and max:
+// "*", a value, a range "a-b", a step "*/n" or "a-b/n" or a comma separated list of them.
+func parseCronField(field string, min int, max int) (cronField, error) {
+	values := make(cronField)
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step < 1 {
+				return nil, fmt.Errorf("invalid step in %q", part)
+			}
+			part = part[:i]
+		}
+		from, to := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if from, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, fmt.Errorf("invalid value %q", part)
+			}
+			to = from
+			if len(bounds) == 2 {
+				if to, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, fmt.Errorf("invalid range %q", part)
+				}
+			} else if step > 1 {
+				//"a/n" means from a to the maximum
+				to = max
+			}
+		}
+		if from < min || to > max || from > to {
+			return nil, fmt.Errorf("%q is out of the range %d-%d", part, min, max)
+		}
+		for v := from; v <= to; v += step {
+			values[v] = true
+		}
+	}
+	return values, nil
+}
+
+//cronExpression This is a cron expression with the fields minute, hour, day of month, month and day of week.
+// Like in cron, a time matches if the day of month or the day of week matches, when both are restricted.
+type cronExpression struct {
+	minute, hour, dom, month, dow cronField
+	domAny, dowAny                bool
+}
+
+//parseCron Parses the five fields of a cron expression. Sunday is 0 or 7.
+func parseCron(fields []string) (cronExpression, error) {
+	if len(fields) != 5 {
+		return cronExpression{}, errors.New("a cron expression has 5 fields")
+	}
+	ranges := [][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	parsed := make([]cronField, 5)
+	for i, field := range fields {
+		var err error
+		if parsed[i], err = parseCronField(field, ranges[i][0], ranges[i][1]); err != nil {
+			return cronExpression{}, err
+		}
+	}
+	if parsed[4][7] {
+		parsed[4][0] = true
+	}
+	return cronExpression{minute: parsed[0], hour: parsed[1], dom: parsed[2], month: parsed[3], dow: parsed[4],
+		domAny: fields[2] == "*", dowAny: fields[4] == "*"}, nil
+}
+
+//matches Returns true if the minute of t matches the expression.
+func (cron cronExpression) matches(t time.Time) bool {
+	if !cron.minute[t.Minute()] || !cron.hour[t.Hour()] || !cron.month[int(t.Month())] {
+		return false
+	}
+	dom, dow := cron.dom[t.Day()], cron.dow[int(t.Weekday())]
+	if cron.domAny || cron.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+//prewarmSchedule This is a time window in which the capacity of an application is raised in advance,
+// e.g. for a course. The window starts whenever the cron expression matches and lasts duration.
+// While it is active, the spare tickets are at least spareTickets and at least minPods Pods are scaled.
+type prewarmSchedule struct {
+	name         string
+	cron         cronExpression
+	duration     time.Duration
+	spareTickets int
+	minPods      int
+}
+
+//parseSchedule Parses a schedule of the form "<minute> <hour> <day of month> <month> <day of week>
+// <duration> tickets.spare=<n> pods.min=<n>", e.g. "45 8 * * 1-5 4h tickets.spare=40".
+func parseSchedule(name string, spec string) (prewarmSchedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) < 7 {
+		return prewarmSchedule{}, errors.New("expected a cron expression, a duration and tickets.spare=<n> or pods.min=<n>")
+	}
+	schedule := prewarmSchedule{name: name}
+	var err error
+	if schedule.cron, err = parseCron(fields[:5]); err != nil {
+		return prewarmSchedule{}, err
+	}
+	if schedule.duration, err = time.ParseDuration(fields[5]); err != nil {
+		return prewarmSchedule{}, err
+	}
+	if schedule.duration < time.Minute || schedule.duration > maxScheduleDuration {
+		return prewarmSchedule{}, fmt.Errorf("the duration %v is not between 1m and %v", schedule.duration, maxScheduleDuration)
+	}
+	for _, setting := range fields[6:] {
+		kv := strings.SplitN(setting, "=", 2)
+		if len(kv) != 2 {
+			return prewarmSchedule{}, fmt.Errorf("%q is not of the form key=value", setting)
+		}
+		value, err := strconv.Atoi(kv[1])
+		if err != nil || value < 0 {
+			return prewarmSchedule{}, fmt.Errorf("%q is not a number of at least 0", setting)
+		}
+		switch kv[0] {
+		case "tickets.spare":
+			schedule.spareTickets = value
+		case "pods.min":
+			schedule.minPods = value
+		default:
+			return prewarmSchedule{}, fmt.Errorf("unknown setting %q", kv[0])
+		}
+	}
+	return schedule, nil
+}
+
+//activeAt Returns true if a time window of the schedule contains t,
+// i.e. the cron expression matched within the duration before t.
+func (schedule prewarmSchedule) activeAt(t time.Time) bool {
+	minute := t.Truncate(time.Minute)
+	for start := minute; t.Sub(start) < schedule.duration; start = start.Add(-time.Minute) {
+		if schedule.cron.matches(start) {
+			return true
+		}
+	}
+	return false
+}
+
+//parseSchedules Parses the schedules of an application, given as a map from name to schedule.
+// The valid schedules are returned in a canonical form for the AppConfig, one "name: schedule" per line,
+// together with the errors of the invalid ones.
+func parseSchedules(specs map[string]string, field func(name string) string) (string, []error) {
+	names := make([]string, 0, len(specs))
+	for name := range specs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var lines []string
+	var errs []error
+	for _, name := range names {
+		spec := strings.Join(strings.Fields(specs[name]), " ")
+		if _, err := parseSchedule(name, spec); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", field(name), err))
+			continue
+		}
+		lines = append(lines, name+": "+spec)
+	}
+	return strings.Join(lines, "\n"), errs
+}
+
+//schedulesOf Returns the schedules of the canonical form of parseSchedules.
+func schedulesOf(canonical string) []prewarmSchedule {
+	var schedules []prewarmSchedule
+	for _, line := range strings.Split(canonical, "\n") {
+		kv := strings.SplitN(line, ": ", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		if schedule, err := parseSchedule(kv[0], kv[1]); err == nil {
+			schedules = append(schedules, schedule)
+		}
+	}
+	return schedules
+}
+
+//updateSchedules This method checks which schedules of the proxy are active and raises the spare
+// tickets and the minimal number of Pods of the proxy accordingly. The activity of the schedules is
+// exported by the metric k8sticket_prewarm_active. The podScaler is triggered when a schedule starts or ends.
+func (proxy *ProxyForDeployment) updateSchedules() {
+	now := proxy.Serverlist.Now()
+	proxy.mux.Lock()
+	spare, minPods := 0, 0
+	active := make(map[string]bool)
+	for _, schedule := range proxy.schedules {
+		if !schedule.activeAt(now) {
+			continue
+		}
+		active[schedule.name] = true
+		if schedule.spareTickets > spare {
+			spare = schedule.spareTickets
+		}
+		if schedule.minPods > minPods {
+			minPods = schedule.minPods
+		}
+	}
+	changed := spare != proxy.prewarmSpare || minPods != proxy.prewarmPods
+	for name := range proxy.activeSchedules {
+		if !active[name] {
+			log.Println("k8s: ", proxy.Serverlist.Prefix(), " schedule "+name+" has ended")
+			proxy.metric.PrewarmActive.WithLabelValues(proxy.namespace, proxy.Serverlist.Prefix(), name).Set(0)
+		}
+	}
+	for name := range active {
+		if !proxy.activeSchedules[name] {
+			log.Println("k8s: ", proxy.Serverlist.Prefix(), " schedule "+name+" is active")
+		}
+		proxy.metric.PrewarmActive.WithLabelValues(proxy.namespace, proxy.Serverlist.Prefix(), name).Set(1)
+	}
+	proxy.activeSchedules = active
+	proxy.prewarmSpare = spare
+	proxy.prewarmPods = minPods
+	proxy.mux.Unlock()
+	if changed {
+		proxy.TriggerScaler()
+	}
+}
+
+//scheduleWatchdog This method checks the schedules of the proxy every schedulePeriod until the proxy is stopped.
+func (proxy *ProxyForDeployment) scheduleWatchdog() {
+	ticker := time.NewTicker(schedulePeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			proxy.updateSchedules()
+		case <-proxy.metricStopper:
+			return
+		}
+	}
+}
+
+//spareTarget Returns the number of spare tickets, raised by the active schedules and the prediction.
+// It has to be called with the locked mux of the proxy.
+func (proxy *ProxyForDeployment) spareTarget() int {
+	spare := proxy.spareTickets
+	for _, raised := range []int{proxy.prewarmSpare, proxy.predictedSpare} {
+		if raised > spare {
+			spare = raised
+		}
+	}
+	return spare
+}
@@ -0,0 +1,77 @@
+package k8sfunctions
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+	//a Monday
+	monday := time.Date(2024, 1, 8, 0, 0, 0, 0, time.Local)
+	tests := []struct {
+		name     string
+		spec     string
+		err      bool
+		duration time.Duration
+		spare    int
+		minPods  int
+		matches  []time.Time
+		misses   []time.Time
+	}{
+		{name: "course on weekdays", spec: "45 8 * * 1-5 4h tickets.spare=40 pods.min=10",
+			duration: 4 * time.Hour, spare: 40, minPods: 10,
+			matches: []time.Time{monday.Add(8*time.Hour + 45*time.Minute), monday.Add(4*24*time.Hour + 8*time.Hour + 45*time.Minute)},
+			misses:  []time.Time{monday.Add(8*time.Hour + 44*time.Minute), monday.Add(-24*time.Hour + 8*time.Hour + 45*time.Minute)}},
+		{name: "sunday as 7", spec: "0 10 * * 7 1h pods.min=2", duration: time.Hour, minPods: 2,
+			matches: []time.Time{monday.Add(-24*time.Hour + 10*time.Hour)},
+			misses:  []time.Time{monday.Add(10 * time.Hour)}},
+		{name: "steps and lists", spec: "*/15 8,12 * * * 30m tickets.spare=5", duration: 30 * time.Minute, spare: 5,
+			matches: []time.Time{monday.Add(8 * time.Hour), monday.Add(12*time.Hour + 45*time.Minute)},
+			misses:  []time.Time{monday.Add(8*time.Hour + 10*time.Minute), monday.Add(9 * time.Hour)}},
+		{name: "day of month or day of week", spec: "0 9 1 * 1 1h tickets.spare=1", duration: time.Hour, spare: 1,
+			matches: []time.Time{monday.Add(9 * time.Hour), time.Date(2024, 2, 1, 9, 0, 0, 0, time.Local)},
+			misses:  []time.Time{monday.Add(24*time.Hour + 9*time.Hour)}},
+		{name: "too few fields", spec: "45 8 * * 1-5 4h", err: true},
+		{name: "four cron fields", spec: "45 8 * * 4h tickets.spare=1 pods.min=1", err: true},
+		{name: "minute out of range", spec: "60 8 * * * 1h tickets.spare=1", err: true},
+		{name: "reversed range", spec: "0 8 * * 5-1 1h tickets.spare=1", err: true},
+		{name: "invalid step", spec: "*/0 8 * * * 1h tickets.spare=1", err: true},
+		{name: "invalid duration", spec: "0 8 * * * often tickets.spare=1", err: true},
+		{name: "duration too short", spec: "0 8 * * * 30s tickets.spare=1", err: true},
+		{name: "duration too long", spec: "0 8 * * * 169h tickets.spare=1", err: true},
+		{name: "setting without value", spec: "0 8 * * * 1h tickets.spare", err: true},
+		{name: "negative setting", spec: "0 8 * * * 1h tickets.spare=-1", err: true},
+		{name: "unknown setting", spec: "0 8 * * * 1h pods.max=3", err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			schedule, err := parseSchedule("s", test.spec)
+			if test.err {
+				if err == nil {
+					t.Fatalf("%q was accepted", test.spec)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if schedule.duration != test.duration || schedule.spareTickets != test.spare || schedule.minPods != test.minPods {
+				t.Errorf("duration %v, spare %d, minPods %d, expected %v, %d, %d", schedule.duration,
+					schedule.spareTickets, schedule.minPods, test.duration, test.spare, test.minPods)
+			}
+			for _, at := range test.matches {
+				if !schedule.cron.matches(at) {
+					t.Errorf("%v does not match", at)
+				}
+				if !schedule.activeAt(at.Add(test.duration - time.Second)) {
+					t.Errorf("not active %v after %v", test.duration-time.Second, at)
+				}
+			}
+			for _, at := range test.misses {
+				if schedule.cron.matches(at) {
+					t.Errorf("%v matches", at)
+				}
+			}
+		})
+	}
+}
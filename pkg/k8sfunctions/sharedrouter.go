@@ -0,0 +1,80 @@
+package k8sfunctions
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+//SharedRouter This is the top level router used when all applications share one listener.
+// The requests are dispatched by the first segment of the path, the app name of a
+// ProxyForDeployment. The router of the application checks the host in DNS mode.
+// Applications are added and removed at runtime when Deployments come and go.
+type SharedRouter struct {
+	routes map[string]http.Handler
+	mux    sync.RWMutex
+	server *http.Server
+}
+
+//NewSharedRouter Creates a new SharedRouter listening on addr, e.g. ":9001".
+func NewSharedRouter(addr string) *SharedRouter {
+	router := &SharedRouter{routes: make(map[string]http.Handler)}
+	router.server = &http.Server{Addr: addr, Handler: router}
+	return router
+}
+
+//Add This method registers the handler of an application for the given prefix.
+// It fails if the prefix is already used by another application.
+func (router *SharedRouter) Add(prefix string, handler http.Handler) error {
+	router.mux.Lock()
+	defer router.mux.Unlock()
+	if _, ok := router.routes[prefix]; ok {
+		return errors.New("shared router: app " + prefix + " is already served")
+	}
+	router.routes[prefix] = handler
+	log.Println("HTTP: shared router: serving app " + prefix)
+	return nil
+}
+
+//Remove This method removes the application with the given prefix, if it is
+// still served by handler. New requests for this prefix get a 404.
+func (router *SharedRouter) Remove(prefix string, handler http.Handler) {
+	router.mux.Lock()
+	defer router.mux.Unlock()
+	if current, ok := router.routes[prefix]; ok && current == handler {
+		delete(router.routes, prefix)
+		log.Println("HTTP: shared router: removed app " + prefix)
+	}
+}
+
+//ServeHTTP Dispatches a request to the application named by the first segment of the path.
+func (router *SharedRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	prefix := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)[0]
+	router.mux.RLock()
+	handler, ok := router.routes[prefix]
+	router.mux.RUnlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	handler.ServeHTTP(w, r)
+}
+
+//Start Starts the listener of the SharedRouter in the background.
+func (router *SharedRouter) Start() {
+	go func() {
+		if err := router.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Println("HTTP: shared router: ListenAndServe()", err)
+		}
+	}()
+}
+
+//Stop Shuts the listener of the SharedRouter down.
+func (router *SharedRouter) Stop() {
+	if err := router.server.Shutdown(context.Background()); err != nil {
+		log.Println("HTTP: shared router: Shutdown: ", err)
+	}
+}
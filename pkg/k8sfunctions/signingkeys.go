@@ -0,0 +1,116 @@
+package k8sfunctions
+
+import (
+	"crypto/rand"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/ipb-halle/k8sTicket/pkg/proxyfunctions"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/informers/internalinterfaces"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	//the annotation of the signing key Secret naming the key for new tickets
+	currentKeyAnnotation = "ipb-halle.de/k8sticket.keys.current"
+	//how often EnsureSigningKeys tries to read or create the Secret
+	signingKeysAttempts = 6
+)
+
+//EnsureSigningKeys This function creates the Secret with the signing keys of the tickets
+// if it does not exist yet. The Secret gets one random key.
+// Keys are rotated by adding a new key to the Secret. New tickets are signed with the key
+// named in the annotation ipb-halle.de/k8sticket.keys.current or, if the annotation is
+// missing, with the key that has the greatest name. Tickets signed with a removed key are invalid.
+// Failing API calls are retried with backoff, k8sTicket must not start without the shared keys,
+// because the tickets restored after a restart could not be verified otherwise.
+func EnsureSigningKeys(clientset kubernetes.Interface, ns string, name string) error {
+	backoff := newAPIBackoff()
+	backoff.Steps = signingKeysAttempts
+	return retry.OnError(backoff, func(err error) bool {
+		log.Println("k8s: Signing keys: ", err, ", retrying")
+		return true
+	}, func() error {
+		return ensureSigningKeys(clientset, ns, name)
+	})
+}
+
+//ensureSigningKeys Creates the Secret with the signing keys if it does not exist yet, see EnsureSigningKeys.
+func ensureSigningKeys(clientset kubernetes.Interface, ns string, name string) error {
+	_, err := clientset.CoreV1().Secrets(ns).Get(name, metav1.GetOptions{})
+	if err == nil || !errors.IsNotFound(err) {
+		return err
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	log.Println("k8s: Creating Secret " + name + " with a new signing key")
+	_, err = clientset.CoreV1().Secrets(ns).Create(&v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Data:       map[string][]byte{time.Now().UTC().Format("20060102150405"): key},
+	})
+	if errors.IsAlreadyExists(err) {
+		//another replica was faster
+		return nil
+	}
+	return err
+}
+
+//NewSigningKeysController This function creates a controller for the Secret with the
+// signing keys. Whenever the Secret is changed, the keys of the Signer are replaced.
+func NewSigningKeysController(clientset kubernetes.Interface, ns string, name string,
+	signer *proxyfunctions.Signer) Controller {
+	factory := informers.NewSharedInformerFactoryWithOptions(clientset,
+		1000000000,
+		informers.WithNamespace(ns),
+		informers.WithTweakListOptions(internalinterfaces.TweakListOptionsFunc(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+		})))
+	informer := factory.Core().V1().Secrets().Informer()
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			setSigningKeys(obj.(*v1.Secret), signer)
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			setSigningKeys(newObj.(*v1.Secret), signer)
+		},
+		DeleteFunc: func(obj interface{}) {
+			log.Println("k8s: Signing keys: Secret " + name + " was deleted, keeping the known keys")
+		},
+	})
+	return (Controller{
+		Clientset: clientset,
+		Factory:   factory,
+		Informer:  informer,
+		Stopper:   make(chan struct{}),
+	})
+}
+
+//setSigningKeys Passes the keys of the Secret to the Signer.
+func setSigningKeys(secret *v1.Secret, signer *proxyfunctions.Signer) {
+	current, ok := secret.GetAnnotations()[currentKeyAnnotation]
+	if !ok {
+		names := make([]string, 0, len(secret.Data))
+		for name := range secret.Data {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		if len(names) > 0 {
+			current = names[len(names)-1]
+		}
+	}
+	if err := signer.SetKeys(secret.Data, current); err != nil {
+		log.Println("k8s: Signing keys: Secret "+secret.Name+": ", err)
+		return
+	}
+	log.Println("k8s: Signing keys: ", len(secret.Data), " keys loaded, current key is "+current)
+}
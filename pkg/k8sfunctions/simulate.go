@@ -0,0 +1,324 @@
+package k8sfunctions
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ipb-halle/k8sTicket/pkg/proxyfunctions"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	//the namespace of the simulated application
+	simulationNamespace = "simulation"
+	//the resolution of the virtual time of the simulator
+	simulationStep = time.Second
+	//how long the simulator runs after the last user could have left, users still waiting then are unfinished
+	simulationGrace = time.Hour
+)
+
+//Arrival This is a user of a trace for the simulator. The user arrives At after the start of the trace
+// and keeps the ticket for Duration. A user who waits longer than Patience for a ticket gives up
+// and is counted as rejected, a Patience of 0 means that the user waits forever.
+type Arrival struct {
+	At       time.Duration
+	Duration time.Duration
+	Patience time.Duration
+}
+
+//SimulationConfig This is the input of Simulate. Annotations are the annotations of the simulated
+// Deployment, see ParseAppConfig. Startup returns the time a new Pod needs until it is ready.
+// Start is the virtual time of the beginning of the trace, it matters for the pre-warming schedules.
+type SimulationConfig struct {
+	Annotations map[string]string
+	Arrivals    []Arrival
+	Startup     func() time.Duration
+	Start       time.Time
+}
+
+//SimulationReport This is the result of Simulate. The waiting times are those of the served users.
+// Unfinished users were still waiting when the simulation ended.
+type SimulationReport struct {
+	Users       int
+	Served      int
+	Rejected    int
+	Unfinished  int
+	MeanWait    time.Duration
+	MedianWait  time.Duration
+	P95Wait     time.Duration
+	MaxWait     time.Duration
+	PodsCreated int
+	MaxPods     int
+	PodHours    float64
+	Duration    time.Duration
+}
+
+//virtualClock This is the clock of the Serverlist of the simulator.
+type virtualClock struct {
+	mux sync.Mutex
+	now time.Time
+}
+
+//Now Returns the virtual time.
+func (clock *virtualClock) Now() time.Time {
+	clock.mux.Lock()
+	defer clock.mux.Unlock()
+	return clock.now
+}
+
+//set Sets the virtual time.
+func (clock *virtualClock) set(now time.Time) {
+	clock.mux.Lock()
+	clock.now = now
+	clock.mux.Unlock()
+}
+
+//simulatedUser This is the state of an Arrival during the simulation.
+type simulatedUser struct {
+	Arrival
+	request *proxyfunctions.Request
+	queued  time.Time
+	leaves  time.Time
+	served  bool
+	done    bool
+}
+
+//simulatedPod This is the state of a Pod created by the podScaler during the simulation.
+type simulatedPod struct {
+	ip      string
+	ready   time.Time
+	running bool
+}
+
+//simulation This struct runs a ProxyForDeployment against a fake clientset in virtual time.
+type simulation struct {
+	clock     *virtualClock
+	clientset *fake.Clientset
+	proxy     *ProxyForDeployment
+	indexer   cache.Indexer
+	startup   func() time.Duration
+	pods      map[string]*simulatedPod
+	podCount  int
+	started   int
+	podTime   time.Duration
+	report    SimulationReport
+}
+
+//Simulate This function replays the arrivals of a trace against the Serverlist, the podScaler and the
+// podWatchdog of an application configured by the annotations, without a cluster and in virtual time.
+// The Pods are created in a fake clientset and are ready after the startup delay. Every second of the
+// virtual time, the users arrive, leave or give up, the expired tickets are removed and the podScaler
+// checks the demand. The podWatchdog checks the idle Pods every interval of the scale-down policy.
+// The errors of the annotations are returned, the invalid values are replaced by their defaults.
+func Simulate(conf SimulationConfig) (SimulationReport, []error) {
+	appConf, errs := ParseAppConfig("simulated", conf.Annotations)
+	sim := &simulation{
+		clock:     &virtualClock{now: conf.Start},
+		clientset: fake.NewSimpleClientset(),
+		startup:   conf.Startup,
+		pods:      make(map[string]*simulatedPod),
+	}
+	//the fake clientset neither generates names nor sets the creation time
+	sim.clientset.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		pod := action.(k8stesting.CreateAction).GetObject().(*v1.Pod)
+		if pod.Name == "" {
+			sim.podCount++
+			pod.Name = fmt.Sprintf("%s%05d", pod.GenerateName, sim.podCount)
+		}
+		pod.CreationTimestamp = metav1.NewTime(sim.clock.Now())
+		return false, nil, nil
+	})
+	podCache := NewPodCache(sim.clientset, []string{simulationNamespace})
+	sim.indexer = podCache.indexers[simulationNamespace]
+	metric := NewPMetric()
+	template := v1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{labelAppName: appConf.AppName}},
+		Spec:       v1.PodSpec{Containers: []v1.Container{{Name: "app", Image: "simulated"}}},
+	}
+	proxy := NewProxyForDeployment(sim.clientset, appConf.AppName, simulationNamespace, appConf.Port,
+		appConf.MaxTickets, appConf.SpareTickets, appConf.MaxPods, appConf.Cooldown, template, &metric,
+		false, false, appConf.Cookies, proxyfunctions.NewMemoryTicketStore(), nil, nil, nil, podCache)
+	proxy.Serverlist.SetClock(sim.clock)
+	proxy.config = appConf
+	proxy.scaleDown = newScaleDownPolicy(appConf)
+	proxy.schedules = schedulesOf(appConf.Schedules)
+	proxy.setPrediction(appConf.Predictive, time.Duration(appConf.PredictiveLead)*time.Second)
+	sim.proxy = proxy
+	go func() {
+		//the podScaler is called by the simulator, its messages are dropped
+		for {
+			select {
+			case <-proxy.podScalerInformer:
+			case <-proxy.podScalerStopper:
+				return
+			}
+		}
+	}()
+	defer func() {
+		close(proxy.podScalerStopper)
+		close(proxy.Serverlist.Stop)
+		proxy.podQueue.ShutDown()
+	}()
+	proxy.mux.Lock()
+	proxy.subscribePods()
+	proxy.mux.Unlock()
+	sim.run(conf.Arrivals)
+	return sim.report, errs
+}
+
+//run Runs the simulation until all users have left or given up.
+func (sim *simulation) run(arrivals []Arrival) {
+	users := make([]*simulatedUser, 0, len(arrivals))
+	end := time.Duration(0)
+	for _, arrival := range arrivals {
+		users = append(users, &simulatedUser{Arrival: arrival})
+		if last := arrival.At + arrival.Patience + arrival.Duration; last > end {
+			end = last
+		}
+	}
+	sort.SliceStable(users, func(i, j int) bool { return users[i].At < users[j].At })
+	end += simulationGrace
+	start := sim.clock.Now()
+	list := sim.proxy.Serverlist
+	var waits []time.Duration
+	next := 0
+	var elapsed time.Duration
+	for elapsed = 0; elapsed <= end; elapsed += simulationStep {
+		now := start.Add(elapsed)
+		sim.clock.set(now)
+		for ; next < len(users) && users[next].At <= elapsed; next++ {
+			users[next].request = list.NewRequest("")
+			users[next].queued = now
+		}
+		finished := next == len(users)
+		for _, user := range users[:next] {
+			switch {
+			case user.done:
+			case user.served && now.Before(user.leaves):
+				list.Touch(user.request)
+				finished = false
+			case user.served:
+				user.done = true
+			case list.Received(user.request):
+				user.served = true
+				user.leaves = now.Add(user.Duration)
+				waits = append(waits, now.Sub(user.queued))
+				sim.proxy.arrivals.record(now)
+				list.Touch(user.request)
+				finished = false
+			case user.Patience > 0 && now.Sub(user.queued) >= user.Patience:
+				list.Cancel(user.request)
+				user.done = true
+				sim.report.Rejected++
+			default:
+				finished = false
+			}
+		}
+		list.ExpireTickets()
+		sim.syncPods()
+		if elapsed%schedulePeriod == 0 {
+			sim.proxy.updateSchedules()
+			sim.proxy.updatePrediction()
+		}
+		if err := sim.proxy.scalePods(); err != nil {
+			sim.proxy.apiFailed("podScaler", err)
+		}
+		sim.syncPods()
+		if elapsed > 0 && elapsed%sim.proxy.scaleDown.interval == 0 {
+			sim.proxy.removeIdlePods()
+			sim.syncPods()
+		}
+		sim.podTime += time.Duration(len(sim.pods)) * simulationStep
+		if len(sim.pods) > sim.report.MaxPods {
+			sim.report.MaxPods = len(sim.pods)
+		}
+		if finished {
+			break
+		}
+	}
+	sim.report.Users = len(users)
+	for _, user := range users {
+		if user.served {
+			sim.report.Served++
+		} else if !user.done {
+			sim.report.Unfinished++
+		}
+	}
+	sim.report.Duration = elapsed
+	sim.report.PodHours = sim.podTime.Hours()
+	sim.report.PodsCreated = sim.podCount
+	if len(waits) > 0 {
+		sort.Slice(waits, func(i, j int) bool { return waits[i] < waits[j] })
+		var sum time.Duration
+		for _, wait := range waits {
+			sum += wait
+		}
+		sim.report.MeanWait = sum / time.Duration(len(waits))
+		sim.report.MedianWait = waits[len(waits)/2]
+		sim.report.P95Wait = waits[(len(waits)*95+99)/100-1]
+		sim.report.MaxWait = waits[len(waits)-1]
+	}
+}
+
+//syncPods Brings the PodCache in line with the Pods of the fake clientset, like the informer of the PodCache.
+// A new Pod gets its startup delay, a Pod whose delay has passed becomes running and ready. The servers
+// of the Pods are updated by the PodReconciler of the proxy, see reconcilePod.
+func (sim *simulation) syncPods() {
+	now := sim.clock.Now()
+	existing, err := sim.clientset.CoreV1().Pods(simulationNamespace).List(metav1.ListOptions{})
+	if err != nil {
+		return
+	}
+	seen := make(map[string]bool)
+	for i := range existing.Items {
+		pod := existing.Items[i].DeepCopy()
+		seen[pod.Name] = true
+		state, ok := sim.pods[pod.Name]
+		if !ok {
+			sim.started++
+			state = &simulatedPod{
+				ip:    fmt.Sprintf("10.%d.%d.%d", sim.started/65536%256, sim.started/256%256, sim.started%256),
+				ready: now.Add(sim.startup()),
+			}
+			sim.pods[pod.Name] = state
+		} else if state.running || now.Before(state.ready) {
+			continue
+		}
+		if !now.Before(state.ready) {
+			state.running = true
+			pod.Status.Phase = v1.PodRunning
+			pod.Status.PodIP = state.ip
+			pod.Status.Conditions = []v1.PodCondition{{Type: v1.PodReady, Status: v1.ConditionTrue}}
+			if _, err := sim.clientset.CoreV1().Pods(simulationNamespace).UpdateStatus(pod); err != nil {
+				continue
+			}
+		}
+		if err := sim.indexer.Update(pod); err == nil {
+			sim.reconcile(pod.Name)
+		}
+	}
+	for name := range sim.pods {
+		if seen[name] {
+			continue
+		}
+		delete(sim.pods, name)
+		if obj, exists, err := sim.indexer.GetByKey(simulationNamespace + "/" + name); err == nil && exists {
+			if err := sim.indexer.Delete(obj); err == nil {
+				sim.reconcile(name)
+			}
+		}
+	}
+}
+
+//reconcile Runs the PodReconciler of the proxy for the Pod name.
+func (sim *simulation) reconcile(name string) {
+	//nolint:errcheck
+	sim.proxy.reconcilePod(simulationNamespace + "/" + name)
+}
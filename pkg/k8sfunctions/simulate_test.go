@@ -0,0 +1,70 @@
+package k8sfunctions
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSimulate(t *testing.T) {
+	//a Monday
+	start := time.Date(2024, 1, 8, 10, 0, 0, 0, time.Local)
+	fixed := func(delay time.Duration) func() time.Duration {
+		return func() time.Duration { return delay }
+	}
+	annotations := func(pairs ...string) map[string]string {
+		result := make(map[string]string)
+		for i := 0; i+1 < len(pairs); i += 2 {
+			result["ipb-halle.de/k8sticket.deployment."+pairs[i]] = pairs[i+1]
+		}
+		return result
+	}
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		arrivals    []Arrival
+		served      int
+		rejected    int
+		maxWait     [2]time.Duration
+		maxPods     int
+		errs        int
+	}{
+		{"user waits for the startup", annotations("tickets.spare", "0"),
+			[]Arrival{{At: time.Minute, Duration: 10 * time.Minute}},
+			1, 0, [2]time.Duration{30 * time.Second, 32 * time.Second}, 1, 0},
+		{"spare tickets are ready", annotations("tickets.spare", "1"),
+			[]Arrival{{At: time.Minute, Duration: 10 * time.Minute}},
+			1, 0, [2]time.Duration{0, 0}, 1, 0},
+		{"second Pod for the third user", annotations("tickets.spare", "0", "tickets.max", "2", "pods.max", "5"),
+			[]Arrival{{At: 0, Duration: time.Hour}, {At: 0, Duration: time.Hour}, {At: 0, Duration: time.Hour}},
+			3, 0, [2]time.Duration{30 * time.Second, 32 * time.Second}, 2, 0},
+		{"impatient users are rejected without Pods", annotations("pods.max", "0"),
+			[]Arrival{{At: 0, Duration: time.Minute, Patience: time.Minute}, {At: time.Minute, Duration: time.Minute, Patience: time.Minute}},
+			0, 2, [2]time.Duration{0, 0}, 0, 0},
+		{"invalid annotations are reported", annotations("tickets.spare", "many"),
+			[]Arrival{{At: time.Minute, Duration: time.Minute}},
+			1, 0, [2]time.Duration{0, 0}, 1, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			report, errs := Simulate(SimulationConfig{
+				Annotations: test.annotations,
+				Arrivals:    test.arrivals,
+				Startup:     fixed(30 * time.Second),
+				Start:       start,
+			})
+			if len(errs) != test.errs {
+				t.Errorf("errors %v, expected %d", errs, test.errs)
+			}
+			if report.Users != len(test.arrivals) || report.Served != test.served || report.Rejected != test.rejected || report.Unfinished != 0 {
+				t.Errorf("users %d, served %d, rejected %d, unfinished %d, expected %d, %d, %d, 0",
+					report.Users, report.Served, report.Rejected, report.Unfinished, len(test.arrivals), test.served, test.rejected)
+			}
+			if report.MaxWait < test.maxWait[0] || report.MaxWait > test.maxWait[1] {
+				t.Errorf("maximal wait %v, expected between %v and %v", report.MaxWait, test.maxWait[0], test.maxWait[1])
+			}
+			if report.MaxPods != test.maxPods {
+				t.Errorf("at most %d Pods, expected %d", report.MaxPods, test.maxPods)
+			}
+		})
+	}
+}
@@ -0,0 +1,370 @@
+package k8sfunctions
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"time"
+
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	//the interval of the status updates of the TicketApps
+	ticketAppStatusInterval = 10 * time.Second
+	//the resync period of the TicketApp informer, a resync reloads the pod template of the referenced Deployment
+	ticketAppResync = 30 * time.Second
+)
+
+//TicketAppResource This is the resource of the TicketApp CustomResourceDefinition.
+var TicketAppResource = schema.GroupVersionResource{Group: "ipb-halle.de", Version: "v1alpha1", Resource: "ticketapps"}
+
+//TicketAppSpec This is the configuration of a TicketApp. It is the typed counterpart
+// of the ipb-halle.de/k8sticket.* annotations of a Deployment.
+// The Pods are either created from the pod template of the referenced Deployment
+// or from the Template of the TicketApp. Unset values get the defaults of the annotations.
+type TicketAppSpec struct {
+	Deployment        string              `json:"deployment,omitempty"`
+	Template          *v1.PodTemplateSpec `json:"template,omitempty"`
+	AppName           string              `json:"appName,omitempty"`
+	Port              *int                `json:"port,omitempty"`
+	MaxTickets        *int                `json:"maxTickets,omitempty"`
+	SpareTickets      *int                `json:"spareTickets,omitempty"`
+	MaxPods           *int                `json:"maxPods,omitempty"`
+	Cooldown          *int                `json:"cooldown,omitempty"`
+	MinLifetime       *int                `json:"minLifetime,omitempty"`
+	ScaleDownMax      *int                `json:"scaleDownMax,omitempty"`
+	ScaleDownOrder    string              `json:"scaleDownOrder,omitempty"`
+	ScaleDownInterval *int                `json:"scaleDownInterval,omitempty"`
+	DNS               bool                `json:"dns,omitempty"`
+	Rewrite           bool                `json:"rewrite,omitempty"`
+	Cookies           string              `json:"cookies,omitempty"`
+	Schedules         map[string]string   `json:"schedules,omitempty"`
+	Predictive        bool                `json:"predictive,omitempty"`
+	PredictiveLead    *int                `json:"predictiveLead,omitempty"`
+}
+
+//TicketAppStatus This is the status subresource of a TicketApp, it is updated by k8sTicket.
+// Degraded is the last error of the Kubernetes API while the proxy is degraded.
+type TicketAppStatus struct {
+	CurrentUsers int    `json:"currentUsers"`
+	FreeTickets  int    `json:"freeTickets"`
+	ScaledPods   int    `json:"scaledPods"`
+	QueueLength  int    `json:"queueLength"`
+	Degraded     string `json:"degraded"`
+}
+
+//TicketApp This is an application served by k8sTicket, configured by a custom resource
+// instead of the annotations of a Deployment.
+type TicketApp struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              TicketAppSpec   `json:"spec"`
+	Status            TicketAppStatus `json:"status,omitempty"`
+}
+
+//ticketAppConfig These are the parameters of a ProxyForDeployment resolved from a TicketApp.
+type ticketAppConfig struct {
+	AppConfig
+	podSpec v1.PodTemplateSpec
+}
+
+//intOrDefault Returns the value of an optional field of the TicketAppSpec.
+func intOrDefault(value *int, def int) int {
+	if value == nil {
+		return def
+	}
+	return *value
+}
+
+//TicketAppsServed Returns true if the TicketApp CustomResourceDefinition is installed in the cluster.
+func TicketAppsServed(client discovery.DiscoveryInterface) bool {
+	resources, err := client.ServerResourcesForGroupVersion(TicketAppResource.GroupVersion().String())
+	if err != nil {
+		return false
+	}
+	for _, resource := range resources.APIResources {
+		if resource.Name == TicketAppResource.Resource {
+			return true
+		}
+	}
+	return false
+}
+
+//NewTicketAppController This function creates a new controller for the TicketApps
+// in the given namespace. The Clientset of the controller is a dynamic.Interface,
+// because there is no generated clientset for the custom resource.
+func NewTicketAppController(client dynamic.Interface, ns string) Controller {
+	log.Println("New TicketApp controller started")
+	factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(client, ticketAppResync, ns, nil)
+	return (Controller{
+		Clientset: client,
+		Factory:   factory,
+		Informer:  factory.ForResource(TicketAppResource).Informer(),
+		Stopper:   make(chan struct{}),
+	})
+}
+
+//toTicketApp Converts an object of the TicketApp informer.
+func toTicketApp(obj interface{}) (*TicketApp, error) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return nil, errors.New("object is not a TicketApp")
+	}
+	app := &TicketApp{}
+	err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.UnstructuredContent(), app)
+	return app, err
+}
+
+//resolveTicketApp Creates the parameters of the proxy from the spec of a TicketApp.
+// The pod template is read from the referenced Deployment in the lister of the namespace of the TicketApp, if there is one.
+// The Pods of the template get the label of the app, so that the PodController finds them.
+// Unlike the annotations of a Deployment, invalid values are not replaced by their defaults.
+// The errors of the spec are returned in errs, an error of the lookup of the Deployment in err.
+func resolveTicketApp(deployments appslisters.DeploymentNamespaceLister, app *TicketApp) (conf ticketAppConfig, errs []error, err error) {
+	spec := app.Spec
+	defaults := DefaultAppConfig(app.Name)
+	port, _ := strconv.Atoi(defaults.Port)
+	conf = ticketAppConfig{AppConfig: AppConfig{
+		Port:              strconv.Itoa(intOrDefault(spec.Port, port)),
+		AppName:           defaults.AppName,
+		MaxTickets:        intOrDefault(spec.MaxTickets, defaults.MaxTickets),
+		SpareTickets:      intOrDefault(spec.SpareTickets, defaults.SpareTickets),
+		MaxPods:           intOrDefault(spec.MaxPods, defaults.MaxPods),
+		Cooldown:          intOrDefault(spec.Cooldown, defaults.Cooldown),
+		MinLifetime:       intOrDefault(spec.MinLifetime, defaults.MinLifetime),
+		ScaleDownMax:      intOrDefault(spec.ScaleDownMax, defaults.ScaleDownMax),
+		ScaleDownOrder:    defaults.ScaleDownOrder,
+		ScaleDownInterval: intOrDefault(spec.ScaleDownInterval, defaults.ScaleDownInterval),
+		DNS:               spec.DNS,
+		Rewrite:           spec.Rewrite,
+		Cookies:           defaults.Cookies,
+		Predictive:        spec.Predictive,
+		PredictiveLead:    intOrDefault(spec.PredictiveLead, defaults.PredictiveLead),
+	}}
+	if spec.AppName != "" {
+		conf.AppName = spec.AppName
+	}
+	if spec.ScaleDownOrder != "" {
+		conf.ScaleDownOrder = spec.ScaleDownOrder
+	}
+	if spec.Cookies != "" {
+		conf.Cookies = spec.Cookies
+	}
+	errs = conf.Validate()
+	var scheduleErrs []error
+	conf.Schedules, scheduleErrs = parseSchedules(spec.Schedules, func(name string) string {
+		return "schedules." + name
+	})
+	if errs = append(errs, scheduleErrs...); len(errs) > 0 {
+		return conf, errs, nil
+	}
+	switch {
+	case spec.Deployment != "":
+		deployment, err := deployments.Get(spec.Deployment)
+		if err != nil {
+			return conf, nil, err
+		}
+		conf.podSpec = *deployment.Spec.Template.DeepCopy()
+	case spec.Template != nil:
+		conf.podSpec = *spec.Template.DeepCopy()
+	default:
+		return conf, []error{errors.New("either deployment or template must be set")}, nil
+	}
+	if conf.podSpec.Labels == nil {
+		conf.podSpec.Labels = make(map[string]string)
+	}
+	conf.podSpec.Labels[labelAppName] = conf.AppName
+	return conf, nil, nil
+}
+
+//AddTicketAppControllers Lets the DeploymentReconciler reconcile the TicketApps of the
+// TicketAppControllers (keyed by namespace, see NamespaceScope.InformerNamespaces) in the same queue
+// as the Deployments. It has to be called before Run. The status of the TicketApps is written with client.
+// The Deployments referenced by the TicketApps do not carry the label of the DeploymentControllers,
+// so they are read from informers of all Deployments of the namespaces, which are run by Run.
+func (reconciler *DeploymentReconciler) AddTicketAppControllers(client dynamic.Interface, controllers map[string]Controller) {
+	reconciler.client = client
+	for ns, controller := range controllers {
+		factory := controller.Factory.(dynamicinformer.DynamicSharedInformerFactory)
+		reconciler.ticketApps[ns] = factory.ForResource(TicketAppResource).Lister()
+		reconciler.synced = append(reconciler.synced, controller.Informer.HasSynced)
+		controller.Informer.AddEventHandler(newQueueHandler(reconciler.queue, ticketAppKeyPrefix))
+		templates := informers.NewSharedInformerFactoryWithOptions(reconciler.clientset, 0, informers.WithNamespace(ns))
+		deployments := templates.Apps().V1().Deployments()
+		reconciler.templates[ns] = deployments.Lister()
+		reconciler.synced = append(reconciler.synced, deployments.Informer().HasSynced)
+		reconciler.factories = append(reconciler.factories, templates)
+	}
+}
+
+//ticketApp Returns the TicketApp name in the namespace ns from the lister, or nil if it does not exist.
+func (reconciler *DeploymentReconciler) ticketApp(ns string, name string) (*TicketApp, error) {
+	lister, ok := reconciler.ticketApps[ns]
+	if !ok {
+		lister, ok = reconciler.ticketApps[metav1.NamespaceAll]
+	}
+	if !ok {
+		return nil, nil
+	}
+	obj, err := lister.ByNamespace(ns).Get(name)
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return toTicketApp(obj)
+}
+
+//reconcileTicketApp Brings the proxy of the TicketApp key in line with the TicketApp in the lister.
+// It does the same job as reconcile for the Deployments, but the configuration is read from the TicketApp.
+// The proxies are kept in the TicketApps map of the ProxyMap, keyed by namespace/name.
+// A TicketApp in a namespace that is not watched (anymore) is handled as if it was deleted.
+// The errors of a spec are reported once per generation, so that the resyncs and status updates
+// of an invalid TicketApp do not lead to new Events. All parameters are changed while the proxy is running, see Reconfigure.
+func (reconciler *DeploymentReconciler) reconcileTicketApp(key string) error {
+	ns, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+	app, err := reconciler.ticketApp(ns, name)
+	if err != nil {
+		return err
+	}
+	proxies := reconciler.proxies
+	proxies.Mux.Lock()
+	defer proxies.Mux.Unlock()
+	proxy, ok := proxies.TicketApps[key]
+	if app == nil || !proxies.watches(ns) {
+		delete(reconciler.reported, key)
+		if ok {
+			log.Println("k8s: Deleting TicketApp " + key)
+			proxies.drain("TicketApp "+key, proxy, "", proxies.DrainTimeout)
+			delete(proxies.TicketApps, key)
+			delete(reconciler.apps, key)
+		}
+		return nil
+	}
+	conf, errs, err := resolveTicketApp(namespaceLister(reconciler.templates, ns), app)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	if err != nil || len(errs) > 0 {
+		if reconciler.reported[key] != app.Generation {
+			reconciler.reported[key] = app.Generation
+			if err != nil {
+				//the Deployment may be created later, the TicketApp is checked again at its next resync
+				proxies.Reporter.Warn(ticketAppRef(app), "DeploymentNotFound", err.Error())
+			} else {
+				proxies.Reporter.ReportTicketApp(app, errs)
+			}
+		}
+		if ok {
+			log.Println("k8s: TicketApp: " + key + ": keeping the running configuration")
+		}
+		return nil
+	}
+	delete(reconciler.reported, key)
+	if !ok {
+		log.Println("k8s: Adding TicketApp " + key)
+		reconciler.startTicketApp(app, conf)
+		return nil
+	}
+	old := reconciler.apps[key]
+	reconciler.apps[key] = conf
+	proxy.mux.Lock()
+	proxy.podSpec = conf.podSpec
+	proxy.mux.Unlock()
+	if old.AppConfig == conf.AppConfig {
+		return nil
+	}
+	proxy.Reconfigure(key, old.AppConfig, conf.AppConfig)
+	proxy.applyConfig(key, old.AppConfig, conf.AppConfig)
+	return nil
+}
+
+//startTicketApp Creates and starts the proxy of the TicketApp with the configuration conf.
+// It has to be called with the locked mux of the ProxyMap.
+func (reconciler *DeploymentReconciler) startTicketApp(app *TicketApp, conf ticketAppConfig) {
+	proxies := reconciler.proxies
+	c := reconciler.clientset
+	key := app.Namespace + "/" + app.Name
+	proxies.stopDraining("TicketApp " + key)
+	log.Println("k8s: TicketApp: " + key + " parameters: ")
+	conf.logParameters(key)
+	if user := proxies.portUser(conf.Port); proxies.SharedRouter == nil && user != "" {
+		log.Println("k8s: TicketApp: " + key + ": port " + conf.Port + " is already used by " + user)
+	}
+	proxy := NewProxyForDeployment(c, conf.AppName, app.Namespace, conf.Port, conf.MaxTickets, conf.SpareTickets,
+		conf.MaxPods, conf.Cooldown, conf.podSpec, reconciler.metric, conf.DNS, conf.Rewrite, conf.Cookies,
+		proxies.ticketStore(c, app.Namespace, "ticketapp-"+app.Name), proxies.Leadership, proxies.Signer, proxies.SharedRouter, proxies.Pods)
+	proxy.reporter = proxies.Reporter
+	proxy.ref = ticketAppRef(app)
+	proxy.scaleDown = newScaleDownPolicy(conf.AppConfig)
+	proxy.schedules = schedulesOf(conf.Schedules)
+	proxy.setPrediction(conf.Predictive, time.Duration(conf.PredictiveLead)*time.Second)
+	proxy.Serverlist.SetLegacyTokens(proxies.LegacyTokens)
+	proxies.TicketApps[key] = proxy
+	reconciler.apps[key] = conf
+	proxy.Start()
+	proxy.TriggerScaler()
+	go proxy.reportTicketAppStatus(reconciler.client, app.Name)
+}
+
+//reportTicketAppStatus This method writes the state of the proxy into the status of the TicketApp
+// until the proxy is stopped or drained. In high-availability mode, only the leader writes the status.
+func (proxy *ProxyForDeployment) reportTicketAppStatus(client dynamic.Interface, name string) {
+	ticker := time.NewTicker(ticketAppStatusInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if proxy.Serverlist.Draining() {
+				//the TicketApp was deleted
+				return
+			}
+			if !proxy.leadership.IsLeader() {
+				continue
+			}
+			status := TicketAppStatus{
+				CurrentUsers: proxy.Serverlist.GetTickets(),
+				FreeTickets:  proxy.Serverlist.GetAvailableTickets(),
+				QueueLength:  proxy.Serverlist.QueueLength(),
+			}
+			if err := proxy.Degraded(); err != nil {
+				status.Degraded = err.Error()
+			}
+			pods, err := proxy.pods.scaledPods(proxy.namespace, proxy.Serverlist.Prefix())
+			if err != nil {
+				log.Println("k8s: TicketApp: "+name+": status: ", err)
+				continue
+			}
+			status.ScaledPods = len(pods)
+			patch, err := json.Marshal(map[string]TicketAppStatus{"status": status})
+			if err != nil {
+				log.Println("k8s: TicketApp: "+name+": status: ", err)
+				continue
+			}
+			_, err = client.Resource(TicketAppResource).Namespace(proxy.namespace).Patch(name,
+				types.MergePatchType, patch, metav1.PatchOptions{}, "status")
+			if err != nil {
+				log.Println("k8s: TicketApp: "+name+": status: ", err)
+			}
+		case <-proxy.metricStopper:
+			return
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package k8sfunctions
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/ipb-halle/k8sTicket/pkg/proxyfunctions"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes"
+)
+
+//Types of ticket stores that can be chosen for k8sTicket
+const (
+	StoreMemory = "memory"
+	StoreSecret = "secret"
+)
+
+const (
+	//the label of the Secrets of the tickets, its value is the name of the Deployment, see ticketLabelValue
+	ticketLabel = "ipb-halle.de/k8sticket.tickets"
+	//the annotation of the Secrets of the tickets with the full name of the Deployment
+	ticketAppAnnotation = "ipb-halle.de/k8sticket.tickets.app"
+	//the key of the TicketRecord in the data of a Secret
+	ticketDataKey = "ticket"
+)
+
+//SecretTicketStore This is a TicketStore backed by one Secret per ticket, so that the
+// writes of different tickets do not conflict and the number of tickets is not limited by
+// the size of one object. The Secrets of a Deployment carry the label ticketLabel with the
+// name of the Deployment and the annotation ticketAppAnnotation with its full name, each one
+// holds a JSON encoded TicketRecord. The names of the
+// Secrets are hashes of the Deployment and the token, because names are limited in length
+// and characters.
+type SecretTicketStore struct {
+	clientset kubernetes.Interface
+	namespace string
+	app       string
+}
+
+//NewSecretTicketStore Creates a new SecretTicketStore for a Deployment.
+func NewSecretTicketStore(clientset kubernetes.Interface, ns string, deployment string) *SecretTicketStore {
+	return &SecretTicketStore{
+		clientset: clientset,
+		namespace: ns,
+		app:       deployment,
+	}
+}
+
+//ticketKey Returns a hash of a token that can be used in names and keys.
+func ticketKey(token string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(token)))[:32]
+}
+
+//ticketLabelValue Returns the value of the label ticketLabel for the Deployment app.
+// Label values are limited to 63 characters, longer names are shortened and made unique by a hash.
+func ticketLabelValue(app string) string {
+	if len(app) <= validation.LabelValueMaxLength {
+		return app
+	}
+	return app[:validation.LabelValueMaxLength-33] + "-" + ticketKey(app)
+}
+
+//secretName Returns the name of the Secret of a token.
+func (store *SecretTicketStore) secretName(token string) string {
+	return "k8sticket-ticket-" + ticketKey(store.app+"/"+token)
+}
+
+//Load Returns all tickets stored in the Secrets of the Deployment.
+// Secrets that do not hold a valid TicketRecord are skipped, so that one broken
+// Secret does not cost the other tickets.
+func (store *SecretTicketStore) Load() ([]proxyfunctions.TicketRecord, error) {
+	secrets, err := store.clientset.CoreV1().Secrets(store.namespace).List(metav1.ListOptions{
+		LabelSelector: labels.Set{ticketLabel: ticketLabelValue(store.app)}.String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	records := make([]proxyfunctions.TicketRecord, 0, len(secrets.Items))
+	for _, secret := range secrets.Items {
+		if app, ok := secret.Annotations[ticketAppAnnotation]; ok && app != store.app {
+			//another Deployment with the same shortened label value
+			continue
+		}
+		var record proxyfunctions.TicketRecord
+		if err := json.Unmarshal(secret.Data[ticketDataKey], &record); err != nil {
+			log.Println("k8s: SecretTicketStore: skipping Secret ", secret.Name, ": ", err)
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+//Get Returns the ticket of a token from its Secret, ok is false if there is no Secret.
+func (store *SecretTicketStore) Get(token string) (record proxyfunctions.TicketRecord, ok bool, err error) {
+	secret, err := store.clientset.CoreV1().Secrets(store.namespace).Get(store.secretName(token), metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return record, false, nil
+	}
+	if err != nil {
+		return record, false, err
+	}
+	if err := json.Unmarshal(secret.Data[ticketDataKey], &record); err != nil {
+		return record, false, fmt.Errorf("secret %s: %v", secret.Name, err)
+	}
+	return record, true, nil
+}
+
+//Save Stores a ticket in its Secret. The Secret is created if it does not exist.
+func (store *SecretTicketStore) Save(record proxyfunctions.TicketRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        store.secretName(record.Token),
+			Labels:      map[string]string{ticketLabel: ticketLabelValue(store.app)},
+			Annotations: map[string]string{ticketAppAnnotation: store.app},
+		},
+		Data: map[string][]byte{ticketDataKey: data},
+	}
+	_, err = store.clientset.CoreV1().Secrets(store.namespace).Create(secret)
+	if errors.IsAlreadyExists(err) {
+		//the usage of a known ticket, the Secret only holds this ticket
+		_, err = store.clientset.CoreV1().Secrets(store.namespace).Update(secret)
+	}
+	return err
+}
+
+//Delete Removes the Secret of a ticket.
+func (store *SecretTicketStore) Delete(token string) error {
+	err := store.clientset.CoreV1().Secrets(store.namespace).Delete(store.secretName(token), &metav1.DeleteOptions{})
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
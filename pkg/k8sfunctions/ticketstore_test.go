@@ -0,0 +1,151 @@
+package k8sfunctions
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ipb-halle/k8sTicket/pkg/proxyfunctions"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestSecretTicketStoreRestart(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	created := time.Date(2024, 1, 8, 10, 0, 0, 0, time.UTC)
+	records := []proxyfunctions.TicketRecord{
+		{Token: "t1", Server: "pod-1", UID: "u1", Session: "s1", Created: created, LastUsed: created},
+		{Token: "t2", Server: "pod-2", UID: "u2", Session: "s2", Created: created, LastUsed: created},
+	}
+	store := NewSecretTicketStore(clientset, "ns", "app")
+	other := NewSecretTicketStore(clientset, "ns", "other")
+	for _, record := range records {
+		if err := store.Save(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := other.Save(proxyfunctions.TicketRecord{Token: "t1", Server: "pod-9"}); err != nil {
+		t.Fatal(err)
+	}
+	//a broken Secret does not cost the other tickets
+	broken := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "broken", Labels: map[string]string{ticketLabel: "app"}},
+		Data:       map[string][]byte{ticketDataKey: []byte("{")},
+	}
+	if _, err := clientset.CoreV1().Secrets("ns").Create(broken); err != nil {
+		t.Fatal(err)
+	}
+	//the usage of a known ticket overwrites its Secret
+	used := records[0]
+	used.LastUsed = created.Add(time.Hour)
+	if err := store.Save(used); err != nil {
+		t.Fatal(err)
+	}
+
+	//a restarted k8sTicket only knows the Secrets
+	restarted := NewSecretTicketStore(clientset, "ns", "app")
+	loaded, err := restarted.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(loaded, func(i, j int) bool { return loaded[i].Token < loaded[j].Token })
+	if len(loaded) != 2 {
+		t.Fatalf("loaded %v, expected the 2 tickets of the app", loaded)
+	}
+	if loaded[0].Server != "pod-1" || !loaded[0].LastUsed.Equal(used.LastUsed) || loaded[1].Session != "s2" {
+		t.Errorf("loaded %v, expected %v and %v", loaded, used, records[1])
+	}
+
+	//the restored tickets are served again as soon as their server is back
+	list := proxyfunctions.NewServerlist("app", false)
+	defer close(list.Stop)
+	if err := list.SetTicketStore(restarted, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := list.AddServer("pod-1", 2, proxyfunctions.Config{Host: "10.0.0.1:80", Path: "/"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := list.Servers["pod-1"].Tickets["t1"]; !ok || list.GetTickets() != 1 {
+		t.Errorf("the ticket t1 was not restored on pod-1, %d tickets", list.GetTickets())
+	}
+
+	if err := restarted.Delete("t2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := restarted.Delete("t2"); err != nil {
+		t.Errorf("deleting a deleted ticket: %v", err)
+	}
+	if loaded, err = restarted.Load(); err != nil || len(loaded) != 1 || loaded[0].Token != "t1" {
+		t.Errorf("loaded %v, %v after the deletion, expected t1", loaded, err)
+	}
+	if loaded, err = other.Load(); err != nil || len(loaded) != 1 || loaded[0].Server != "pod-9" {
+		t.Errorf("the tickets of another app were changed: %v, %v", loaded, err)
+	}
+}
+
+func TestRestoreRetry(t *testing.T) {
+	clientset := newTestClientset()
+	store := NewSecretTicketStore(clientset, "ns", "app")
+	if err := store.Save(proxyfunctions.TicketRecord{Token: "t1", Server: "pod-1", Session: "s1", Created: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	failures := 1
+	clientset.PrependReactor("list", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if failures > 0 {
+			failures--
+			return true, nil, fmt.Errorf("the API server is not reachable")
+		}
+		return false, nil, nil
+	})
+	metric := NewPMetric()
+	proxy := NewProxyForDeployment(clientset, "app", "ns", "0", 1, 0, 3, 0, v1.PodTemplateSpec{}, &metric,
+		false, false, "", store, nil, nil, nil, NewPodCache(clientset, []string{"ns"}))
+	defer close(proxy.Stopper)
+	defer close(proxy.Serverlist.Stop)
+	if proxy.Degraded() == nil {
+		t.Fatal("the failed restore did not degrade the proxy")
+	}
+	//the server shows up before the retry
+	if err := proxy.Serverlist.AddServer("pod-1", 1, proxyfunctions.Config{Host: "10.0.0.1:80", Path: "/"}); err != nil {
+		t.Fatal(err)
+	}
+	if !eventually(3*time.Second, func() bool { return proxy.Serverlist.GetTickets() == 1 }) {
+		t.Fatal("the ticket t1 was not restored by the retry")
+	}
+	if proxy.Degraded() != nil {
+		t.Errorf("the proxy is still degraded: %v", proxy.Degraded())
+	}
+}
+
+func TestSecretTicketStoreLongNames(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	long := "ticketapp-" + strings.Repeat("a.very-long-deployment-name.", 8)
+	//the same shortened label value, but another hash
+	similar := long + "x"
+	for _, app := range []string{long, similar, "short"} {
+		store := NewSecretTicketStore(clientset, "ns", app)
+		if err := store.Save(proxyfunctions.TicketRecord{Token: "t-" + app, Server: "pod-1"}); err != nil {
+			t.Fatal(err)
+		}
+		secret, err := clientset.CoreV1().Secrets("ns").Get(store.secretName("t-"+app), metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if errs := validation.IsValidLabelValue(secret.Labels[ticketLabel]); len(errs) > 0 {
+			t.Errorf("label value %q: %v", secret.Labels[ticketLabel], errs)
+		}
+		if secret.Annotations[ticketAppAnnotation] != app {
+			t.Errorf("annotation %q, expected %q", secret.Annotations[ticketAppAnnotation], app)
+		}
+		loaded, err := store.Load()
+		if err != nil || len(loaded) != 1 || loaded[0].Token != "t-"+app {
+			t.Errorf("loaded %v, %v, expected the ticket of %s only", loaded, err, app)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package proxyfunctions
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	//the time a client has to redeem a claim code
+	claimTimeout = 30 * time.Second
+
+	//the message for legacy clients that are not allowed, see SetLegacyTokens
+	legacyRefusedMessage = "This page is outdated. Please reload it to open your application."
+)
+
+//claim A claim code can be redeemed once for the cookie of a ticket.
+// The token itself is never sent to the JavaScript of the home page.
+// The route is the route of the Serverlist when the ticket was made out.
+type claim struct {
+	ticket  *ticket
+	expires time.Time
+	route   Route
+}
+
+//newClaim This function creates a one-time claim code for a ticket.
+// The code has to be redeemed at /prefix/claim/code within the claimTimeout.
+func (list *Serverlist) newClaim(t *ticket) string {
+	code := tokenGenerator(16)
+	list.Mux.Lock()
+	list.claims[code] = &claim{ticket: t, expires: list.Now().Add(claimTimeout), route: Route{Prefix: list.Prefix(), DNS: list.dns}}
+	list.Mux.Unlock()
+	return code
+}
+
+//expireClaims Removes all claim codes that were not redeemed in time.
+// Lock the mux of the Serverlist before calling this function.
+func (list *Serverlist) expireClaims() {
+	for code, c := range list.claims {
+		if list.Now().After(c.expires) {
+			delete(list.claims, code)
+		}
+	}
+}
+
+//SetLegacyTokens This function allows legacy clients, which do not speak the JSONProtocol.
+// They get the token of their ticket and set the cookie in JavaScript, so the cookie is not
+// HttpOnly. Without this option, legacy clients are asked to reload the home page.
+// It has to be called before the Serverlist is used.
+func (list *Serverlist) SetLegacyTokens(allowed bool) {
+	list.Mux.Lock()
+	list.legacyTokens = allowed
+	list.Mux.Unlock()
+}
+
+//isSecure Returns true if the client connected with TLS, either to k8sTicket
+// or to a proxy in front of it.
+func isSecure(r *http.Request) bool {
+	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+//ServeClaim This handler redeems a claim code. It sets the cookie of the ticket
+// as HttpOnly cookie and redirects the client to its application.
+// Every code can only be used once.
+func (list *Serverlist) ServeClaim(w http.ResponseWriter, r *http.Request) {
+	code := mux.Vars(r)["c"]
+	list.Mux.Lock()
+	c, ok := list.claims[code]
+	delete(list.claims, code)
+	list.Mux.Unlock()
+	if !ok || list.Now().After(c.expires) {
+		http.Error(w, "This link is not valid anymore. Please open the application with the base path.", http.StatusForbidden)
+		return
+	}
+	t := c.ticket
+	t.server.Mux.Lock()
+	_, ok = t.server.Tickets[t.token]
+	t.server.Mux.Unlock()
+	if ok {
+		//the client needs some time to follow the redirect
+		t.Mux.Lock()
+		t.LastUsed = list.Now()
+		t.Mux.Unlock()
+	} else {
+		http.Error(w, "Session expired! Please open your application again by using the base path.", http.StatusForbidden)
+		return
+	}
+	cookie := &http.Cookie{
+		Name:     t.session + "-" + t.uid + "-stoken",
+		Value:    t.token,
+		HttpOnly: true,
+		Secure:   isSecure(r),
+		SameSite: http.SameSiteLaxMode,
+	}
+	var location string
+	if c.route.DNS {
+		//the cookie has to be sent to session.uid.host as well
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		cookie.Domain = host
+		cookie.Path = "/" + c.route.Prefix + "/"
+		scheme := "http"
+		if cookie.Secure {
+			scheme = "https"
+		}
+		location = scheme + "://" + t.session + "." + t.uid + "." + r.Host + "/" + c.route.Prefix + "/"
+	} else {
+		cookie.Path = "/" + c.route.Prefix + "/" + t.session + "/" + t.uid + "/"
+		location = cookie.Path
+	}
+	log.Println("Ticket: claim redeemed for ticket " + t.token)
+	http.SetCookie(w, cookie)
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, location, http.StatusSeeOther)
+}
@@ -0,0 +1,167 @@
+package proxyfunctions
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+//newClaimList Creates a Serverlist of the app "app" with one server and a ticket on it.
+func newClaimList(t *testing.T, dns bool) (*Serverlist, *ticket, *testClock) {
+	clock := &testClock{now: time.Now()}
+	list := NewServerlist("app", dns)
+	list.SetClock(clock)
+	if err := list.AddServer("pod-1", 2, Config{Host: "10.0.0.1:80", Path: "/"}); err != nil {
+		t.Fatal(err)
+	}
+	list.Mux.Lock()
+	ticket, err := list.addTicket("")
+	list.Mux.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return list, ticket, clock
+}
+
+//redeem Redeems a claim code and returns the response.
+func redeem(list *Serverlist, code string, host string, prepare func(r *http.Request)) *http.Response {
+	r := httptest.NewRequest("GET", "http://"+host+"/app/claim/"+code, nil)
+	r = mux.SetURLVars(r, map[string]string{"c": code})
+	if prepare != nil {
+		prepare(r)
+	}
+	w := httptest.NewRecorder()
+	list.ServeClaim(w, r)
+	return w.Result()
+}
+
+func TestServeClaim(t *testing.T) {
+	viaTLS := func(r *http.Request) { r.TLS = &tls.ConnectionState{} }
+	forwarded := func(r *http.Request) { r.Header.Set("X-Forwarded-Proto", "https") }
+	tests := []struct {
+		name     string
+		dns      bool
+		prepare  func(r *http.Request)
+		secure   bool
+		domain   string
+		path     string
+		location string
+	}{
+		{"path mode", false, nil, false, "", "/app/{s}/{u}/", "/app/{s}/{u}/"},
+		{"path mode via TLS", false, viaTLS, true, "", "/app/{s}/{u}/", "/app/{s}/{u}/"},
+		{"path mode behind a TLS ingress", false, forwarded, true, "", "/app/{s}/{u}/", "/app/{s}/{u}/"},
+		{"DNS mode", true, nil, false, "example.org", "/app/", "http://{s}.{u}.example.org:8080/app/"},
+		{"DNS mode behind a TLS ingress", true, forwarded, true, "example.org", "/app/", "https://{s}.{u}.example.org:8080/app/"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			list, ticket, _ := newClaimList(t, test.dns)
+			defer close(list.Stop)
+			expand := strings.NewReplacer("{s}", ticket.session, "{u}", ticket.uid).Replace
+			code := list.newClaim(ticket)
+			response := redeem(list, code, "example.org:8080", test.prepare)
+			if response.StatusCode != http.StatusSeeOther || response.Header.Get("Location") != expand(test.location) {
+				t.Errorf("status %d to %q, expected %d to %q", response.StatusCode, response.Header.Get("Location"),
+					http.StatusSeeOther, expand(test.location))
+			}
+			if response.Header.Get("Cache-Control") != "no-store" {
+				t.Errorf("Cache-Control %q, expected no-store", response.Header.Get("Cache-Control"))
+			}
+			cookies := response.Cookies()
+			if len(cookies) != 1 {
+				t.Fatalf("cookies %v, expected one", cookies)
+			}
+			cookie := cookies[0]
+			if cookie.Name != ticket.session+"-"+ticket.uid+"-stoken" || cookie.Value != ticket.token {
+				t.Errorf("cookie %s=%s is not the cookie of the ticket", cookie.Name, cookie.Value)
+			}
+			if !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode || cookie.Secure != test.secure {
+				t.Errorf("HttpOnly %v, SameSite %v, Secure %v, expected true, Lax, %v", cookie.HttpOnly, cookie.SameSite, cookie.Secure, test.secure)
+			}
+			if cookie.Domain != test.domain || cookie.Path != expand(test.path) {
+				t.Errorf("domain %q, path %q, expected %q, %q", cookie.Domain, cookie.Path, test.domain, expand(test.path))
+			}
+			//every code can only be used once
+			if again := redeem(list, code, "example.org:8080", test.prepare); again.StatusCode != http.StatusForbidden || len(again.Cookies()) != 0 {
+				t.Errorf("the second redemption got status %d and cookies %v", again.StatusCode, again.Cookies())
+			}
+		})
+	}
+}
+
+func TestServeClaimInvalid(t *testing.T) {
+	list, ticket, clock := newClaimList(t, false)
+	defer close(list.Stop)
+	if response := redeem(list, "unknown", "example.org", nil); response.StatusCode != http.StatusForbidden {
+		t.Errorf("status %d for an unknown code, expected %d", response.StatusCode, http.StatusForbidden)
+	}
+	code := list.newClaim(ticket)
+	clock.add(claimTimeout + time.Second)
+	if response := redeem(list, code, "example.org", nil); response.StatusCode != http.StatusForbidden || len(response.Cookies()) != 0 {
+		t.Errorf("status %d and cookies %v for an expired code, expected %d", response.StatusCode, response.Cookies(), http.StatusForbidden)
+	}
+}
+
+//readLegacy Connects a legacy client to the WebSocket handler of list and returns its messages.
+func readLegacy(t *testing.T, list *Serverlist) []string {
+	server := httptest.NewServer(http.HandlerFunc(list.ServeWs))
+	defer server.Close()
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	var messages []string
+	for {
+		if err := ws.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			return messages
+		}
+		messages = append(messages, string(data))
+	}
+}
+
+func TestLegacyTokens(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed bool
+		prefix  string
+		tickets int
+	}{
+		{"legacy clients are refused by default", false, "msg#" + legacyRefusedMessage, 0},
+		{"legacy clients get the token if allowed", true, "tkn#", 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			list := NewServerlist("app", false)
+			defer close(list.Stop)
+			list.SetLegacyTokens(test.allowed)
+			if err := list.AddServer("pod-1", 1, Config{Host: "10.0.0.1:80", Path: "/"}); err != nil {
+				t.Fatal(err)
+			}
+			messages := readLegacy(t, list)
+			found := false
+			for _, message := range messages {
+				found = found || strings.HasPrefix(message, test.prefix)
+				if !test.allowed && strings.HasPrefix(message, "tkn#") {
+					t.Errorf("a refused legacy client got the token: %q", message)
+				}
+			}
+			if !found {
+				t.Errorf("messages %q, expected one starting with %q", messages, test.prefix)
+			}
+			if tickets := list.GetTickets(); tickets != test.tickets {
+				t.Errorf("%d tickets after the connection, expected %d", tickets, test.tickets)
+			}
+		})
+	}
+}
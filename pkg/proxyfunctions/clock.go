@@ -0,0 +1,26 @@
+package proxyfunctions
+
+import "time"
+
+//Clock This is the source of the current time of a Serverlist for the tickets, the sessions
+// and the scaling of its servers. The simulator replaces the wall clock by a virtual clock.
+type Clock interface {
+	Now() time.Time
+}
+
+//SetClock This function sets the clock of the Serverlist.
+// It has to be called before the Serverlist is used.
+func (list *Serverlist) SetClock(clock Clock) {
+	list.Mux.Lock()
+	list.clock = clock
+	list.Mux.Unlock()
+}
+
+//Now Returns the current time of the clock of the Serverlist, the wall clock by default.
+// It does not lock the mux of the Serverlist, because the clock is not changed while the Serverlist is used.
+func (list *Serverlist) Now() time.Time {
+	if list.clock == nil {
+		return time.Now()
+	}
+	return list.clock.Now()
+}
@@ -0,0 +1,87 @@
+package proxyfunctions
+
+import (
+	"context"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+)
+
+//Cookie modes of a Serverlist
+const (
+	//CookiesBrowser The cookies of the servers are passed to the browser (default).
+	CookiesBrowser = "browser"
+	//CookiesJar The cookies of the servers are kept in a cookie jar of the ticket.
+	CookiesJar = "jar"
+)
+
+//cookieJarKey This is the key of the cookie jar of a session in the request context.
+type cookieJarKey struct{}
+
+//SetCookieMode This function chooses where the cookies of the servers are kept,
+// see CookiesBrowser and CookiesJar. With CookiesJar, the cookies set by a server
+// never reach the browser. They are stored per ticket and attached to the requests
+// of this ticket only, so sessions sharing the same origin do not see each others cookies.
+// It can be changed while the Serverlist is running, the cookies of the jars are lost in this case.
+func (list *Serverlist) SetCookieMode(mode string) {
+	list.Mux.Lock()
+	list.cookieJar = mode == CookiesJar
+	list.Mux.Unlock()
+}
+
+//cookies Returns the cookie jar of a ticket. The jar is created on first use.
+func (ticket *ticket) cookies() http.CookieJar {
+	ticket.Mux.Lock()
+	defer ticket.Mux.Unlock()
+	if ticket.jar == nil {
+		//the error is always nil without options
+		ticket.jar, _ = cookiejar.New(nil)
+	}
+	return ticket.jar
+}
+
+//withCookieJar Returns a copy of the request that carries the cookie jar of its ticket.
+func withCookieJar(r *http.Request, jar http.CookieJar) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), cookieJarKey{}, jar))
+}
+
+//jarURL Returns the URL used to scope the cookies in the jar. The scheme is https,
+// so that cookies with the Secure attribute are kept, too.
+func jarURL(u *url.URL) *url.URL {
+	scoped := *u
+	scoped.Scheme = "https"
+	return &scoped
+}
+
+//attachCookies This function replaces the cookies sent by the browser with the
+// cookies of the jar of the ticket. It is called by the Director of the proxy.
+func attachCookies(req *http.Request) {
+	jar, ok := req.Context().Value(cookieJarKey{}).(http.CookieJar)
+	if !ok {
+		return
+	}
+	req.Header.Del("Cookie")
+	cookies := jar.Cookies(jarURL(req.URL))
+	if len(cookies) == 0 {
+		return
+	}
+	values := make([]string, 0, len(cookies))
+	for _, cookie := range cookies {
+		values = append(values, cookie.Name+"="+cookie.Value)
+	}
+	req.Header.Set("Cookie", strings.Join(values, "; "))
+}
+
+//storeCookies This function moves the cookies of a response into the jar of the ticket.
+// It is called by the ModifyResponse function of the proxy.
+func storeCookies(resp *http.Response) {
+	jar, ok := resp.Request.Context().Value(cookieJarKey{}).(http.CookieJar)
+	if !ok {
+		return
+	}
+	if cookies := resp.Cookies(); len(cookies) > 0 {
+		jar.SetCookies(jarURL(resp.Request.URL), cookies)
+	}
+	resp.Header.Del("Set-Cookie")
+}
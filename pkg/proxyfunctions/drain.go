@@ -0,0 +1,41 @@
+package proxyfunctions
+
+import "log"
+
+//DefaultDrainMessage This is the message for the waiting clients of a draining Serverlist
+// if Drain is called without a message.
+const DefaultDrainMessage = "This application does not accept new users at the moment. Please try again later."
+
+//Drain This method stops the Serverlist from making out new tickets.
+// The clients waiting in the queue and all clients connecting later get a maintenance
+// message with the given text and are disconnected. The existing tickets are still
+// served until they expire. A Serverlist can not be resumed after it was drained.
+func (list *Serverlist) Drain(message string) {
+	list.drainOnce.Do(func() {
+		if message == "" {
+			message = DefaultDrainMessage
+		}
+		list.Mux.Lock()
+		list.drainMessage = message
+		list.Mux.Unlock()
+		log.Println("Serverlist:", list.Prefix(), "draining, no new tickets are made out")
+		close(list.drain)
+	})
+}
+
+//Draining Returns true if the Serverlist was drained.
+func (list *Serverlist) Draining() bool {
+	select {
+	case <-list.drain:
+		return true
+	default:
+		return false
+	}
+}
+
+//drainText Returns the message for the waiting clients of a draining Serverlist.
+func (list *Serverlist) drainText() string {
+	list.Mux.Lock()
+	defer list.Mux.Unlock()
+	return list.drainMessage
+}
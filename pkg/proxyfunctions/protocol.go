@@ -0,0 +1,127 @@
+package proxyfunctions
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+const (
+	//ProtocolVersion This is the version of the JSON message protocol of the home page.
+	ProtocolVersion = 1
+
+	//JSONProtocol This is the WebSocket subprotocol a client has to request to use the
+	// JSON message protocol. Clients without this subprotocol get the legacy
+	// msg#..., pos#... and tkn#... strings.
+	JSONProtocol = "k8sticket.v1"
+)
+
+//Types of the messages sent by k8sTicket
+const (
+	MessageWelcome     = "welcome"
+	MessagePosition    = "position"
+	MessageTicket      = "ticket"
+	MessageError       = "error"
+	MessageMaintenance = "maintenance"
+)
+
+//Types of the commands sent by the clients
+const (
+	CommandCancel       = "cancel"
+	CommandHeartbeat    = "heartbeat"
+	CommandChooseFlavor = "choose-flavor"
+)
+
+//ServerMessage This is a message sent by k8sTicket to a waiting client.
+// Only the fields belonging to the Type of the message are set.
+// ETA is given in seconds, 0 means that there is no estimation yet.
+// Server is the opaque session ID that replaces the name of the server in the URLs.
+type ServerMessage struct {
+	Version  int    `json:"version"`
+	Type     string `json:"type"`
+	Message  string `json:"message,omitempty"`
+	Position int    `json:"position,omitempty"`
+	ETA      int    `json:"eta,omitempty"`
+	Token    string `json:"token,omitempty"`
+	Server   string `json:"server,omitempty"`
+	UID      string `json:"uid,omitempty"`
+	Claim    string `json:"claim,omitempty"`
+}
+
+//ClientCommand This is a command sent by a waiting client to k8sTicket.
+// The Flavor is only used by the choose-flavor command.
+type ClientCommand struct {
+	Version int    `json:"version"`
+	Type    string `json:"type"`
+	Flavor  string `json:"flavor,omitempty"`
+}
+
+//newTextMessage Creates a message of the given type with a text for the user.
+func newTextMessage(msgType string, text string) ServerMessage {
+	return ServerMessage{Version: ProtocolVersion, Type: msgType, Message: text}
+}
+
+//newPositionMessage Creates a message with the position of a client in the queue.
+func newPositionMessage(pos QueuePosition, text string) ServerMessage {
+	return ServerMessage{
+		Version:  ProtocolVersion,
+		Type:     MessagePosition,
+		Message:  text,
+		Position: pos.Position,
+		ETA:      int(pos.ETA.Seconds()),
+	}
+}
+
+//newTicketMessage Creates a message that hands a ticket over to the client.
+// If a claim code is given, the message contains the code instead of the token.
+func newTicketMessage(t *ticket, code string) ServerMessage {
+	msg := ServerMessage{
+		Version: ProtocolVersion,
+		Type:    MessageTicket,
+		Server:  t.session,
+		UID:     t.uid,
+	}
+	if code != "" {
+		msg.Claim = code
+	} else {
+		msg.Token = t.token
+	}
+	return msg
+}
+
+//encode This method encodes a message for the protocol negotiated with the client.
+// The legacy protocol only knows text messages (msg#text), positions (pos#position@eta)
+// and tickets (tkn#token@session@uid). Several legacy messages are separated by a newline.
+func (msg ServerMessage) encode(legacy bool) ([]byte, error) {
+	if !legacy {
+		return json.Marshal(msg)
+	}
+	switch msg.Type {
+	case MessageTicket:
+		return []byte("tkn#" + msg.Token + "@" + msg.Server + "@" + msg.UID), nil
+	case MessagePosition:
+		if msg.Position == 0 {
+			return []byte("msg#" + msg.Message), nil
+		}
+		out := "pos#" + strconv.Itoa(msg.Position) + "@" + strconv.Itoa(msg.ETA)
+		if msg.Message != "" {
+			out = "msg#" + msg.Message + "\n" + out
+		}
+		return []byte(out), nil
+	default:
+		return []byte("msg#" + msg.Message), nil
+	}
+}
+
+//decodeCommand Decodes a command of a client using the JSON protocol.
+// Commands of other versions than ProtocolVersion are rejected.
+func decodeCommand(data []byte) (ClientCommand, error) {
+	var cmd ClientCommand
+	if err := json.Unmarshal(data, &cmd); err != nil {
+		return cmd, fmt.Errorf("invalid command: %v", err)
+	}
+	if cmd.Version != ProtocolVersion {
+		return cmd, fmt.Errorf("unsupported protocol version %d, expected %d", cmd.Version, ProtocolVersion)
+	}
+	return cmd, nil
+}
@@ -0,0 +1,134 @@
+package proxyfunctions
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestEncode(t *testing.T) {
+	ticket := &ticket{token: "tok", session: "sid", uid: "uid"}
+	tests := []struct {
+		name   string
+		msg    ServerMessage
+		legacy string
+		json   string
+	}{
+		{"welcome", newTextMessage(MessageWelcome, "hello"), "msg#hello",
+			`{"version":1,"type":"welcome","message":"hello"}`},
+		{"position", newPositionMessage(QueuePosition{Position: 3, ETA: 90 * time.Second}, ""), "pos#3@90",
+			`{"version":1,"type":"position","position":3,"eta":90}`},
+		{"position with text", newPositionMessage(QueuePosition{Position: 1}, "degraded"), "msg#degraded\npos#1@0",
+			`{"version":1,"type":"position","message":"degraded","position":1}`},
+		{"text without position", newPositionMessage(QueuePosition{}, "starting"), "msg#starting",
+			`{"version":1,"type":"position","message":"starting"}`},
+		{"ticket with token", newTicketMessage(ticket, ""), "tkn#tok@sid@uid",
+			`{"version":1,"type":"ticket","token":"tok","server":"sid","uid":"uid"}`},
+		{"ticket with claim", newTicketMessage(ticket, "code"), "tkn#@sid@uid",
+			`{"version":1,"type":"ticket","server":"sid","uid":"uid","claim":"code"}`},
+		{"error", newTextMessage(MessageError, "unknown"), "msg#unknown",
+			`{"version":1,"type":"error","message":"unknown"}`},
+		{"maintenance", newTextMessage(MessageMaintenance, "later"), "msg#later",
+			`{"version":1,"type":"maintenance","message":"later"}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			legacy, err := test.msg.encode(true)
+			if err != nil || string(legacy) != test.legacy {
+				t.Errorf("legacy %q, %v, expected %q", legacy, err, test.legacy)
+			}
+			encoded, err := test.msg.encode(false)
+			if err != nil || string(encoded) != test.json {
+				t.Errorf("JSON %s, %v, expected %s", encoded, err, test.json)
+			}
+		})
+	}
+}
+
+func TestDecodeCommand(t *testing.T) {
+	tests := []struct {
+		data string
+		cmd  ClientCommand
+		err  string
+	}{
+		{`{"version":1,"type":"cancel"}`, ClientCommand{Version: 1, Type: CommandCancel}, ""},
+		{`{"version":1,"type":"choose-flavor","flavor":"gpu"}`, ClientCommand{Version: 1, Type: CommandChooseFlavor, Flavor: "gpu"}, ""},
+		{`{"version":1,"type":"dance"}`, ClientCommand{Version: 1, Type: "dance"}, ""},
+		{`{"version":2,"type":"cancel"}`, ClientCommand{}, "unsupported protocol version 2, expected 1"},
+		{`{"type":"cancel"}`, ClientCommand{}, "unsupported protocol version 0, expected 1"},
+		{`cancel`, ClientCommand{}, "invalid command: "},
+		{`{"version":"1"}`, ClientCommand{}, "invalid command: "},
+	}
+	for _, test := range tests {
+		t.Run(test.data, func(t *testing.T) {
+			cmd, err := decodeCommand([]byte(test.data))
+			if test.err != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+					t.Errorf("error %v, expected %q", err, test.err)
+				}
+				return
+			}
+			if err != nil || cmd != test.cmd {
+				t.Errorf("command %+v, %v, expected %+v", cmd, err, test.cmd)
+			}
+		})
+	}
+}
+
+func TestUndecodableCommands(t *testing.T) {
+	list := NewServerlist("app", false)
+	defer close(list.Stop)
+	server := httptest.NewServer(http.HandlerFunc(list.ServeWs))
+	defer server.Close()
+	dialer := websocket.Dialer{Subprotocols: []string{JSONProtocol}}
+	ws, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	if ws.Subprotocol() != JSONProtocol {
+		t.Fatalf("subprotocol %q, expected %q", ws.Subprotocol(), JSONProtocol)
+	}
+	commands := []string{`{`, `{"version":2,"type":"heartbeat"}`, `{"version":1,"type":"dance"}`}
+	expected := []string{"invalid command: ", "unsupported protocol version 2, expected 1", "Unknown command: dance"}
+	for _, command := range commands {
+		if err := ws.WriteMessage(websocket.TextMessage, []byte(command)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//the replies come between the welcome and the position messages
+	var replies []string
+	for len(replies) < len(expected) {
+		if err := ws.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatalf("errors %q, connection: %v", replies, err)
+		}
+		var msg ServerMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			t.Fatalf("message %s: %v", data, err)
+		}
+		if msg.Version != ProtocolVersion {
+			t.Errorf("message %s has version %d", data, msg.Version)
+		}
+		if msg.Type == MessageError {
+			replies = append(replies, msg.Message)
+		}
+	}
+	for i := range expected {
+		if !strings.HasPrefix(replies[i], expected[i]) {
+			t.Errorf("error %q, expected %q", replies[i], expected[i])
+		}
+	}
+	//the client is still in the queue
+	if length := list.QueueLength(); length != 1 {
+		t.Errorf("queue length %d after the errors, expected 1", length)
+	}
+}
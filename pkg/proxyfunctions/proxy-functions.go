@@ -41,24 +41,38 @@ const (
 	ticketTime = 3 * time.Second
 )
 
+//errNoTicketLeft is returned by addTicket if no server has a free slot
+var errNoTicketLeft = errors.New("no ticket left")
+
 // Stucts for Server and Tickets
 
 //Config This is the config of a server. It has a Path and a Host.
+// The optional Flavor can be chosen by the clients waiting for a ticket.
 type Config struct {
-	Path string
-	Host string
+	Path   string
+	Host   string
+	Flavor string
 }
 
 //ticket A ticket has redundant information about the server and the token for easier access.
 // It will be updated everytime it is used.
+// The session is the opaque ID used in the URLs instead of the name of the server.
 // Developers: Lock the mux before you modify an object of this struct.
 
 type ticket struct {
 	LastUsed time.Time
+	created  time.Time
 	server   *server
 	token    string
 	uid      string
+	session  string
 	Mux      sync.Mutex
+	//stored is the LastUsed value that was written to the TicketStore
+	stored time.Time
+	//remote is true for tickets of a shared store that were not used by this replica yet
+	remote bool
+	//jar keeps the cookies of the server if the Serverlist uses CookiesJar
+	jar http.CookieJar
 }
 
 //server The server defines a backend including its tickets.
@@ -80,25 +94,63 @@ type server struct {
 // available, a ticket will be generated and the Tqueries will be removed from
 // the list.
 type Serverlist struct {
-	Servers   map[string]*server
-	Tqueries  list.List
-	Prefix    string
+	Servers  map[string]*server
+	Tqueries list.List
+	//prefix is the app name, it is read by Prefix and changed by SetRoute
+	prefix    string
+	prefixMux sync.RWMutex
 	Mux       sync.Mutex
 	Informers []chan string //maybe use a list.List if deletion of channels gets important
 	Stop      chan struct{}
 	dns       bool
+	rewrite   bool
+	cookieJar bool
+	stats     queueStats
+	signer    *Signer
+	//the store is optional, see SetTicketStore
+	store         TicketStore
+	shared        bool
+	storeMux      sync.Mutex
+	storeQueue    map[string]storeOp
+	storeSignal   chan struct{}
+	storeDone     chan struct{}
+	restored      map[string][]TicketRecord
+	restoredUntil time.Time
+	misses        map[string]time.Time //tokens not found in a shared store, see adoptTicket
+	claims        map[string]*claim
+	legacyTokens  bool
+	//sessions maps the session IDs of the URLs to the tickets
+	sessions map[string]*ticket
+	//drain is closed when the Serverlist stops making out tickets, see Drain
+	drain        chan struct{}
+	drainOnce    sync.Once
+	drainMessage string
+	//degraded is the message for the waiting clients while new servers can not be scaled, see SetDegraded
+	degraded string
+	//clock is the source of the current time, see SetClock
+	clock Clock
 }
 
 //NewServerlist Creates a new Serverlist, needs a prefix (app label).
 func NewServerlist(prefix string, dns bool) *Serverlist {
 	list := new(Serverlist)
 	list.Servers = make(map[string]*server)
-	list.Prefix = prefix
+	list.claims = make(map[string]*claim)
+	list.sessions = make(map[string]*ticket)
+	list.prefix = prefix
 	list.Stop = make(chan struct{})
+	list.drain = make(chan struct{})
 	list.dns = dns
 	return (list)
 }
 
+//Prefix Returns the app name of the Serverlist. It can be called with or without the locked mux.
+func (list *Serverlist) Prefix() string {
+	list.prefixMux.RLock()
+	defer list.prefixMux.RUnlock()
+	return list.prefix
+}
+
 //tockenGenerator This function generates a token like 31f4ef3d.
 // It is used to identify the tickets in k8sticket.
 func tokenGenerator(c int) string {
@@ -137,6 +189,7 @@ func (list *Serverlist) AddServer(name string, maxtickets int, Config Config) er
 			Tickets:    make(map[string]*ticket),
 			Name:       name,
 		}
+		list.restoreTickets(name)
 		go func() {
 			for _, channel := range list.Informers {
 				channel <- "adding server"
@@ -166,6 +219,34 @@ func (list *Serverlist) SetServerDeletion(name string) error {
 	return nil
 }
 
+//ResumeServer This function allows the use of a server that is marked for deletion again,
+// e.g. when its Pod is ready again before its tickets ended. It returns false if the
+// server does not exist or is not marked for deletion.
+func (list *Serverlist) ResumeServer(name string) bool {
+	list.Mux.Lock()
+	server, ok := list.Servers[name]
+	if !ok {
+		list.Mux.Unlock()
+		return false
+	}
+	server.Mux.Lock()
+	resumed := !server.UseAllowed
+	server.UseAllowed = true
+	server.Mux.Unlock()
+	if resumed {
+		go func() {
+			for _, channel := range list.Informers {
+				channel <- "adding server"
+			}
+		}()
+	}
+	list.Mux.Unlock()
+	if resumed {
+		list.querrymanager()
+	}
+	return resumed
+}
+
 //RemoveServer This function tries to remove a server from the serverlist. It will only succeed if the server
 // is not occupied by a ticket!
 // If the server is still busy, it will be marked for deletion by setting the
@@ -241,25 +322,67 @@ func (list *Serverlist) GetTickets() int {
 	return out
 }
 
+//ServerConfig Returns the Config of the server name and true, or false if the Serverlist
+// does not know the server. Servers that are marked for deletion are known until they are removed.
+func (list *Serverlist) ServerConfig(name string) (Config, bool) {
+	list.Mux.Lock()
+	defer list.Mux.Unlock()
+	server, ok := list.Servers[name]
+	if !ok {
+		return Config{}, false
+	}
+	return server.Config, true
+}
+
 //addTicket This functions adds a new ticket to the Serverlist on the first
-// available server. It will return an error if there are no free Tickets
-// left in the Serverlist.
-func (list *Serverlist) addTicket() (*ticket, error) {
+// available server with the requested flavor (an empty flavor matches all servers).
+// It will return errNoTicketLeft if there are no free Tickets left in the Serverlist,
+// or the error of the Signer if the ticket could not be signed.
+func (list *Serverlist) addTicket(flavor string) (*ticket, error) {
 	for name := range list.Servers {
 		list.Servers[name].Mux.Lock()
 		log.Println("Ticket: Trying " + name)
-		if list.Servers[name].hasSlots() && list.Servers[name].UseAllowed {
+		if list.Servers[name].hasSlots() && list.Servers[name].UseAllowed &&
+			(flavor == "" || list.Servers[name].Config.Flavor == flavor) {
 			list.Servers[name].Mux.Unlock()
-			return list.Servers[name].newTicket(), nil
+			t, err := list.Servers[name].newTicket(list.signer, list.Prefix(), list.Now())
+			if err != nil {
+				return nil, err
+			}
+			list.sessions[t.session] = t
+			return t, nil
 		}
 		list.Servers[name].Mux.Unlock()
 	}
-	return nil, errors.New("no ticket left")
+	return nil, errNoTicketLeft
+}
+
+//releaseTicket This function removes a ticket that was made out but never handed over
+// to the client, e.g. because the client closed the connection while waiting.
+// The slot will be available for the next query immediately.
+func (list *Serverlist) releaseTicket(t *ticket) {
+	list.Mux.Lock()
+	t.server.Mux.Lock()
+	if _, ok := t.server.Tickets[t.token]; ok {
+		delete(t.server.Tickets, t.token)
+		delete(list.sessions, t.session)
+		list.forgetTicket(t.token)
+		log.Println("Ticket: Releasing undelivered ticket " + t.token)
+		go func() {
+			for _, channel := range list.Informers {
+				channel <- "delete ticket " + t.token
+			}
+		}()
+	}
+	t.server.Mux.Unlock()
+	list.Mux.Unlock()
+	list.deletionmanager()
+	list.querrymanager()
 }
 
 //AddInformerChannel This function allows to inform external
 // functions about new and removed tickets.
-// It informs with "new ticket", "delete ticket", "adding server", "deleting server".
+// It informs with "new ticket", "new query", "delete ticket", "restore ticket", "adding server", "deleting server".
 func (list *Serverlist) AddInformerChannel() chan string {
 	chanInformer := make(chan string, 1)
 	list.Mux.Lock()
@@ -269,51 +392,69 @@ func (list *Serverlist) AddInformerChannel() chan string {
 }
 
 //TicketWatchdog This function checks if tickets are still valid (updated in specified time by a HTTP connection).
-// If the ticket was not updated in time, it will be removed from the server.
+// If the ticket was not updated in time, it will be removed from the server, see ExpireTickets.
 func (list *Serverlist) TicketWatchdog() {
 	ticker := time.NewTicker(ticketTime)
 	defer ticker.Stop()
-	//defer list.Mux.Unlock()
 	for {
 		select {
 		case <-ticker.C:
-			list.Mux.Lock()
-			for id := range list.Servers {
-				for token := range list.Servers[id].Tickets {
-					list.Servers[id].Tickets[token].Mux.Lock()
-					if time.Since(list.Servers[id].Tickets[token].LastUsed).Milliseconds() > ticketTime.Milliseconds() {
-						list.Servers[id].Tickets[token].Mux.Unlock()
-						list.Servers[id].Mux.Lock()
-						delete(list.Servers[id].Tickets, token)
-						list.Servers[id].Mux.Unlock()
-						log.Println("Ticket: Deleting ticket " + token)
-						//run the notification of external functions in the background
-						//we do this because of a possible dead lock.
-						//When an external function trys to lock list.servers
-						//it would stuck (amd we could not write new messages
-						//to the channels which locks this function as well)
-						go func() {
-							for _, channel := range list.Informers {
-								channel <- "delete ticket " + token
-							}
-						}()
-					} else {
-						list.Servers[id].Tickets[token].Mux.Unlock()
-					}
-				}
-			}
-			list.Mux.Unlock()
-			list.deletionmanager()
-			list.querrymanager()
+			list.ExpireTickets()
 		case <-list.Stop:
 			return
 		}
 	}
 }
 
+//ExpireTickets This function removes the tickets that were not updated in time from their servers.
+// The freed slots are passed to the waiting clients and the servers marked for deletion are removed.
+func (list *Serverlist) ExpireTickets() {
+	list.Mux.Lock()
+	now := list.Now()
+	for id := range list.Servers {
+		for token := range list.Servers[id].Tickets {
+			token := token
+			list.Servers[id].Tickets[token].Mux.Lock()
+			if now.Sub(list.Servers[id].Tickets[token].LastUsed).Milliseconds() > ticketTimeout(list.Servers[id].Tickets[token]).Milliseconds() {
+				list.Servers[id].Tickets[token].Mux.Unlock()
+				list.recordTicketEnd(list.Servers[id].Tickets[token])
+				list.Servers[id].Mux.Lock()
+				delete(list.sessions, list.Servers[id].Tickets[token].session)
+				delete(list.Servers[id].Tickets, token)
+				list.Servers[id].Mux.Unlock()
+				list.forgetTicket(token)
+				log.Println("Ticket: Deleting ticket " + token)
+				//run the notification of external functions in the background
+				//we do this because of a possible dead lock.
+				//When an external function trys to lock list.servers
+				//it would stuck (amd we could not write new messages
+				//to the channels which locks this function as well)
+				go func() {
+					for _, channel := range list.Informers {
+						channel <- "delete ticket " + token
+					}
+				}()
+			} else {
+				list.Servers[id].Tickets[token].Mux.Unlock()
+			}
+		}
+	}
+	list.expireRestored()
+	list.expireClaims()
+	list.Mux.Unlock()
+	list.deletionmanager()
+	list.querrymanager()
+}
+
 //querrymanager This function checks the Tqueries and creates a new ticket if resources are
 // available. It is used by callServer to ask for a new Ticket.
+// The first query in the list that can be served gets the ticket. A query that
+// waits for a flavor without free slots does not block the queries behind it.
+// A draining Serverlist does not make out tickets anymore.
 func (list *Serverlist) querrymanager() {
+	if list.Draining() {
+		return
+	}
 	for {
 		select {
 		case <-list.Stop:
@@ -322,25 +463,32 @@ func (list *Serverlist) querrymanager() {
 			list.Mux.Lock()
 			if list.Tqueries.Len() > 0 {
 				log.Println("Queries: There are " + strconv.Itoa(list.Tqueries.Len()) + " waiting")
-				t, err := list.addTicket()
-				if err == nil {
-					ChannelElement := list.Tqueries.Front()
+				for ChannelElement := list.Tqueries.Front(); ChannelElement != nil; ChannelElement = ChannelElement.Next() {
 					ChannelValue := ChannelElement.Value
-					channel, ok := ChannelValue.(chan *ticket)
+					q, ok := ChannelValue.(*query)
 					if !ok {
-						log.Printf("FATAL: got data of type %T but wanted chan!", ChannelValue)
+						log.Printf("FATAL: got data of type %T but wanted *query!", ChannelValue)
 						os.Exit(1)
 					}
-					channel <- t
-					close(channel)
-					list.Tqueries.Remove(ChannelElement)
-					go func() {
-						for _, channel := range list.Informers {
-							channel <- "new ticket"
-						}
-					}()
-				} else {
-					log.Println("Serverlist: querrymanager: ", err)
+					t, err := list.addTicket(q.flavor)
+					if err == nil {
+						list.persistTicket(t)
+						q.ticket <- t
+						close(q.ticket)
+						list.Tqueries.Remove(ChannelElement)
+						list.notifyPositions()
+						go func() {
+							for _, channel := range list.Informers {
+								channel <- "new ticket"
+							}
+						}()
+						break
+					}
+					if q.flavor == "" || err != errNoTicketLeft {
+						//there are no free slots at all, or no ticket can be made out
+						log.Println("Serverlist: querrymanager: ", err)
+						break
+					}
 				}
 			}
 			list.Mux.Unlock()
@@ -384,31 +532,44 @@ func (server *server) hasSlots() bool {
 	return len(server.Tickets) < server.maxTickets
 }
 
-//newTicket This function adds a new Ticket to a server and returns the new Ticket.
-func (server *server) newTicket() *ticket {
+//newTicket This function adds a new Ticket to a server made out at curtime and returns the new Ticket.
+// If a Signer is given, the token is signed for the app, the session and the uid. No ticket is
+// made out if it can not be signed, because an unsigned token would be rejected by verifyToken.
+func (server *server) newTicket(signer *Signer, app string, curtime time.Time) (*ticket, error) {
 	defer server.Mux.Unlock()
 	server.Mux.Lock()
 	token := tokenGenerator(5)
 	uid := tokenGenerator(server.maxTickets)
+	session := tokenGenerator(8)
+	if signer != nil {
+		signed, err := signer.Sign(TicketClaims{App: app, Session: session, UID: uid}, curtime)
+		if err != nil {
+			return nil, err
+		}
+		token = signed
+	}
 	newTicket := &ticket{
-		LastUsed: time.Now(),
+		LastUsed: curtime,
+		created:  curtime,
 		server:   server,
 		token:    token,
 		uid:      uid,
+		session:  session,
 	}
 	server.Tickets[token] = newTicket
-	return (newTicket)
+	return newTicket, nil
 }
 
 //update This functions updates a Ticket as long as the chan is not closed.
-func (ticket *ticket) update(alive chan struct{}) {
+// The time of the refresh is taken from now, the clock of the Serverlist.
+func (ticket *ticket) update(alive chan struct{}, now func() time.Time) {
 	ticker := time.NewTicker(ticketTime - 10*time.Millisecond)
 	defer ticker.Stop()
 	for {
 		select {
 		case <-ticker.C:
 			ticket.Mux.Lock()
-			curtime := time.Now()
+			curtime := now()
 			ticket.LastUsed = curtime
 			ticket.server.Mux.Lock()
 			ticket.server.LastUsed = curtime
@@ -427,25 +588,45 @@ func (ticket *ticket) update(alive chan struct{}) {
 // It uses CallServer to handle all connection details.
 func (list *Serverlist) MainHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	servername := vars["s"]
+	session := vars["s"]
 	uid := vars["u"]
 	log.Println("proxyfunctions: MainHandler: domain:", vars["domain"])
 	log.Println("proxyfunctions: MainHandler: path:", vars["serverpath"])
 	log.Println("proxyfunctions: MainHandler: uid:", vars["u"])
-	log.Println("proxyfunctions: MainHandler: servername:", vars["s"])
-	list.callServer(w, r, servername, uid)
+	log.Println("proxyfunctions: MainHandler: session:", vars["s"])
+	list.callServer(w, r, list.Route(), session, uid)
 }
 
 //callServer This function redirects client requests to the according backend.
 // It checks the cookie, checks and updates the Ticket and gets the HTTP content.
-func (list *Serverlist) callServer(w http.ResponseWriter, r *http.Request, name string, uid string) {
+// The backend is looked up by the session ID, the names of the servers are never part of the URL.
+// The route is the route the session was made out for.
+func (list *Serverlist) callServer(w http.ResponseWriter, r *http.Request, route Route, session string, uid string) {
 	alive := make(chan struct{})
 	defer close(alive)
+	if cookie, err := r.Cookie(session + "-" + uid + "-stoken"); err == nil {
+		//the signature is checked before the token is looked up anywhere
+		if err := list.verifyToken(cookie.Value, route.Prefix, session, uid); err != nil {
+			log.Println("Ticket: ", err)
+			if err == ErrTokenExpired {
+				list.endExpiredTicket(session, cookie.Value)
+				http.Error(w, "Session expired! Please open your application again by using the base path.", http.StatusForbidden)
+				return
+			}
+			http.Error(w, "You do not have access to this page. Please open the application with the base path.", http.StatusForbidden)
+			return
+		}
+		list.adoptTicket(session, cookie.Value)
+	}
 	list.Mux.Lock()
+	name := ""
+	if t, ok := list.sessions[session]; ok {
+		name = t.server.Name
+	}
 	if _, ok := list.Servers[name]; ok {
 		if list.Servers[name].Handler != nil {
 			//Middleware check Ticket
-			cookie, err := r.Cookie(name + "-" + uid + "-stoken")
+			cookie, err := r.Cookie(session + "-" + uid + "-stoken")
 			if err == http.ErrNoCookie {
 				http.Error(w, "Session expired! Please open your application again by using the base path.", http.StatusForbidden)
 				list.Mux.Unlock()
@@ -453,27 +634,35 @@ func (list *Serverlist) callServer(w http.ResponseWriter, r *http.Request, name
 				//token := r.Header.Get("X-Session-Token")
 				token := cookie.Value
 				if ticket, ok := list.Servers[name].Tickets[token]; ok {
-					if !(list.Servers[name].Tickets[token].uid == uid) {
+					if !(list.Servers[name].Tickets[token].uid == uid) || ticket.session != session {
 						list.Mux.Unlock()
 						http.Error(w, "Wrong user ID.", http.StatusInternalServerError)
+						return
 					}
 					list.Mux.Unlock()
 					list.Servers[name].Mux.Lock()
-					curtime := time.Now()
+					curtime := list.Now()
 					list.Servers[name].LastUsed = curtime
 					list.Servers[name].Mux.Unlock()
 					ticket.Mux.Lock()
 					ticket.LastUsed = curtime
+					ticket.remote = false
 					log.Println("Ticket:", token+"  "+ticket.LastUsed.Format("2006-01-02 15:04:05"))
 					ticket.Mux.Unlock()
-					go ticket.update(alive)
+					go ticket.update(alive, list.Now)
 					list.Servers[name].Mux.Lock()
 					ThisHandler := &list.Servers[name].Handler
 					list.Servers[name].Mux.Unlock()
-					if list.dns {
-						http.StripPrefix("/"+list.Prefix+"/", *ThisHandler).ServeHTTP(w, r)
+					if list.cookieJar {
+						r = withCookieJar(r, ticket.cookies())
+					}
+					if route.DNS {
+						http.StripPrefix("/"+route.Prefix+"/", *ThisHandler).ServeHTTP(w, r)
 					} else {
-						http.StripPrefix("/"+list.Prefix+"/"+name+"/"+uid+"/", *ThisHandler).ServeHTTP(w, r)
+						if list.rewrite {
+							r = withPublicPath(r, "/"+route.Prefix+"/"+session+"/"+uid)
+						}
+						http.StripPrefix("/"+route.Prefix+"/"+session+"/"+uid+"/", *ThisHandler).ServeHTTP(w, r)
 					}
 				} else {
 					list.Mux.Unlock()
@@ -491,7 +680,8 @@ func (list *Serverlist) callServer(w http.ResponseWriter, r *http.Request, name
 
 //ServeHome This function serves the home page.
 func (list *Serverlist) ServeHome(w http.ResponseWriter, r *http.Request) {
-	if r.URL.Path != "/"+list.Prefix && r.URL.Path != "/"+list.Prefix+"/" {
+	route := list.Route()
+	if r.URL.Path != "/"+route.Prefix && r.URL.Path != "/"+route.Prefix+"/" {
 		http.Error(w, "Not found", http.StatusNotFound)
 		return
 	}
@@ -504,7 +694,7 @@ func (list *Serverlist) ServeHome(w http.ResponseWriter, r *http.Request) {
 		log.Println("Proxy: ServerHome: os.Executable:", err)
 	}
 	dir := path.Dir(ex)
-	if list.dns {
+	if route.DNS {
 		http.ServeFile(w, r, dir+"/web/static/homeDNS.html")
 
 	} else {
@@ -513,7 +703,7 @@ func (list *Serverlist) ServeHome(w http.ResponseWriter, r *http.Request) {
 }
 
 //ping This is just the Websocket ping
-func ping(ws *websocket.Conn, done chan struct{}) {
+func ping(ws *websocket.Conn, done chan struct{}, stop func()) {
 	ticker := time.NewTicker(pingPeriod)
 	defer ticker.Stop()
 	for {
@@ -522,7 +712,8 @@ func ping(ws *websocket.Conn, done chan struct{}) {
 			log.Println("ping: Ping!")
 			if err := ws.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(writeWait)); err != nil {
 				log.Println("ping:", err)
-				close(done)
+				stop()
+				return
 			}
 		case <-done:
 			return
@@ -530,30 +721,108 @@ func ping(ws *websocket.Conn, done chan struct{}) {
 	}
 }
 
-var upgrader = websocket.Upgrader{}
+var upgrader = websocket.Upgrader{Subprotocols: []string{JSONProtocol}}
+
+//wsMessage A message for the writer of a WebSocket connection.
+// If result is set, the writer reports the result of the write on this channel.
+type wsMessage struct {
+	msg    ServerMessage
+	result chan error
+}
+
+//readCommands This function reads the messages of a client. Reading is necessary to
+// process the pong messages and to notice a closed connection.
+// Commands of clients using the JSON protocol are forwarded to the commands channel,
+// messages of legacy clients are ignored. Commands that can not be decoded are answered
+// with an error message by send. The closed channel is closed as soon as
+// the connection can not be read anymore.
+func readCommands(ws *websocket.Conn, legacy bool, commands chan ClientCommand, send func(ServerMessage),
+	closed chan struct{}, done chan struct{}) {
+	defer close(closed)
+	if err := ws.SetReadDeadline(time.Now().Add(pongWait)); err != nil {
+		log.Println("Ticket: WS: SetReadDeadline: ", err)
+	}
+	for {
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			log.Println("Ticket: WS: ReadMessage: ", err)
+			return
+		}
+		//every message shows that the client is still alive
+		if err := ws.SetReadDeadline(time.Now().Add(pongWait)); err != nil {
+			log.Println("Ticket: WS: SetReadDeadline: ", err)
+		}
+		if legacy {
+			continue
+		}
+		cmd, err := decodeCommand(data)
+		if err != nil {
+			log.Println("Ticket: WS: decodeCommand: ", err)
+			send(newTextMessage(MessageError, err.Error()))
+			continue
+		}
+		select {
+		case commands <- cmd:
+		case <-done:
+			return
+		}
+	}
+}
 
 //ServeWs This handler serves the WebSocket connection to acquire the cookie and the Ticket.
 // The delivered home page will wait until a cookie and a backend is transferred.
 // This function also handels the initial creation of Ticket by calling querrymanager.
+// Clients requesting the JSONProtocol subprotocol get JSON messages and can send commands,
+// all other clients get the legacy string messages. Legacy clients only get a ticket if
+// they are allowed by SetLegacyTokens.
 func (list *Serverlist) ServeWs(w http.ResponseWriter, r *http.Request) {
 	running := make(chan struct{})
-	wswrite := make(chan string)
-	//defer close(running)
+	var runningOnce sync.Once
+	stop := func() {
+		runningOnce.Do(func() { close(running) })
+	}
+	wswrite := make(chan wsMessage)
+	send := func(msg ServerMessage) {
+		select {
+		case wswrite <- wsMessage{msg: msg}:
+		case <-running:
+		}
+	}
+	//deliver waits until the message was written to the connection
+	deliver := func(msg ServerMessage) error {
+		result := make(chan error, 1)
+		select {
+		case wswrite <- wsMessage{msg: msg, result: result}:
+		case <-running:
+			return errors.New("connection closed")
+		}
+		return <-result
+	}
 	log.Print("WS: connection opened!\n")
 	ws, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println("upgrade:", err)
 		return
 	}
+	legacy := ws.Subprotocol() != JSONProtocol
 	go func() {
 		for {
 			select {
-			case string := <-wswrite:
-				if err := ws.SetWriteDeadline(time.Now().Add(writeWait)); err != nil {
-					log.Println("Ticket: WS: SetWriteDeadline: ", err)
+			case out := <-wswrite:
+				data, err := out.msg.encode(legacy)
+				if err != nil {
+					log.Println("Ticket: WS: encode: ", err)
+				} else {
+					if err := ws.SetWriteDeadline(time.Now().Add(writeWait)); err != nil {
+						log.Println("Ticket: WS: SetWriteDeadline: ", err)
+					}
+					if err = ws.WriteMessage(websocket.TextMessage, data); err != nil {
+						log.Println("Ticket: WS: WriteMessage: ", err)
+						stop()
+					}
 				}
-				if err := ws.WriteMessage(websocket.TextMessage, []byte(string)); err != nil {
-					log.Println("Ticket: WS: WriteMessage: ", err)
+				if out.result != nil {
+					out.result <- err
 				}
 			case <-running:
 				if err := ws.WriteMessage(websocket.CloseMessage,
@@ -565,34 +834,92 @@ func (list *Serverlist) ServeWs(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 	}()
-	go writeHello(wswrite)
-	go ping(ws, running)
+	go writeHello(send)
+	go ping(ws, running, stop)
 	ws.SetPongHandler(func(string) error {
 		err := ws.SetReadDeadline(time.Now().Add(pongWait))
 		log.Println("Pong: WS: SetReadDeadline: ", err)
 		return err
 	})
-	querry := make(chan *ticket, 1)
+	commands := make(chan ClientCommand)
+	closed := make(chan struct{})
+	go readCommands(ws, legacy, commands, send, closed, running)
+	if list.Draining() {
+		send(newTextMessage(MessageMaintenance, list.drainText()))
+		stop()
+		return
+	}
+	list.Mux.Lock()
+	refused := legacy && !list.legacyTokens
+	list.Mux.Unlock()
+	if refused {
+		//the token would end up in a cookie that is not HttpOnly, see SetLegacyTokens
+		log.Println("Ticket: WS: refusing a legacy client")
+		send(newTextMessage(MessageError, legacyRefusedMessage))
+		stop()
+		return
+	}
+	querry := newQuery()
 	list.Mux.Lock()
 	myElement := list.Tqueries.PushBack(querry)
+	list.notifyPositions()
 	list.Mux.Unlock()
-	defer func() {
-		list.Mux.Lock()
-		list.Tqueries.Remove(myElement)
-		list.Mux.Unlock()
-	}()
+	//the query is canceled whenever we leave, a ticket that was not delivered is released
+	defer list.cancelQuery(myElement, querry)
 	list.querrymanager()
 	go func() {
-		ticket := <-querry
-		wswrite <- "tkn#" + ticket.token + "@" + ticket.server.Name + "@" + ticket.uid
-		close(running)
+		list.Mux.Lock()
+		informers := list.Informers
+		list.Mux.Unlock()
+		for _, channel := range informers {
+			channel <- "new query"
+		}
 	}()
+	ticketchannel := querry.ticket
+	drainchannel := list.drain
 	ticketticker := time.NewTicker(10 * time.Second)
 	defer ticketticker.Stop()
 	for {
 		select {
+		case ticket := <-ticketchannel:
+			ticketchannel = nil
+			//JSON clients get a claim code instead of the token, the cookie is set by ServeClaim
+			code := ""
+			if !legacy {
+				code = list.newClaim(ticket)
+			}
+			if err := deliver(newTicketMessage(ticket, code)); err != nil {
+				log.Println("Ticket: WS: ticket could not be delivered: ", err)
+				list.releaseTicket(ticket)
+			}
+			stop()
 		case <-ticketticker.C:
-			wswrite <- "msg#Waiting for a free application slot. Please be patient."
+			send(newPositionMessage(list.queuePosition(myElement), list.waitingText()))
+		case pos := <-querry.position:
+			send(newPositionMessage(pos, ""))
+		case cmd := <-commands:
+			switch cmd.Type {
+			case CommandCancel:
+				log.Println("Ticket: WS: query canceled by the client")
+				stop()
+			case CommandHeartbeat:
+				send(newPositionMessage(list.queuePosition(myElement), ""))
+			case CommandChooseFlavor:
+				log.Println("Ticket: WS: client chose flavor " + cmd.Flavor)
+				list.setFlavor(querry, cmd.Flavor)
+				list.querrymanager()
+				send(newPositionMessage(list.queuePosition(myElement), ""))
+			default:
+				send(newTextMessage(MessageError, "Unknown command: "+cmd.Type))
+			}
+		case <-closed:
+			log.Println("Ticket: WS: connection closed by the client")
+			stop()
+		case <-drainchannel:
+			drainchannel = nil
+			log.Println("Ticket: WS: the application is draining, closing the query")
+			send(newTextMessage(MessageMaintenance, list.drainText()))
+			stop()
 		case <-running:
 			return
 		}
@@ -601,11 +928,14 @@ func (list *Serverlist) ServeWs(w http.ResponseWriter, r *http.Request) {
 
 //writeHello Writes a message to the frontend to welcome the user
 // Can be uses as template to send other messages to the home page.
-func writeHello(writech chan string) {
-	writech <- "msg#Welcome to k8sTicket. We will redirect you to your enquired application."
+func writeHello(send func(ServerMessage)) {
+	send(newTextMessage(MessageWelcome, "Welcome to k8sTicket. We will redirect you to your enquired application."))
 }
 
 //generateProxy Creates a proxy based on a given configuration.
+// If the request knows its public path (see withPublicPath), the response is rewritten by rewriteResponse.
+// If the request carries a cookie jar (see withCookieJar), the cookies are kept in this jar.
+// In this way, rewriting and the cookie mode can be changed without creating new proxies.
 func generateProxy(conf Config) http.Handler {
 	proxy := &httputil.ReverseProxy{Director: func(req *http.Request) {
 		originHost := conf.Host
@@ -615,12 +945,21 @@ func generateProxy(conf Config) http.Handler {
 		req.URL.Host = originHost
 		req.URL.Scheme = "http"
 		req.URL.Path = conf.Path + req.URL.Path
+		if _, rewrite := req.Context().Value(publicPathKey{}).(string); rewrite && req.Header.Get("Accept-Encoding") != "" {
+			//only gzip can be rewritten
+			req.Header.Set("Accept-Encoding", "gzip")
+		}
+		attachCookies(req)
 
 	}, Transport: &http.Transport{
 		Dial: (&net.Dialer{
 			Timeout: 5 * time.Second,
 		}).Dial,
 	}}
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		storeCookies(resp)
+		return rewriteResponse(resp)
+	}
 
 	return proxy
 }
@@ -0,0 +1,194 @@
+package proxyfunctions
+
+import (
+	"container/list"
+	"time"
+)
+
+const (
+	//the number of finished sessions and freed tickets that are kept for the estimation
+	statsSamples = 50
+
+	//only tickets that were freed in this window are used to calculate the free-ticket rate
+	statsWindow = 15 * time.Minute
+)
+
+//QueuePosition This is the position of a waiting client in the Tqueries list
+// together with the estimated time until a ticket will be made out.
+// An ETA of 0 means that there is not enough data for an estimation yet.
+type QueuePosition struct {
+	Position int
+	ETA      time.Duration
+}
+
+//query A query is the entry of a waiting client in the Tqueries list.
+// The querrymanager sends the ticket on the ticket channel, position changes
+// are pushed on the position channel (only the latest position is kept).
+type query struct {
+	ticket       chan *ticket
+	position     chan QueuePosition
+	lastPosition int
+	flavor       string
+}
+
+//queueStats This struct keeps the recently observed session durations and the times
+// when tickets were freed. It is used to estimate the waiting time in the queue.
+// Developers: Lock the mux of the Serverlist before you modify an object of this struct.
+type queueStats struct {
+	durations []time.Duration
+	frees     []time.Time
+}
+
+//newQuery Creates a new query for the Tqueries list.
+func newQuery() *query {
+	return &query{
+		ticket:   make(chan *ticket, 1),
+		position: make(chan QueuePosition, 1),
+	}
+}
+
+//pushPosition This method sends the latest position to the query without blocking.
+// An older position that was not read yet will be replaced.
+func (q *query) pushPosition(pos QueuePosition) {
+	select {
+	case <-q.position:
+	default:
+	}
+	q.position <- pos
+}
+
+//cancelQuery This method removes the query of a client that is gone from the Tqueries list.
+// A ticket that was already made out for this query, but not received by the client,
+// is released at once. Otherwise, it would occupy a slot until the TicketWatchdog removes it.
+func (list *Serverlist) cancelQuery(element *list.Element, q *query) {
+	list.Mux.Lock()
+	list.Tqueries.Remove(element)
+	list.notifyPositions()
+	list.Mux.Unlock()
+	select {
+	case t, ok := <-q.ticket:
+		if ok && t != nil {
+			list.releaseTicket(t)
+		}
+	default:
+	}
+}
+
+//setFlavor This method changes the flavor of the servers a query is waiting for.
+func (list *Serverlist) setFlavor(q *query, flavor string) {
+	list.Mux.Lock()
+	q.flavor = flavor
+	list.Mux.Unlock()
+}
+
+//recordTicketEnd This method records the duration of a finished session.
+// It has to be called with the locked mux of the Serverlist.
+func (list *Serverlist) recordTicketEnd(t *ticket) {
+	now := list.Now()
+	list.stats.durations = append(list.stats.durations, now.Sub(t.created))
+	if len(list.stats.durations) > statsSamples {
+		list.stats.durations = list.stats.durations[1:]
+	}
+	list.stats.frees = append(list.stats.frees, now)
+	if len(list.stats.frees) > statsSamples {
+		list.stats.frees = list.stats.frees[1:]
+	}
+}
+
+//estimateWait This method estimates the waiting time for a given position in the queue.
+// If tickets were freed recently, the rate of freed tickets is used. Otherwise, the
+// average session duration and the number of slots on all usable servers are used.
+// It has to be called with the locked mux of the Serverlist.
+func (list *Serverlist) estimateWait(position int) time.Duration {
+	now := list.Now()
+	var recent []time.Time
+	for _, t := range list.stats.frees {
+		if now.Sub(t) <= statsWindow {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) >= 2 {
+		span := now.Sub(recent[0])
+		if span > 0 {
+			perTicket := span / time.Duration(len(recent))
+			return perTicket * time.Duration(position)
+		}
+	}
+	if len(list.stats.durations) == 0 {
+		return 0
+	}
+	var sum time.Duration
+	for _, d := range list.stats.durations {
+		sum += d
+	}
+	average := sum / time.Duration(len(list.stats.durations))
+	slots := 0
+	for name := range list.Servers {
+		list.Servers[name].Mux.Lock()
+		if list.Servers[name].UseAllowed {
+			slots = slots + list.Servers[name].maxTickets
+		}
+		list.Servers[name].Mux.Unlock()
+	}
+	if slots == 0 {
+		return 0
+	}
+	//every full round of sessions on all slots frees another batch of tickets
+	rounds := (position + slots - 1) / slots
+	return average * time.Duration(rounds)
+}
+
+//notifyPositions This method pushes the current positions to all waiting clients
+// whose position has changed.
+// It has to be called with the locked mux of the Serverlist.
+func (list *Serverlist) notifyPositions() {
+	position := 0
+	for e := list.Tqueries.Front(); e != nil; e = e.Next() {
+		position++
+		q := e.Value.(*query)
+		if q.lastPosition != position {
+			q.lastPosition = position
+			q.pushPosition(QueuePosition{Position: position, ETA: list.estimateWait(position)})
+		}
+	}
+}
+
+//queuePosition This method returns the current position of an element in the Tqueries list.
+// It returns 0 if the element is not waiting anymore.
+func (list *Serverlist) queuePosition(element *list.Element) QueuePosition {
+	list.Mux.Lock()
+	defer list.Mux.Unlock()
+	position := 0
+	for e := list.Tqueries.Front(); e != nil; e = e.Next() {
+		position++
+		if e == element {
+			return QueuePosition{Position: position, ETA: list.estimateWait(position)}
+		}
+	}
+	return QueuePosition{}
+}
+
+//QueueLength This method returns the number of clients waiting for a ticket.
+func (list *Serverlist) QueueLength() int {
+	list.Mux.Lock()
+	defer list.Mux.Unlock()
+	return list.Tqueries.Len()
+}
+
+//SetDegraded This method sets the message for the waiting clients while new servers can not
+// be provided, e.g. because the Kubernetes API is not reachable. An empty message clears it.
+func (list *Serverlist) SetDegraded(message string) {
+	list.Mux.Lock()
+	defer list.Mux.Unlock()
+	list.degraded = message
+}
+
+//waitingText Returns the message that is sent periodically to the waiting clients.
+func (list *Serverlist) waitingText() string {
+	list.Mux.Lock()
+	defer list.Mux.Unlock()
+	if list.degraded != "" {
+		return list.degraded
+	}
+	return "Waiting for a free application slot. Please be patient."
+}
@@ -0,0 +1,74 @@
+package proxyfunctions
+
+import (
+	"container/list"
+)
+
+//Request This is a client waiting for a ticket without a WebSocket connection, e.g. a user of the simulator.
+// It takes the same way through the Tqueries list as the clients of ServeWs.
+type Request struct {
+	element *list.Element
+	query   *query
+	ticket  *ticket
+}
+
+//NewRequest This function queues a new client for a ticket of a server with the flavor
+// (an empty flavor matches all servers). It returns nil if the Serverlist is draining.
+func (list *Serverlist) NewRequest(flavor string) *Request {
+	if list.Draining() {
+		return nil
+	}
+	q := newQuery()
+	q.flavor = flavor
+	list.Mux.Lock()
+	element := list.Tqueries.PushBack(q)
+	list.notifyPositions()
+	informers := list.Informers
+	list.Mux.Unlock()
+	list.querrymanager()
+	go func() {
+		for _, channel := range informers {
+			channel <- "new query"
+		}
+	}()
+	return &Request{element: element, query: q}
+}
+
+//Received This function returns true as soon as the ticket of the request was made out.
+func (list *Serverlist) Received(r *Request) bool {
+	if r.ticket != nil {
+		return true
+	}
+	select {
+	case t, ok := <-r.query.ticket:
+		if ok && t != nil {
+			r.ticket = t
+			return true
+		}
+	default:
+	}
+	return false
+}
+
+//Cancel This function removes a request that is still waiting from the Tqueries list,
+// like a client that leaves the home page. A ticket that was not received yet is released.
+func (list *Serverlist) Cancel(r *Request) {
+	if r.ticket == nil {
+		list.cancelQuery(r.element, r.query)
+	}
+}
+
+//Touch This function marks the ticket of the request and its server as used now,
+// like the requests of a client in a session.
+func (list *Serverlist) Touch(r *Request) {
+	if r.ticket == nil {
+		return
+	}
+	now := list.Now()
+	r.ticket.Mux.Lock()
+	r.ticket.LastUsed = now
+	r.ticket.server.Mux.Lock()
+	r.ticket.server.LastUsed = now
+	r.ticket.server.Mux.Unlock()
+	r.ticket.Mux.Unlock()
+}
@@ -0,0 +1,141 @@
+package proxyfunctions
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+//publicPathKey This is the key of the public path of a session in the request context.
+type publicPathKey struct{}
+
+var (
+	//href="/...", src='/...', action=/...
+	attributeURL = regexp.MustCompile(`(?i)(\s(?:href|src|action)\s*=\s*)("[^"]*"|'[^']*'|[^\s>"']+)`)
+	//url(/...), url("/..."), url('/...')
+	cssURL = regexp.MustCompile(`(?i)url\(\s*("[^"]*"|'[^']*'|[^\s)"']+)\s*\)`)
+	//Path=/... of a Set-Cookie header
+	cookiePath = regexp.MustCompile(`(?i)(;\s*path=)([^;]*)`)
+)
+
+//withPublicPath Returns a copy of the request that knows the public path of the session,
+// e.g. /prefix/session/uid. The path is used by rewriteResponse.
+func withPublicPath(r *http.Request, base string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), publicPathKey{}, base))
+}
+
+//rewritePath Moves a root-relative URL below the public path. Absolute URLs,
+// protocol-relative URLs and URLs that are already below the public path are kept.
+func rewritePath(u string, base string) string {
+	if !strings.HasPrefix(u, "/") || strings.HasPrefix(u, "//") ||
+		u == base || strings.HasPrefix(u, base+"/") {
+		return u
+	}
+	return base + u
+}
+
+//rewriteQuoted Rewrites a URL that may be surrounded by quotes.
+func rewriteQuoted(value string, base string) string {
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') {
+		return value[:1] + rewritePath(value[1:len(value)-1], base) + value[len(value)-1:]
+	}
+	return rewritePath(value, base)
+}
+
+//rewriteBody Rewrites the root-relative URLs of a HTML or CSS document.
+func rewriteBody(body []byte, base string, html bool) []byte {
+	if html {
+		body = attributeURL.ReplaceAllFunc(body, func(match []byte) []byte {
+			parts := attributeURL.FindSubmatch(match)
+			return []byte(string(parts[1]) + rewriteQuoted(string(parts[2]), base))
+		})
+	}
+	return cssURL.ReplaceAllFunc(body, func(match []byte) []byte {
+		parts := cssURL.FindSubmatch(match)
+		return []byte("url(" + rewriteQuoted(string(parts[1]), base) + ")")
+	})
+}
+
+//rewriteResponse This function is the ModifyResponse function of the proxies with rewriting.
+// Applications that generate absolute paths are moved below the public path of the
+// session: Location headers, the Path of cookies and root-relative href, src and action
+// attributes as well as url() in HTML and CSS are rewritten. Gzip encoded bodies are
+// decompressed and compressed again, bodies with other encodings are not touched.
+func rewriteResponse(resp *http.Response) error {
+	base, _ := resp.Request.Context().Value(publicPathKey{}).(string)
+	if base == "" {
+		return nil
+	}
+	if location := resp.Header.Get("Location"); location != "" {
+		if u, err := url.Parse(location); err == nil && u.Host != "" &&
+			(u.Host == resp.Request.URL.Host || u.Host == resp.Request.Header.Get("X-Forwarded-Host")) {
+			//the backend redirects to itself
+			u.Scheme = ""
+			u.Host = ""
+			location = u.String()
+		}
+		resp.Header.Set("Location", rewritePath(location, base))
+	}
+	if cookies := resp.Header["Set-Cookie"]; len(cookies) > 0 {
+		for i, cookie := range cookies {
+			cookies[i] = cookiePath.ReplaceAllStringFunc(cookie, func(match string) string {
+				parts := cookiePath.FindStringSubmatch(match)
+				return parts[1] + rewritePath(parts[2], base)
+			})
+		}
+	}
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || (mediaType != "text/html" && mediaType != "text/css") {
+		return nil
+	}
+	encoding := resp.Header.Get("Content-Encoding")
+	if encoding != "" && encoding != "gzip" {
+		return nil
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if encoding == "gzip" {
+		reader, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		body, err = ioutil.ReadAll(reader)
+		if err != nil {
+			return err
+		}
+	}
+	body = rewriteBody(body, base, mediaType == "text/html")
+	if encoding == "gzip" {
+		var buf bytes.Buffer
+		writer := gzip.NewWriter(&buf)
+		if _, err := writer.Write(body); err != nil {
+			return err
+		}
+		if err := writer.Close(); err != nil {
+			return err
+		}
+		body = buf.Bytes()
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
+
+//SetRewrite This function enables the rewriting of the responses of the servers.
+// It is only used for routes in path mode and can be changed while the Serverlist is running.
+func (list *Serverlist) SetRewrite(rewrite bool) {
+	list.Mux.Lock()
+	list.rewrite = rewrite
+	list.Mux.Unlock()
+}
@@ -0,0 +1,38 @@
+package proxyfunctions
+
+import "testing"
+
+func TestRewriteBody(t *testing.T) {
+	const base = "/app/session/uid"
+	tests := []struct {
+		name string
+		body string
+		html bool
+		want string
+	}{
+		{"double quoted href", `<a href="/index.html">`, true, `<a href="/app/session/uid/index.html">`},
+		{"single quoted src", `<img src='/img/logo.png'>`, true, `<img src='/app/session/uid/img/logo.png'>`},
+		{"unquoted action", `<form action=/submit method=post>`, true, `<form action=/app/session/uid/submit method=post>`},
+		{"upper case attribute", `<A HREF="/x">`, true, `<A HREF="/app/session/uid/x">`},
+		{"relative url", `<a href="page.html">`, true, `<a href="page.html">`},
+		{"absolute url", `<a href="https://example.org/x">`, true, `<a href="https://example.org/x">`},
+		{"protocol relative url", `<script src="//cdn.example.org/x.js">`, true, `<script src="//cdn.example.org/x.js">`},
+		{"already rewritten", `<a href="/app/session/uid/x">`, true, `<a href="/app/session/uid/x">`},
+		{"public path itself", `<a href="/app/session/uid">`, true, `<a href="/app/session/uid">`},
+		{"prefix of the public path", `<a href="/app/session/uidx">`, true, `<a href="/app/session/uid/app/session/uidx">`},
+		{"data attribute", `<div data-href="/x">`, true, `<div data-href="/x">`},
+		{"css in html", `<div style="background: url(/bg.png)">`, true, `<div style="background: url(/app/session/uid/bg.png)">`},
+		{"css unquoted", `body { background: url(/bg.png) }`, false, `body { background: url(/app/session/uid/bg.png) }`},
+		{"css quoted", `@font-face { src: url( "/f.woff" ) }`, false, `@font-face { src: url("/app/session/uid/f.woff") }`},
+		{"css relative", `a { background: url(bg.png) }`, false, `a { background: url(bg.png) }`},
+		{"css attributes untouched", `a[href="/x"] { color: red }`, false, `a[href="/x"] { color: red }`},
+		{"several urls", `<a href="/a"><img src="/b">`, true, `<a href="/app/session/uid/a"><img src="/app/session/uid/b">`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := string(rewriteBody([]byte(test.body), base, test.html)); got != test.want {
+				t.Errorf("got %s, expected %s", got, test.want)
+			}
+		})
+	}
+}
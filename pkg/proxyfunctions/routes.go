@@ -0,0 +1,90 @@
+package proxyfunctions
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+//Route This is the public address of a Serverlist: the app name at the beginning of the
+// path and the DNS mode. New tickets are made out for the current route of the Serverlist.
+// After a reconfiguration, the sessions of the previous route can still be served
+// with a SessionHandler for this route until they end.
+type Route struct {
+	Prefix string
+	DNS    bool
+}
+
+//Session Returns the session ID of a request for this route, or an empty string.
+// In DNS mode, the session is the first label of the host, otherwise the first part
+// of the path after the prefix.
+func (route Route) Session(r *http.Request) string {
+	if route.DNS {
+		return strings.SplitN(r.Host, ".", 2)[0]
+	}
+	rest := strings.TrimPrefix(r.URL.Path, "/"+route.Prefix+"/")
+	if rest == r.URL.Path {
+		return ""
+	}
+	return strings.SplitN(rest, "/", 2)[0]
+}
+
+//Route Returns the current route of the Serverlist.
+func (list *Serverlist) Route() Route {
+	list.Mux.Lock()
+	defer list.Mux.Unlock()
+	return Route{Prefix: list.Prefix(), DNS: list.dns}
+}
+
+//SetRoute This function changes the route for new tickets. The clients waiting in the
+// queue get their tickets for the new route.
+// It returns the IDs of the sessions made out before, they keep using the old route.
+func (list *Serverlist) SetRoute(route Route) map[string]bool {
+	list.Mux.Lock()
+	defer list.Mux.Unlock()
+	list.prefixMux.Lock()
+	list.prefix = route.Prefix
+	list.prefixMux.Unlock()
+	list.dns = route.DNS
+	return list.sessionIDs()
+}
+
+//Sessions Returns the IDs of all current sessions.
+func (list *Serverlist) Sessions() map[string]bool {
+	list.Mux.Lock()
+	defer list.Mux.Unlock()
+	return list.sessionIDs()
+}
+
+//sessionIDs Returns a copy of the IDs of all current sessions.
+// It has to be called with the locked mux of the Serverlist.
+func (list *Serverlist) sessionIDs() map[string]bool {
+	sessions := make(map[string]bool, len(list.sessions))
+	for session := range list.sessions {
+		sessions[session] = true
+	}
+	return sessions
+}
+
+//LiveSessions Returns the number of the given sessions that did not end yet.
+func (list *Serverlist) LiveSessions(sessions map[string]bool) int {
+	list.Mux.Lock()
+	defer list.Mux.Unlock()
+	live := 0
+	for session := range sessions {
+		if _, ok := list.sessions[session]; ok {
+			live++
+		}
+	}
+	return live
+}
+
+//SessionHandler Returns a handler for the sessions of a route. Unlike MainHandler, which
+// serves the sessions of the current route, it serves the sessions of a previous route.
+func (list *Serverlist) SessionHandler(route Route) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		list.callServer(w, r, route, vars["s"], vars["u"])
+	}
+}
@@ -0,0 +1,196 @@
+package proxyfunctions
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+//ErrTokenExpired is returned by Verify for a valid token that is older than the maximal age
+var ErrTokenExpired = errors.New("signer: token expired")
+
+//TicketClaims These are the signed contents of a ticket. The nonce makes every
+// token unique, even if two tickets are made out at the same time.
+type TicketClaims struct {
+	App      string `json:"app"`
+	Session  string `json:"sid"`
+	UID      string `json:"uid"`
+	IssuedAt int64  `json:"iat"`
+	Expiry   int64  `json:"exp"`
+	Nonce    string `json:"n"`
+	KeyID    string `json:"kid"`
+}
+
+//Signer A Signer creates and verifies HMAC-SHA256 signed tickets.
+// A token has the form base64url(claims).base64url(signature).
+// New tokens are signed with the current key, all other keys are still
+// accepted for verification. This allows the rotation of keys.
+// Developers: Lock the mux before you modify an object of this struct.
+type Signer struct {
+	keys    map[string][]byte
+	current string
+	maxAge  time.Duration
+	mux     sync.RWMutex
+}
+
+//NewSigner Creates a new Signer without keys. Tokens expire after maxAge.
+// No token can be signed or verified until the keys are set by SetKeys.
+func NewSigner(maxAge time.Duration) *Signer {
+	return &Signer{
+		keys:   make(map[string][]byte),
+		maxAge: maxAge,
+	}
+}
+
+//HasKeys Returns true if the keys of the Signer were set.
+func (signer *Signer) HasKeys() bool {
+	signer.mux.RLock()
+	defer signer.mux.RUnlock()
+	return len(signer.keys) > 0
+}
+
+//SetKeys Replaces the keys of the Signer. New tokens are signed with the key current.
+func (signer *Signer) SetKeys(keys map[string][]byte, current string) error {
+	if _, ok := keys[current]; !ok {
+		return errors.New("signer: current key " + current + " does not exist")
+	}
+	copied := make(map[string][]byte)
+	for id, key := range keys {
+		if len(key) == 0 {
+			return errors.New("signer: key " + id + " is empty")
+		}
+		copied[id] = key
+	}
+	signer.mux.Lock()
+	signer.keys = copied
+	signer.current = current
+	signer.mux.Unlock()
+	return nil
+}
+
+//sign Calculates the signature of the encoded claims.
+func sign(key []byte, payload string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+//Sign Creates a signed token for a ticket made out at now. The issue time, the expiry,
+// the nonce and the key id are set by the Signer.
+func (signer *Signer) Sign(claims TicketClaims, now time.Time) (string, error) {
+	signer.mux.RLock()
+	defer signer.mux.RUnlock()
+	if len(signer.keys) == 0 {
+		return "", errors.New("signer: no signing keys")
+	}
+	claims.IssuedAt = now.Unix()
+	claims.Expiry = now.Add(signer.maxAge).Unix()
+	claims.Nonce = tokenGenerator(8)
+	claims.KeyID = signer.current
+	data, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	signature := base64.RawURLEncoding.EncodeToString(sign(signer.keys[signer.current], payload))
+	return payload + "." + signature, nil
+}
+
+//Verify Checks the signature and the expiry of a token at now and returns its claims.
+// The signature is checked with all known keys before the claims are decoded,
+// so the claims of a token are never looked at unless a known key signed them.
+// The claims of an expired token are returned with ErrTokenExpired.
+func (signer *Signer) Verify(token string, now time.Time) (TicketClaims, error) {
+	var claims TicketClaims
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return claims, errors.New("signer: malformed token")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return claims, errors.New("signer: malformed token")
+	}
+	keyID := ""
+	signer.mux.RLock()
+	for id, key := range signer.keys {
+		if hmac.Equal(signature, sign(key, parts[0])) {
+			keyID = id
+			break
+		}
+	}
+	signer.mux.RUnlock()
+	if keyID == "" {
+		return claims, errors.New("signer: invalid signature")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return claims, errors.New("signer: malformed token")
+	}
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return claims, errors.New("signer: malformed token")
+	}
+	if claims.KeyID != keyID {
+		return claims, errors.New("signer: invalid signature")
+	}
+	if now.Unix() > claims.Expiry {
+		return claims, ErrTokenExpired
+	}
+	return claims, nil
+}
+
+//SetSigner This function enables signed tickets for the Serverlist.
+// It has to be called before the Serverlist is used.
+func (list *Serverlist) SetSigner(signer *Signer) {
+	list.Mux.Lock()
+	list.signer = signer
+	list.Mux.Unlock()
+}
+
+//verifyToken This function checks if a token was signed for the given app, session and user id.
+// ErrTokenExpired is only returned for an expired token of this session.
+// All tokens are accepted if the Serverlist has no Signer.
+func (list *Serverlist) verifyToken(token string, app string, session string, uid string) error {
+	if list.signer == nil {
+		return nil
+	}
+	claims, err := list.signer.Verify(token, list.Now())
+	if err != nil && err != ErrTokenExpired {
+		return err
+	}
+	if claims.App != app || claims.Session != session || claims.UID != uid {
+		return errors.New("signer: token was not made out for this session")
+	}
+	return err
+}
+
+//endExpiredTicket This function removes the ticket of a session whose token expired,
+// so that its slot is free for the next client at once.
+func (list *Serverlist) endExpiredTicket(session string, token string) {
+	list.Mux.Lock()
+	t, ok := list.sessions[session]
+	if !ok || t.token != token {
+		list.Mux.Unlock()
+		return
+	}
+	list.recordTicketEnd(t)
+	t.server.Mux.Lock()
+	delete(t.server.Tickets, token)
+	t.server.Mux.Unlock()
+	delete(list.sessions, session)
+	list.forgetTicket(token)
+	log.Println("Ticket: Ending expired ticket " + token)
+	go func() {
+		for _, channel := range list.Informers {
+			channel <- "delete ticket " + token
+		}
+	}()
+	list.Mux.Unlock()
+	list.deletionmanager()
+	list.querrymanager()
+}
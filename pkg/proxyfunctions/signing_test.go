@@ -0,0 +1,125 @@
+package proxyfunctions
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+//craftToken Signs the claims with key as they are, without the defaults of Sign.
+func craftToken(t *testing.T, claims TicketClaims, key []byte) string {
+	data, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(sign(key, payload))
+}
+
+func TestSignerVerify(t *testing.T) {
+	keys := map[string][]byte{"old": []byte("old secret"), "new": []byte("new secret")}
+	signer := NewSigner(time.Hour)
+	if err := signer.SetKeys(keys, "new"); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 1, 8, 10, 0, 0, 0, time.UTC)
+	valid, err := signer.Sign(TicketClaims{App: "app", Session: "s", UID: "u"}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	future := now.Add(time.Hour).Unix()
+	past := now.Add(-time.Minute).Unix()
+	parts := strings.Split(valid, ".")
+	tests := []struct {
+		name  string
+		token string
+		err   string
+	}{
+		{"valid", valid, ""},
+		{"expired by the clock", valid, "signer: token expired"},
+		{"rotated key", craftToken(t, TicketClaims{App: "app", Expiry: future, KeyID: "old"}, keys["old"]), ""},
+		{"unknown key", craftToken(t, TicketClaims{App: "app", Expiry: future, KeyID: "gone"}, []byte("gone")), "signer: invalid signature"},
+		{"other key id", craftToken(t, TicketClaims{App: "app", Expiry: future, KeyID: "new"}, keys["old"]), "signer: invalid signature"},
+		{"expired", craftToken(t, TicketClaims{App: "app", Expiry: past, KeyID: "new"}, keys["new"]), "signer: token expired"},
+		{"tampered claims", base64.RawURLEncoding.EncodeToString([]byte(`{"app":"other"}`)) + "." + parts[1], "signer: invalid signature"},
+		{"no separator", parts[0], "signer: malformed token"},
+		{"too many parts", valid + ".x", "signer: malformed token"},
+		{"bad signature encoding", parts[0] + ".!!", "signer: malformed token"},
+		{"signed garbage", "!!." + base64.RawURLEncoding.EncodeToString(sign(keys["new"], "!!")), "signer: malformed token"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			at := now
+			if test.name == "expired by the clock" {
+				at = now.Add(time.Hour + time.Second)
+			}
+			claims, err := signer.Verify(test.token, at)
+			if test.err == "" {
+				if err != nil {
+					t.Fatalf("unexpected error %v", err)
+				}
+				if claims.App != "app" {
+					t.Errorf("app %q, expected %q", claims.App, "app")
+				}
+				return
+			}
+			if err == nil || err.Error() != test.err {
+				t.Errorf("error %v, expected %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestSignerWithoutKeys(t *testing.T) {
+	signer := NewSigner(time.Hour)
+	if signer.HasKeys() {
+		t.Error("a new Signer has keys")
+	}
+	if _, err := signer.Sign(TicketClaims{App: "app"}, time.Now()); err == nil {
+		t.Error("a Signer without keys signed a token")
+	}
+	token := craftToken(t, TicketClaims{App: "app", Expiry: time.Now().Add(time.Hour).Unix()}, []byte("secret"))
+	if _, err := signer.Verify(token, time.Now()); err == nil {
+		t.Error("a Signer without keys verified a token")
+	}
+}
+
+func TestExpiredTokenEndsTicket(t *testing.T) {
+	signer := NewSigner(time.Hour)
+	if err := signer.SetKeys(map[string][]byte{"key": []byte("secret")}, "key"); err != nil {
+		t.Fatal(err)
+	}
+	clock := &testClock{now: time.Date(2024, 1, 8, 10, 0, 0, 0, time.UTC)}
+	list := NewServerlist("app", false)
+	list.SetClock(clock)
+	list.SetSigner(signer)
+	defer close(list.Stop)
+	if err := list.AddServer("pod-1", 1, Config{Host: "10.0.0.1:80", Path: "/"}); err != nil {
+		t.Fatal(err)
+	}
+	list.Mux.Lock()
+	ticket, err := list.addTicket("")
+	list.Mux.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := func() int {
+		r := httptest.NewRequest("GET", "/app/"+ticket.session+"/"+ticket.uid+"/", nil)
+		r.AddCookie(&http.Cookie{Name: ticket.session + "-" + ticket.uid + "-stoken", Value: ticket.token})
+		w := httptest.NewRecorder()
+		list.callServer(w, r, list.Route(), ticket.session, ticket.uid)
+		return w.Code
+	}
+	//the session is still in use after the maximal age of its token
+	clock.add(time.Hour + time.Minute)
+	if code := request(); code != http.StatusForbidden {
+		t.Errorf("status %d for an expired token, expected %d", code, http.StatusForbidden)
+	}
+	if tickets := list.GetTickets(); tickets != 0 {
+		t.Errorf("%d tickets after the token expired, expected the slot to be free", tickets)
+	}
+}
@@ -0,0 +1,455 @@
+package proxyfunctions
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	//the time a client has to reconnect with a ticket that was restored from a TicketStore
+	restoreGrace = 60 * time.Second
+
+	//the interval for synchronizing the tickets with a shared store
+	syncPeriod = 5 * time.Second
+
+	//the usage of a ticket is written to a shared store at most once in this interval
+	touchPeriod = 30 * time.Second
+
+	//tickets that are used on other replicas are removed after this time without any usage in the store
+	sharedTicketTimeout = ticketTime + touchPeriod + 2*syncPeriod
+
+	//a token that was not found in a shared store is not looked up again for this time,
+	// the ticket is adopted by the next synchronization if it shows up later
+	missTimeout = syncPeriod
+)
+
+//TicketRecord This is the persisted part of a ticket. It has everything needed to
+// accept the cookie of a client again after k8sTicket was restarted.
+type TicketRecord struct {
+	Token    string    `json:"token"`
+	Server   string    `json:"server"`
+	UID      string    `json:"uid"`
+	Session  string    `json:"session"`
+	Created  time.Time `json:"created"`
+	LastUsed time.Time `json:"lastUsed"`
+}
+
+//TicketStore A TicketStore persists the active tickets of a Serverlist.
+// The Serverlist restores its tickets from the store when it is started.
+type TicketStore interface {
+	Load() ([]TicketRecord, error)
+	Get(token string) (TicketRecord, bool, error)
+	Save(record TicketRecord) error
+	Delete(token string) error
+}
+
+//MemoryTicketStore This is a TicketStore that keeps the tickets in memory.
+// It survives the rebuild of a Serverlist, but not a restart of k8sTicket.
+type MemoryTicketStore struct {
+	tickets map[string]TicketRecord
+	mux     sync.Mutex
+}
+
+//storeOp This is a queued operation for the TicketStore of the ticket token.
+// A record is saved, otherwise the token is deleted.
+type storeOp struct {
+	record *TicketRecord
+	token  string
+}
+
+//NewMemoryTicketStore Creates a new empty MemoryTicketStore.
+func NewMemoryTicketStore() *MemoryTicketStore {
+	return &MemoryTicketStore{tickets: make(map[string]TicketRecord)}
+}
+
+//Load Returns all stored tickets.
+func (store *MemoryTicketStore) Load() ([]TicketRecord, error) {
+	store.mux.Lock()
+	defer store.mux.Unlock()
+	records := make([]TicketRecord, 0, len(store.tickets))
+	for _, record := range store.tickets {
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+//Get Returns the stored ticket of a token, ok is false if the token is not stored.
+func (store *MemoryTicketStore) Get(token string) (record TicketRecord, ok bool, err error) {
+	store.mux.Lock()
+	defer store.mux.Unlock()
+	record, ok = store.tickets[token]
+	return record, ok, nil
+}
+
+//Save Stores a ticket.
+func (store *MemoryTicketStore) Save(record TicketRecord) error {
+	store.mux.Lock()
+	store.tickets[record.Token] = record
+	store.mux.Unlock()
+	return nil
+}
+
+//Delete Removes a ticket from the store.
+func (store *MemoryTicketStore) Delete(token string) error {
+	store.mux.Lock()
+	delete(store.tickets, token)
+	store.mux.Unlock()
+	return nil
+}
+
+//SetTicketStore This function connects a TicketStore to the Serverlist and loads
+// the stored tickets. The tickets are restored as soon as their server is added to
+// the Serverlist. Tickets of servers that do not show up within restoreGrace are dropped.
+// If the store is shared with other k8sTicket replicas, the Serverlist synchronizes
+// its tickets with the store, so that every replica can serve every ticket.
+// The store is connected even if the tickets could not be loaded, the error is returned
+// so that the caller can try again with RestoreTickets.
+// It has to be called before the first server is added.
+func (list *Serverlist) SetTicketStore(store TicketStore, shared bool) error {
+	list.Mux.Lock()
+	list.store = store
+	list.shared = shared
+	list.storeQueue = make(map[string]storeOp)
+	list.storeSignal = make(chan struct{}, 1)
+	list.storeDone = make(chan struct{})
+	list.restored = make(map[string][]TicketRecord)
+	list.misses = make(map[string]time.Time)
+	list.Mux.Unlock()
+	go list.storeWorker()
+	if shared {
+		go list.syncWorker()
+	}
+	return list.RestoreTickets()
+}
+
+//RestoreTickets This function loads the stored tickets of the TicketStore. The tickets of
+// servers that are already known are restored at once, the others as soon as their server
+// is added to the Serverlist. Tickets that are known already are skipped.
+func (list *Serverlist) RestoreTickets() error {
+	records, err := list.store.Load()
+	if err != nil {
+		return err
+	}
+	list.Mux.Lock()
+	defer list.Mux.Unlock()
+	list.restoredUntil = list.Now().Add(restoreGrace)
+	for _, record := range records {
+		if _, known := list.sessions[record.Session]; known {
+			continue
+		}
+		list.restored[record.Server] = append(list.restored[record.Server], record)
+	}
+	for name := range list.restored {
+		if _, ok := list.Servers[name]; ok {
+			list.restoreTickets(name)
+		}
+	}
+	log.Println("Store: ", list.Prefix(), ": loaded ", len(records), " tickets")
+	return nil
+}
+
+//FlushTicketStore This function waits until all queued store operations are written.
+// It returns immediately if there is no store. The Serverlist has to be stopped before.
+func (list *Serverlist) FlushTicketStore() {
+	if list.storeDone != nil {
+		<-list.storeDone
+	}
+}
+
+//storeWorker This function writes the queued operations to the store. The Serverlist
+// does not have to wait for the store in this way.
+// When the Serverlist is stopped, the remaining operations are written before it returns.
+func (list *Serverlist) storeWorker() {
+	defer close(list.storeDone)
+	for {
+		select {
+		case <-list.storeSignal:
+			list.applyStoreOps()
+		case <-list.Stop:
+			list.applyStoreOps()
+			return
+		}
+	}
+}
+
+//applyStoreOps Writes all queued operations to the store.
+func (list *Serverlist) applyStoreOps() {
+	list.storeMux.Lock()
+	ops := list.storeQueue
+	list.storeQueue = make(map[string]storeOp)
+	list.storeMux.Unlock()
+	for _, op := range ops {
+		list.applyStoreOp(op)
+	}
+}
+
+//applyStoreOp Writes one operation to the store.
+func (list *Serverlist) applyStoreOp(op storeOp) {
+	var err error
+	if op.record != nil {
+		err = list.store.Save(*op.record)
+	} else {
+		err = list.store.Delete(op.token)
+	}
+	if err != nil {
+		log.Println("Store: ", list.Prefix(), ": ", err)
+	}
+}
+
+//persistTicket Queues a ticket for the store.
+// The ticket has to be locked if it can be used concurrently.
+func (list *Serverlist) persistTicket(t *ticket) {
+	if list.store == nil {
+		return
+	}
+	t.stored = t.LastUsed
+	list.queueStoreOp(storeOp{token: t.token, record: &TicketRecord{
+		Token:    t.token,
+		Server:   t.server.Name,
+		UID:      t.uid,
+		Session:  t.session,
+		Created:  t.created,
+		LastUsed: t.LastUsed,
+	}})
+}
+
+//forgetTicket Queues the deletion of a ticket for the store.
+func (list *Serverlist) forgetTicket(token string) {
+	if list.store == nil {
+		return
+	}
+	list.queueStoreOp(storeOp{token: token})
+}
+
+//queueStoreOp Queues an operation for the storeWorker. It never waits for the store, because
+// it is called with the locked mux of the Serverlist: an operation replaces the queued operation
+// of the same ticket that was not written yet, so the queue does not grow while the store is slow.
+// Operations are dropped when the Serverlist is stopped.
+func (list *Serverlist) queueStoreOp(op storeOp) {
+	select {
+	case <-list.Stop:
+		log.Println("Store: ", list.Prefix(), ": Serverlist stopped, dropping store operation")
+		return
+	default:
+	}
+	list.storeMux.Lock()
+	list.storeQueue[op.token] = op
+	list.storeMux.Unlock()
+	select {
+	case list.storeSignal <- struct{}{}:
+	default:
+		//the storeWorker has not picked up the last signal yet
+	}
+}
+
+//restoreTickets This function adds the restored tickets of a server that was
+// just added to the Serverlist. The clients have restoreGrace to reconnect.
+// It has to be called with the locked mux of the Serverlist.
+func (list *Serverlist) restoreTickets(name string) {
+	records, ok := list.restored[name]
+	if !ok {
+		return
+	}
+	delete(list.restored, name)
+	server := list.Servers[name]
+	server.Mux.Lock()
+	for _, record := range records {
+		t := &ticket{
+			//LastUsed is in the future, so the TicketWatchdog waits for the client
+			LastUsed: list.Now().Add(restoreGrace),
+			created:  record.Created,
+			server:   server,
+			token:    record.Token,
+			uid:      record.UID,
+			session:  record.Session,
+		}
+		server.Tickets[record.Token] = t
+		list.sessions[record.Session] = t
+		log.Println("Ticket: Restoring ticket " + record.Token + " on " + name)
+	}
+	server.Mux.Unlock()
+	go func() {
+		for _, channel := range list.Informers {
+			channel <- "restore ticket"
+		}
+	}()
+}
+
+//expireRestored This function drops the restored tickets of servers that did not
+// show up within restoreGrace.
+// It has to be called with the locked mux of the Serverlist.
+func (list *Serverlist) expireRestored() {
+	if len(list.restored) == 0 || list.Now().Before(list.restoredUntil) {
+		return
+	}
+	for name, records := range list.restored {
+		for _, record := range records {
+			log.Println("Ticket: Dropping restored ticket " + record.Token + ", server " + name + " is gone")
+			list.forgetTicket(record.Token)
+		}
+	}
+	list.restored = make(map[string][]TicketRecord)
+}
+
+//ticketTimeout Returns the time after which an unused ticket is removed.
+// Tickets adopted from a shared store are used on other replicas, their usage
+// is only known from the store.
+func ticketTimeout(t *ticket) time.Duration {
+	if t.remote {
+		return sharedTicketTimeout
+	}
+	return ticketTime
+}
+
+//syncWorker This function synchronizes the tickets with the shared store until
+// the Serverlist is stopped.
+func (list *Serverlist) syncWorker() {
+	ticker := time.NewTicker(syncPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			list.syncTickets()
+		case <-list.Stop:
+			return
+		}
+	}
+}
+
+//syncTickets This function merges the tickets of the shared store with the local ones.
+// Tickets made out by other replicas are adopted, tickets removed by other replicas
+// are removed here as well. Tickets in use here are written back to the store, if
+// they are missing there or their usage was not written for touchPeriod.
+func (list *Serverlist) syncTickets() {
+	records, err := list.store.Load()
+	if err != nil {
+		log.Println("Store: ", list.Prefix(), ": sync: ", err)
+		return
+	}
+	stored := make(map[string]TicketRecord)
+	for _, record := range records {
+		stored[record.Token] = record
+	}
+	now := list.Now()
+	list.Mux.Lock()
+	defer list.Mux.Unlock()
+	known := make(map[string]bool)
+	for _, server := range list.Servers {
+		server.Mux.Lock()
+		for token, t := range server.Tickets {
+			token := token
+			known[token] = true
+			t.Mux.Lock()
+			record, ok := stored[token]
+			switch {
+			case ok:
+				if record.LastUsed.After(t.LastUsed) {
+					t.LastUsed = record.LastUsed
+				} else if !t.remote && t.LastUsed.Sub(t.stored) > touchPeriod {
+					list.persistTicket(t)
+				}
+			case t.remote || (now.Sub(t.LastUsed) > ticketTime && now.Sub(t.created) > 2*syncPeriod):
+				//another replica removed the ticket
+				log.Println("Ticket: Sync: Deleting ticket " + token)
+				delete(server.Tickets, token)
+				delete(list.sessions, t.session)
+				go func() {
+					for _, channel := range list.Informers {
+						channel <- "delete ticket " + token
+					}
+				}()
+			default:
+				//the ticket is in use here, but another replica removed it
+				list.persistTicket(t)
+			}
+			t.Mux.Unlock()
+		}
+		server.Mux.Unlock()
+	}
+	for token, record := range stored {
+		if known[token] {
+			continue
+		}
+		if list.adoptRecord(record) {
+			log.Println("Ticket: Sync: Adopting ticket " + token + " on " + record.Server)
+		}
+	}
+}
+
+//adoptRecord Adds a ticket of another replica to its server, if the server is known.
+// It has to be called with the locked mux of the Serverlist.
+func (list *Serverlist) adoptRecord(record TicketRecord) bool {
+	server, ok := list.Servers[record.Server]
+	if !ok {
+		return false
+	}
+	server.Mux.Lock()
+	t := &ticket{
+		LastUsed: record.LastUsed,
+		created:  record.Created,
+		stored:   record.LastUsed,
+		server:   server,
+		token:    record.Token,
+		uid:      record.UID,
+		session:  record.Session,
+		remote:   true,
+	}
+	server.Tickets[record.Token] = t
+	list.sessions[record.Session] = t
+	server.Mux.Unlock()
+	go func() {
+		for _, channel := range list.Informers {
+			channel <- "sync ticket"
+		}
+	}()
+	return true
+}
+
+//adoptTicket This function looks up a session that is unknown to this replica in the
+// shared store. In this way a client can use any replica right after another replica
+// made out its ticket, without waiting for the next synchronization.
+// Only the ticket of the token is read. Tokens that are not stored are not looked up
+// again for missTimeout, e.g. the stale cookies of ended sessions.
+func (list *Serverlist) adoptTicket(session string, token string) {
+	if !list.shared {
+		return
+	}
+	list.Mux.Lock()
+	_, known := list.sessions[session]
+	missed := list.Now().Before(list.misses[token])
+	list.Mux.Unlock()
+	if known || missed {
+		return
+	}
+	record, ok, err := list.store.Get(token)
+	if err != nil {
+		log.Println("Store: ", list.Prefix(), ": adoptTicket: ", err)
+		return
+	}
+	list.Mux.Lock()
+	defer list.Mux.Unlock()
+	if !ok || record.Session != session {
+		list.missTicket(token)
+		return
+	}
+	if _, known := list.sessions[session]; known {
+		//adopted by the synchronization in the meantime
+		return
+	}
+	if list.adoptRecord(record) {
+		log.Println("Ticket: Adopting ticket " + token + " on " + record.Server)
+	}
+}
+
+//missTicket Remembers a token that is not in the shared store for missTimeout.
+// It has to be called with the locked mux of the Serverlist.
+func (list *Serverlist) missTicket(token string) {
+	now := list.Now()
+	for missed, until := range list.misses {
+		if now.After(until) {
+			delete(list.misses, missed)
+		}
+	}
+	list.misses[token] = now.Add(missTimeout)
+}
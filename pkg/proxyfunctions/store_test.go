@@ -0,0 +1,100 @@
+package proxyfunctions
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+//countingStore This is a MemoryTicketStore that counts the reads.
+type countingStore struct {
+	*MemoryTicketStore
+	mux   sync.Mutex
+	loads int
+	gets  int
+}
+
+func (store *countingStore) Load() ([]TicketRecord, error) {
+	store.mux.Lock()
+	store.loads++
+	store.mux.Unlock()
+	return store.MemoryTicketStore.Load()
+}
+
+func (store *countingStore) Get(token string) (TicketRecord, bool, error) {
+	store.mux.Lock()
+	store.gets++
+	store.mux.Unlock()
+	return store.MemoryTicketStore.Get(token)
+}
+
+//testClock This is a Clock that is moved by the test.
+type testClock struct {
+	mux sync.Mutex
+	now time.Time
+}
+
+func (clock *testClock) Now() time.Time {
+	clock.mux.Lock()
+	defer clock.mux.Unlock()
+	return clock.now
+}
+
+func (clock *testClock) add(d time.Duration) {
+	clock.mux.Lock()
+	clock.now = clock.now.Add(d)
+	clock.mux.Unlock()
+}
+
+func TestAdoptTicket(t *testing.T) {
+	store := &countingStore{MemoryTicketStore: NewMemoryTicketStore()}
+	clock := &testClock{now: time.Now()}
+	list := NewServerlist("app", false)
+	list.SetClock(clock)
+	defer close(list.Stop)
+	if err := list.SetTicketStore(store, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := list.AddServer("pod-1", 2, Config{Host: "10.0.0.1:80", Path: "/"}); err != nil {
+		t.Fatal(err)
+	}
+	//another replica makes out a ticket after the start
+	now := clock.Now()
+	if err := store.Save(TicketRecord{Token: "t1", Server: "pod-1", Session: "s1", Created: now, LastUsed: now}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		session string
+		token   string
+		gets    int
+		adopted bool
+	}{
+		{"stored ticket is adopted", "s1", "t1", 1, true},
+		{"known session is not looked up", "s1", "t1", 1, true},
+		{"unknown token is looked up", "s2", "stale", 2, false},
+		{"missed token is not looked up again", "s2", "stale", 2, false},
+		{"token of another session is not adopted", "s3", "t1", 3, false},
+	}
+	for _, test := range tests {
+		list.adoptTicket(test.session, test.token)
+		store.mux.Lock()
+		gets, loads := store.gets, store.loads
+		store.mux.Unlock()
+		list.Mux.Lock()
+		_, adopted := list.sessions[test.session]
+		list.Mux.Unlock()
+		if gets != test.gets || loads != 1 || adopted != test.adopted {
+			t.Errorf("%s: %d gets, %d loads, adopted %v, expected %d gets, 1 load, adopted %v",
+				test.name, gets, loads, adopted, test.gets, test.adopted)
+		}
+	}
+	//the miss expires
+	clock.add(missTimeout + time.Second)
+	list.adoptTicket("s2", "stale")
+	store.mux.Lock()
+	defer store.mux.Unlock()
+	if store.gets != 4 {
+		t.Errorf("%d gets after missTimeout, expected 4", store.gets)
+	}
+}